@@ -0,0 +1,245 @@
+// Package breaker 客户端熔断器
+//
+// 每个上游服务一个熔断器。连续失败达到阈值后熔断器打开，请求直接失败而不再等待超时；
+// 经过 OpenTimeout 后进入半开状态，放行少量试探请求，试探成功则关闭，失败则重新打开。
+// 状态变化会作为事件发布给订阅者，并通过 /breakers 提供给监控服务。
+package breaker
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// State 熔断器状态
+type State int
+
+const (
+	Closed   State = iota // 正常放行请求
+	Open                  // 请求直接失败
+	HalfOpen              // 放行少量试探请求
+)
+
+// String 返回状态的名称
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// MarshalText 在 JSON 中以名称表示状态
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText 从名称解析状态
+func (s *State) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "closed":
+		*s = Closed
+	case "open":
+		*s = Open
+	case "half-open":
+		*s = HalfOpen
+	default:
+		return errors.New("unknown circuit breaker state " + string(text))
+	}
+	return nil
+}
+
+// ErrOpen 熔断器打开（或半开且试探请求已满）时返回的错误
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Config 熔断器的阈值，零值字段使用 DefaultConfig 中的值
+type Config struct {
+	FailureThreshold int           // 关闭状态下连续失败多少次后打开
+	OpenTimeout      time.Duration // 打开多久后进入半开状态
+	HalfOpenRequests int           // 半开状态同时放行的试探请求数
+	SuccessThreshold int           // 半开状态连续成功多少次后关闭
+}
+
+// DefaultConfig 返回默认的熔断器配置
+func DefaultConfig() Config {
+	return Config{
+		FailureThreshold: 5,
+		OpenTimeout:      30 * time.Second,
+		HalfOpenRequests: 1,
+		SuccessThreshold: 1,
+	}
+}
+
+// withDefaults 用默认值补全没有设置的字段
+func (c Config) withDefaults() Config {
+	def := DefaultConfig()
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = def.FailureThreshold
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = def.OpenTimeout
+	}
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = def.HalfOpenRequests
+	}
+	if c.SuccessThreshold <= 0 {
+		c.SuccessThreshold = def.SuccessThreshold
+	}
+	return c
+}
+
+// Status 熔断器当前的状态
+type Status struct {
+	Name     string    `json:"name"`
+	State    State     `json:"state"`
+	Failures int       `json:"failures"`         // 连续失败的次数
+	Since    time.Time `json:"since"`            // 进入当前状态的时间
+	RetryAt  time.Time `json:"retryAt,omitzero"` // 打开状态下进入半开的时间
+}
+
+// Event 熔断器的一次状态变化
+type Event struct {
+	Seq  uint64    `json:"seq"` // 在所属 Set 中递增的序号
+	Name string    `json:"name"`
+	From State     `json:"from"`
+	To   State     `json:"to"`
+	Time time.Time `json:"time"`
+}
+
+// Breaker 一个上游服务的熔断器
+type Breaker struct {
+	name      string
+	cfg       Config
+	set       *Set
+	mutex     sync.Mutex
+	state     State
+	since     time.Time
+	failures  int
+	successes int
+	inflight  int    // 半开状态下进行中的试探请求
+	gen       uint64 // 每次状态变化递增，丢弃上一个状态中发出的请求的结果
+}
+
+// New 创建一个不属于任何 Set 的熔断器，状态变化只写日志
+func New(name string, cfg Config) *Breaker {
+	return &Breaker{name: name, cfg: cfg.withDefaults(), since: time.Now()}
+}
+
+// Name 返回熔断器的名称
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+// Allow 判断是否放行一个请求
+// 放行时返回 done，请求结束后必须调用一次，success 表示上游是否正常处理了请求；
+// 不放行时返回 ErrOpen
+func (b *Breaker) Allow() (done func(success bool), err error) {
+	b.mutex.Lock()
+	now := time.Now()
+	var ev *Event
+	if b.state == Open && now.Sub(b.since) >= b.cfg.OpenTimeout {
+		ev = b.transition(HalfOpen, now)
+	}
+	switch {
+	case b.state == Open, b.state == HalfOpen && b.inflight >= b.cfg.HalfOpenRequests:
+		b.mutex.Unlock()
+		b.publish(ev)
+		return nil, ErrOpen
+	case b.state == HalfOpen:
+		b.inflight++
+	}
+	gen := b.gen
+	b.mutex.Unlock()
+	b.publish(ev)
+
+	var once sync.Once
+	return func(success bool) {
+		once.Do(func() { b.record(gen, success) })
+	}, nil
+}
+
+// Do 在熔断器保护下执行 fn，fn 返回错误时计为失败
+func (b *Breaker) Do(fn func() error) error {
+	done, err := b.Allow()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	done(err == nil)
+	return err
+}
+
+// record 记录一个请求的结果，gen 不是当前状态时忽略
+func (b *Breaker) record(gen uint64, success bool) {
+	b.mutex.Lock()
+	if gen != b.gen {
+		b.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	var ev *Event
+	switch b.state {
+	case Closed:
+		if success {
+			b.failures = 0
+		} else if b.failures++; b.failures >= b.cfg.FailureThreshold {
+			ev = b.transition(Open, now)
+		}
+	case HalfOpen:
+		b.inflight--
+		if !success {
+			b.failures++
+			ev = b.transition(Open, now)
+		} else if b.successes++; b.successes >= b.cfg.SuccessThreshold {
+			ev = b.transition(Closed, now)
+		}
+	}
+	b.mutex.Unlock()
+	b.publish(ev)
+}
+
+// transition 切换到新状态并返回要发布的事件，调用方需持有锁
+func (b *Breaker) transition(to State, now time.Time) *Event {
+	ev := &Event{Name: b.name, From: b.state, To: to, Time: now}
+	b.state = to
+	b.since = now
+	b.successes = 0
+	b.inflight = 0
+	b.gen++
+	if to == Closed {
+		b.failures = 0
+	}
+	return ev
+}
+
+// publish 在锁外发布状态变化
+func (b *Breaker) publish(ev *Event) {
+	if ev == nil {
+		return
+	}
+	log.Printf("Circuit breaker %s: %v -> %v\n", ev.Name, ev.From, ev.To)
+	if b.set != nil {
+		b.set.publish(*ev)
+	}
+}
+
+// State 返回熔断器当前的状态
+func (b *Breaker) State() State {
+	return b.Status().State
+}
+
+// Status 返回熔断器的状态信息
+func (b *Breaker) Status() Status {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	s := Status{Name: b.name, State: b.state, Failures: b.failures, Since: b.since}
+	if b.state == Open {
+		s.RetryAt = b.since.Add(b.cfg.OpenTimeout)
+	}
+	return s
+}
@@ -0,0 +1,143 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// results 依次以给定的结果执行请求，熔断器拒绝的请求不计入
+func results(b *Breaker, outcomes ...bool) {
+	for _, ok := range outcomes {
+		if done, err := b.Allow(); err == nil {
+			done(ok)
+		}
+	}
+}
+
+func TestBreakerThresholds(t *testing.T) {
+	cases := []struct {
+		name      string
+		threshold int
+		outcomes  []bool
+		want      State
+		failures  int
+	}{
+		{"no failures", 3, []bool{true, true}, Closed, 0},
+		{"below threshold", 3, []bool{false, false}, Closed, 2},
+		{"reaches threshold", 3, []bool{false, false, false}, Open, 3},
+		{"success resets the count", 3, []bool{false, false, true, false, false}, Closed, 2},
+		{"default threshold", 0, []bool{false, false, false, false}, Closed, 4},
+		{"default threshold reached", 0, []bool{false, false, false, false, false}, Open, 5},
+		{"open rejects further requests", 1, []bool{false, true, true}, Open, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := New("orders", Config{FailureThreshold: c.threshold, OpenTimeout: time.Hour})
+			results(b, c.outcomes...)
+			if st := b.Status(); st.State != c.want || st.Failures != c.failures {
+				t.Fatalf("breaker is %v with %d failures, want %v with %d", st.State, st.Failures, c.want, c.failures)
+			}
+		})
+	}
+}
+
+func TestBreakerCooldown(t *testing.T) {
+	b := New("orders", Config{FailureThreshold: 1, OpenTimeout: 50 * time.Millisecond})
+	results(b, false)
+	st := b.Status()
+	if st.State != Open || !st.RetryAt.Equal(st.Since.Add(50*time.Millisecond)) {
+		t.Fatalf("status %+v", st)
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrOpen) {
+		t.Fatalf("open breaker allowed a request: %v", err)
+	}
+	if err := b.Do(func() error { t.Fatal("open breaker ran fn"); return nil }); !errors.Is(err, ErrOpen) {
+		t.Fatalf("Do on open breaker returned %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	done, err := b.Allow()
+	if err != nil {
+		t.Fatalf("breaker still open after the cooldown: %v", err)
+	}
+	if b.State() != HalfOpen {
+		t.Fatalf("breaker is %v after the cooldown", b.State())
+	}
+	done(true)
+	if b.State() != Closed || b.Status().Failures != 0 {
+		t.Fatalf("breaker is %+v after a successful probe", b.Status())
+	}
+}
+
+func TestBreakerHalfOpenProbe(t *testing.T) {
+	cases := []struct {
+		name     string
+		cfg      Config
+		outcomes []bool // 依次完成的试探请求
+		want     State
+	}{
+		{"probe succeeds", Config{}, []bool{true}, Closed},
+		{"probe fails", Config{}, []bool{false}, Open},
+		{"needs two successes", Config{SuccessThreshold: 2, HalfOpenRequests: 2}, []bool{true}, HalfOpen},
+		{"two successes close", Config{SuccessThreshold: 2, HalfOpenRequests: 2}, []bool{true, true}, Closed},
+		{"failure after a success reopens", Config{SuccessThreshold: 2, HalfOpenRequests: 2}, []bool{true, false}, Open},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.cfg.FailureThreshold = 1
+			c.cfg.OpenTimeout = 20 * time.Millisecond
+			b := New("orders", c.cfg)
+			results(b, false)
+			time.Sleep(30 * time.Millisecond)
+
+			// 半开状态只放行 HalfOpenRequests 个试探请求
+			var probes []func(bool)
+			for range b.cfg.HalfOpenRequests {
+				done, err := b.Allow()
+				if err != nil {
+					t.Fatalf("probe rejected: %v", err)
+				}
+				probes = append(probes, done)
+			}
+			if _, err := b.Allow(); !errors.Is(err, ErrOpen) {
+				t.Fatalf("half-open breaker allowed more than %d probes", b.cfg.HalfOpenRequests)
+			}
+			for i, ok := range c.outcomes {
+				probes[i](ok)
+			}
+			if b.State() != c.want {
+				t.Fatalf("breaker is %v, want %v", b.State(), c.want)
+			}
+		})
+	}
+}
+
+func TestBreakerIgnoresStaleResults(t *testing.T) {
+	b := New("orders", Config{FailureThreshold: 2, OpenTimeout: time.Hour})
+	slow, _ := b.Allow()
+	results(b, false, false)
+	if b.State() != Open {
+		t.Fatalf("breaker is %v", b.State())
+	}
+	// 打开之前发出的请求的结果不影响新状态，done 只生效一次
+	slow(true)
+	slow(true)
+	if b.State() != Open || b.Status().Failures != 2 {
+		t.Fatalf("stale result changed the breaker: %+v", b.Status())
+	}
+}
+
+func TestStateText(t *testing.T) {
+	for _, s := range []State{Closed, Open, HalfOpen} {
+		text, _ := s.MarshalText()
+		var got State
+		if err := got.UnmarshalText(text); err != nil || got != s {
+			t.Fatalf("%v round-tripped to %v, %v", s, got, err)
+		}
+	}
+	var s State
+	if err := s.UnmarshalText([]byte("broken")); err == nil {
+		t.Fatal("unknown state was accepted")
+	}
+}
@@ -0,0 +1,177 @@
+package breaker
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// historySize 每个 Set 保留的最近状态变化事件数
+const historySize = 256
+
+// Set 按名称管理一组熔断器，并记录它们的状态变化
+type Set struct {
+	mutex       sync.Mutex
+	cfg         Config
+	configs     map[string]Config
+	breakers    map[string]*Breaker
+	history     []Event
+	seq         uint64
+	subscribers map[uint64]func(Event)
+	nextSub     uint64
+}
+
+// NewSet 创建一组熔断器，新建的熔断器使用 cfg
+func NewSet(cfg Config) *Set {
+	return &Set{
+		cfg:         cfg.withDefaults(),
+		configs:     make(map[string]Config),
+		breakers:    make(map[string]*Breaker),
+		subscribers: make(map[uint64]func(Event)),
+	}
+}
+
+// Default 进程内共享的熔断器，discovery.Transport 默认使用它
+var Default = NewSet(DefaultConfig())
+
+// Configure 设置名为 name 的熔断器的配置，name 为空时设置默认配置
+// 只影响之后新建的熔断器，应当在发出请求之前调用
+func (s *Set) Configure(name string, cfg Config) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if name == "" {
+		s.cfg = cfg.withDefaults()
+		return
+	}
+	s.configs[name] = cfg.withDefaults()
+}
+
+// Get 返回名为 name 的熔断器，不存在时创建
+func (s *Set) Get(name string) *Breaker {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if b, ok := s.breakers[name]; ok {
+		return b
+	}
+	cfg, ok := s.configs[name]
+	if !ok {
+		cfg = s.cfg
+	}
+	b := New(name, cfg)
+	b.set = s
+	s.breakers[name] = b
+	return b
+}
+
+// Statuses 返回所有熔断器的状态，按名称排序
+func (s *Set) Statuses() []Status {
+	s.mutex.Lock()
+	breakers := make([]*Breaker, 0, len(s.breakers))
+	for _, b := range s.breakers {
+		breakers = append(breakers, b)
+	}
+	s.mutex.Unlock()
+
+	result := make([]Status, 0, len(breakers))
+	for _, b := range breakers {
+		result = append(result, b.Status())
+	}
+	slices.SortFunc(result, func(a, b Status) int { return strings.Compare(a.Name, b.Name) })
+	return result
+}
+
+// Events 返回序号大于 since 的状态变化事件
+func (s *Set) Events(since uint64) []Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var events []Event
+	for _, ev := range s.history {
+		if ev.Seq > since {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+// Subscribe 订阅状态变化，fn 在发生变化的 goroutine 中同步调用，不能阻塞
+// 返回的函数取消订阅
+func (s *Set) Subscribe(fn func(Event)) (cancel func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id := s.nextSub
+	s.nextSub++
+	s.subscribers[id] = fn
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.subscribers, id)
+	}
+}
+
+// publish 记录事件并通知订阅者
+func (s *Set) publish(ev Event) {
+	s.mutex.Lock()
+	s.seq++
+	ev.Seq = s.seq
+	s.history = append(s.history, ev)
+	if len(s.history) > historySize {
+		s.history = append(s.history[:0], s.history[len(s.history)-historySize:]...)
+	}
+	subscribers := make([]func(Event), 0, len(s.subscribers))
+	for _, fn := range s.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	s.mutex.Unlock()
+
+	for _, fn := range subscribers {
+		fn(ev)
+	}
+}
+
+// Report /breakers 的响应
+type Report struct {
+	Breakers []Status `json:"breakers"`
+	Events   []Event  `json:"events"`
+}
+
+// ServeHTTP 返回所有熔断器的状态和 ?since= 之后的状态变化事件
+func (s *Set) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+	report := Report{Breakers: s.Statuses(), Events: s.Events(since)}
+	if report.Events == nil {
+		report.Events = []Event{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Get 返回默认 Set 中名为 name 的熔断器
+func Get(name string) *Breaker {
+	return Default.Get(name)
+}
+
+// Configure 设置默认 Set 中熔断器的配置
+func Configure(name string, cfg Config) {
+	Default.Configure(name, cfg)
+}
+
+// Statuses 返回默认 Set 中所有熔断器的状态
+func Statuses() []Status {
+	return Default.Statuses()
+}
+
+// Subscribe 订阅默认 Set 中熔断器的状态变化
+func Subscribe(fn func(Event)) (cancel func()) {
+	return Default.Subscribe(fn)
+}
@@ -0,0 +1,86 @@
+package breaker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSetConfigure(t *testing.T) {
+	s := NewSet(Config{FailureThreshold: 2, OpenTimeout: time.Hour})
+	s.Configure("payments", Config{FailureThreshold: 1, OpenTimeout: time.Hour})
+
+	if s.Get("orders") != s.Get("orders") {
+		t.Fatal("Get created a second breaker for the same name")
+	}
+	results(s.Get("orders"), false)
+	results(s.Get("payments"), false)
+	if got := s.Get("orders").State(); got != Closed {
+		t.Fatalf("orders is %v after one failure with threshold 2", got)
+	}
+	if got := s.Get("payments").State(); got != Open {
+		t.Fatalf("payments is %v after one failure with threshold 1", got)
+	}
+
+	statuses := s.Statuses()
+	if len(statuses) != 2 || statuses[0].Name != "orders" || statuses[1].Name != "payments" {
+		t.Fatalf("statuses %+v", statuses)
+	}
+}
+
+func TestSetEvents(t *testing.T) {
+	s := NewSet(Config{FailureThreshold: 1, OpenTimeout: 20 * time.Millisecond})
+	var received []Event
+	cancel := s.Subscribe(func(ev Event) { received = append(received, ev) })
+
+	b := s.Get("orders")
+	results(b, false)
+	time.Sleep(30 * time.Millisecond)
+	results(b, true)
+
+	want := []struct{ from, to State }{{Closed, Open}, {Open, HalfOpen}, {HalfOpen, Closed}}
+	events := s.Events(0)
+	if len(events) != len(want) || len(received) != len(want) {
+		t.Fatalf("events %+v, received %+v", events, received)
+	}
+	for i, w := range want {
+		if events[i].Seq != uint64(i+1) || events[i].Name != "orders" || events[i].From != w.from || events[i].To != w.to {
+			t.Fatalf("event %d is %+v, want %v -> %v", i, events[i], w.from, w.to)
+		}
+		if received[i] != events[i] {
+			t.Fatalf("subscriber received %+v, history has %+v", received[i], events[i])
+		}
+	}
+	if since := s.Events(2); len(since) != 1 || since[0].Seq != 3 {
+		t.Fatalf("events since 2: %+v", since)
+	}
+
+	cancel()
+	results(s.Get("payments"), false)
+	if len(received) != len(want) {
+		t.Fatalf("cancelled subscriber received %+v", received[len(want):])
+	}
+}
+
+func TestSetServeHTTP(t *testing.T) {
+	s := NewSet(Config{FailureThreshold: 1, OpenTimeout: time.Hour})
+	results(s.Get("orders"), false)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/breakers?since=1", nil))
+	var report Report
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Breakers) != 1 || report.Breakers[0].State != Open || report.Events == nil || len(report.Events) != 0 {
+		t.Fatalf("report %+v", report)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/breakers?since=x", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid since returned %d", rec.Code)
+	}
+}
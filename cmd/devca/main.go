@@ -0,0 +1,104 @@
+// devca 本地开发用的简易CA
+//
+//	devca init  -dir ./certs                                  生成 ca.pem 和 ca-key.pem
+//	devca issue -dir ./certs -name LogService [-hosts localhost,127.0.0.1]
+//	                                                          签发 LogService.pem 和 LogService-key.pem
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/linshule/go-distributed/tlsutil"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "init":
+		err = initCA(os.Args[2:])
+	case "issue":
+		err = issue(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: devca init -dir DIR | devca issue -dir DIR -name SERVICE [-hosts HOSTS]")
+	os.Exit(2)
+}
+
+func initCA(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	dir := fs.String("dir", "./certs", "证书目录")
+	validFor := fs.Duration("valid", 10*365*24*time.Hour, "有效期")
+	fs.Parse(args)
+
+	certFile, keyFile := filepath.Join(*dir, "ca.pem"), filepath.Join(*dir, "ca-key.pem")
+	if _, err := os.Stat(certFile); err == nil {
+		return fmt.Errorf("%s already exists", certFile)
+	}
+	certPEM, keyPEM, err := tlsutil.NewCA("go-distributed dev CA", *validFor)
+	if err != nil {
+		return err
+	}
+	if err := write(*dir, certFile, certPEM, keyFile, keyPEM); err != nil {
+		return err
+	}
+	fmt.Println("CA written to", certFile)
+	return nil
+}
+
+func issue(args []string) error {
+	fs := flag.NewFlagSet("issue", flag.ExitOnError)
+	dir := fs.String("dir", "./certs", "证书目录，需要包含 ca.pem 和 ca-key.pem")
+	name := fs.String("name", "", "服务名称，写入证书的 CN，注册时必须与 ServiceName 一致")
+	hosts := fs.String("hosts", "localhost,127.0.0.1", "证书适用的主机名或IP，以逗号分隔")
+	validFor := fs.Duration("valid", 365*24*time.Hour, "有效期")
+	fs.Parse(args)
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+
+	caCert, err := os.ReadFile(filepath.Join(*dir, "ca.pem"))
+	if err != nil {
+		return err
+	}
+	caKey, err := os.ReadFile(filepath.Join(*dir, "ca-key.pem"))
+	if err != nil {
+		return err
+	}
+	certPEM, keyPEM, err := tlsutil.IssueCert(caCert, caKey, *name, strings.Split(*hosts, ","), *validFor)
+	if err != nil {
+		return err
+	}
+	certFile, keyFile := filepath.Join(*dir, *name+".pem"), filepath.Join(*dir, *name+"-key.pem")
+	if err := write(*dir, certFile, certPEM, keyFile, keyPEM); err != nil {
+		return err
+	}
+	fmt.Printf("Certificate for %s written to %s\n", *name, certFile)
+	return nil
+}
+
+func write(dir, certFile string, certPEM []byte, keyFile string, keyPEM []byte) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, keyPEM, 0o600)
+}
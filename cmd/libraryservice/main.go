@@ -2,33 +2,41 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	stlog "log"
 
 	"github.com/linshule/go-distributed/library"
 	"github.com/linshule/go-distributed/registry"
 	"github.com/linshule/go-distributed/service"
+	"github.com/linshule/go-distributed/tlsutil"
 )
 
 func main() {
+	registry.AddFlags(flag.CommandLine)
+	flag.Parse()
 	host, port := "localhost", "5000"
-	serviceAddress := fmt.Sprintf("http://%s:%s", host, port)
+	serviceAddress := fmt.Sprintf("%s://%s:%s", tlsutil.Scheme(), host, port)
 	r := registry.Registration{
 		ServiceName:    registry.LibraryService,
 		ServiceUrl:     serviceAddress,
 		ServiceVersion: "1.0.0",
 		Metadata: map[string]string{
 			"description": "Library management service",
-			"dependsOn":   "LogService",
 		},
 		Tags:           []string{"library", "business"},
+		Dependencies:   []registry.ServiceName{registry.LogService},
 		HealthCheckURL: serviceAddress,
 	}
-	ctx, err := service.Start(context.Background(), host, port, r, library.RegisterHandlers)
+	svc, err := service.Start(context.Background(), host, port, r, library.RegisterHandlers,
+		service.WithReadinessCheck("log-service", library.CheckLogService),
+		service.OnReady(library.OnReady))
 	if err != nil {
 		stlog.Fatalln(err)
 	}
-	<-ctx.Done()
+	if err := svc.Wait(); err != nil {
+		stlog.Println(err)
+	}
 
 	fmt.Println("Shutting down library service")
 }
@@ -2,18 +2,22 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	stlog "log"
 
 	"github.com/linshule/go-distributed/log"
 	"github.com/linshule/go-distributed/registry"
 	"github.com/linshule/go-distributed/service"
+	"github.com/linshule/go-distributed/tlsutil"
 )
 
 func main() {
+	registry.AddFlags(flag.CommandLine)
+	flag.Parse()
 	log.Run("./distributed.log")
 	host, port := "localhost", "4000"
-	serviceAddress := fmt.Sprintf("http://%s:%s", host, port)
+	serviceAddress := fmt.Sprintf("%s://%s:%s", tlsutil.Scheme(), host, port)
 	r := registry.Registration{
 		ServiceName:    registry.LogService,
 		ServiceUrl:     serviceAddress,
@@ -25,11 +29,13 @@ func main() {
 		Tags:           []string{"logging", "core"},
 		HealthCheckURL: serviceAddress,
 	}
-	ctx, err := service.Start(context.Background(), host, port, r, log.RegisterHandlers)
+	svc, err := service.Start(context.Background(), host, port, r, log.RegisterHandlers)
 	if err != nil {
 		stlog.Fatalln(err)
 	}
-	<-ctx.Done()
+	if err := svc.Wait(); err != nil {
+		stlog.Println(err)
+	}
 
 	fmt.Println("Shutting down log service")
 }
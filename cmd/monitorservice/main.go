@@ -2,33 +2,39 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	stlog "log"
 
 	"github.com/linshule/go-distributed/monitor"
 	"github.com/linshule/go-distributed/registry"
 	"github.com/linshule/go-distributed/service"
+	"github.com/linshule/go-distributed/tlsutil"
 )
 
 func main() {
+	registry.AddFlags(flag.CommandLine)
+	flag.Parse()
 	host, port := "localhost", "5003"
-	serviceAddress := fmt.Sprintf("http://%s:%s", host, port)
+	serviceAddress := fmt.Sprintf("%s://%s:%s", tlsutil.Scheme(), host, port)
 	r := registry.Registration{
 		ServiceName:    registry.MonitorService,
 		ServiceUrl:     serviceAddress,
 		ServiceVersion: "1.0.0",
 		Metadata: map[string]string{
-			"description": "Service health monitoring",
+			"description":   "Service health monitoring",
 			"checkInterval": "30s",
 		},
 		Tags:           []string{"monitoring", "health"},
 		HealthCheckURL: serviceAddress,
 	}
-	ctx, err := service.Start(context.Background(), host, port, r, monitor.RegisterHandlers)
+	svc, err := service.Start(context.Background(), host, port, r, monitor.RegisterHandlers)
 	if err != nil {
 		stlog.Fatalln(err)
 	}
-	<-ctx.Done()
+	if err := svc.Wait(); err != nil {
+		stlog.Println(err)
+	}
 
 	fmt.Println("Shutting down monitor service")
 }
@@ -2,19 +2,24 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	stlog "log"
+	"net/http"
 	"time"
 
 	"github.com/linshule/go-distributed/discovery"
 	"github.com/linshule/go-distributed/provider"
 	"github.com/linshule/go-distributed/registry"
 	"github.com/linshule/go-distributed/service"
+	"github.com/linshule/go-distributed/tlsutil"
 )
 
 func main() {
+	registry.AddFlags(flag.CommandLine)
+	flag.Parse()
 	host, port := "localhost", "5001"
-	serviceAddress := fmt.Sprintf("http://%s:%s", host, port)
+	serviceAddress := fmt.Sprintf("%s://%s:%s", tlsutil.Scheme(), host, port)
 	r := registry.Registration{
 		ServiceName:    registry.ProviderService,
 		ServiceUrl:     serviceAddress,
@@ -22,12 +27,12 @@ func main() {
 		Metadata: map[string]string{
 			"description": "Service Provider with Discovery",
 		},
-		Tags: []string{"discovery", "provider"},
+		Tags:           []string{"discovery", "provider"},
 		HealthCheckURL: serviceAddress,
 	}
-	ctx, err := service.Start(context.Background(), host, port, r, func() {
-		provider.RegisterHandlers()
-		discovery.RegisterHandlers()
+	svc, err := service.Start(context.Background(), host, port, r, func(mux *http.ServeMux) {
+		provider.RegisterHandlers(mux)
+		discovery.RegisterHandlers(mux)
 	})
 	if err != nil {
 		stlog.Fatalln(err)
@@ -36,7 +41,12 @@ func main() {
 	// 启动服务发现定时刷新
 	discovery.StartPolling(10 * time.Second)
 
-	<-ctx.Done()
+	// 通过注册中心事件流跟踪服务变化
+	provider.StartWatching(svc.Context())
+
+	if err := svc.Wait(); err != nil {
+		stlog.Println(err)
+	}
 
 	fmt.Println("Shutting down provider service")
 }
@@ -2,34 +2,129 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/linshule/go-distributed/raft"
 	"github.com/linshule/go-distributed/registry"
+	"github.com/linshule/go-distributed/tlsutil"
 )
 
 func main() {
-	http.Handle("/services", &registry.RegistryService{})
+	dataDir := flag.String("data", "", "注册中心数据目录，为空时只保存在内存中；集群模式下 Raft 日志保存在其中的 raft 子目录")
+	addr := flag.String("addr", registry.ListenAddr(), "监听地址，默认读取环境变量 "+registry.ListenAddrEnv)
+	self := flag.String("self", "", "集群模式下本节点对外的地址，默认为 http://localhost 加监听端口")
+	peers := flag.String("peers", "", "集群中其他节点的地址，以逗号分隔，为空时以单机模式运行")
+	clusterSecret := flag.String("cluster-secret", os.Getenv("REGISTRY_CLUSTER_SECRET"), "集群节点之间共享的密钥，默认读取环境变量 REGISTRY_CLUSTER_SECRET")
+	clusterPeerIdentities := flag.String("cluster-peer-identities", "", "允许的集群节点证书名称（CN），以逗号分隔，节点之间通过 mTLS 认证时使用")
+	aclToken := flag.String("acl-bootstrap-token", os.Getenv("REGISTRY_ACL_BOOTSTRAP_TOKEN"), "ACL初始管理令牌，设置后启用ACL，默认读取环境变量 REGISTRY_ACL_BOOTSTRAP_TOKEN")
+	aclAnonymousRead := flag.Bool("acl-anonymous-read", false, "启用ACL时是否允许不带令牌的请求查询服务")
+	env := tlsutil.FromEnv()
+	tlsCA := flag.String("tls-ca", env.CAFile, "信任的CA证书，默认读取环境变量 TLS_CA_FILE")
+	tlsCert := flag.String("tls-cert", env.CertFile, "注册中心的证书，默认读取环境变量 TLS_CERT_FILE")
+	tlsKey := flag.String("tls-key", env.KeyFile, "注册中心的私钥，默认读取环境变量 TLS_KEY_FILE")
+	tlsVerifyClients := flag.Bool("tls-verify-clients", env.VerifyClients, "要求客户端出示由CA签发的证书（mTLS）")
+	flag.Parse()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	tlsConfig := tlsutil.Config{CAFile: *tlsCA, CertFile: *tlsCert, KeyFile: *tlsKey, VerifyClients: *tlsVerifyClients}
+	if err := tlsutil.Configure(tlsConfig); err != nil {
+		log.Fatalln(err)
+	}
+
+	if *aclToken != "" {
+		if err := registry.EnableACL(*aclToken, *aclAnonymousRead); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("ACL enabled")
+	}
+
+	// 集群模式下状态保存在 Raft 日志中，见下面的 EnableCluster
+	if *dataDir != "" && *peers == "" {
+		storage, err := registry.NewFileStorage(*dataDir)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := registry.UseStorage(storage); err != nil {
+			log.Fatalln(err)
+		}
+		defer func() {
+			if err := registry.CloseStorage(); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	// 注册中心API的路由由 RegistryService 自己处理，这里挂在根路径下
+	mux := http.NewServeMux()
+	mux.Handle("/", &registry.RegistryService{})
+
+	if *peers != "" {
+		if *self == "" {
+			*self = tlsConfig.Scheme() + "://localhost" + *addr
+		}
+		cluster := registry.ClusterConfig{Self: *self, Peers: strings.Split(*peers, ","), Secret: *clusterSecret}
+		if *clusterPeerIdentities != "" {
+			cluster.PeerIdentities = strings.Split(*clusterPeerIdentities, ",")
+		}
+		if *dataDir != "" {
+			storage, err := raft.NewFileStorage(filepath.Join(*dataDir, "raft"))
+			if err != nil {
+				log.Fatalln(err)
+			}
+			defer storage.Close()
+			cluster.Storage = storage
+		}
+		node, err := registry.EnableCluster(cluster)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		mux.Handle("/raft/", node.Handler())
+		node.Start()
+		defer node.Stop()
+	}
+
+	// 收到 SIGINT/SIGTERM 时停止
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	// 定期移除租约过期的服务实例
+	registry.StartReaper(ctx, 5*time.Second)
+
 	var srv http.Server
-	srv.Addr = registry.ServerPort
+	srv.Addr = *addr
+	srv.Handler = mux
 
 	go func() {
-		log.Println(srv.ListenAndServe())
+		if tlsConfig.Enabled() {
+			cfg, err := tlsConfig.ServerConfig()
+			if err != nil {
+				log.Println(err)
+				cancel()
+				return
+			}
+			srv.TLSConfig = cfg
+			log.Println(srv.ListenAndServeTLS("", ""))
+		} else {
+			log.Println(srv.ListenAndServe())
+		}
 		cancel()
 	}()
 
-	go func() {
-		fmt.Println("注册服务启动。按下任意键停止。")
-		var s string
-		fmt.Scanln(&s)
-		srv.Shutdown(ctx)
-		cancel()
-	}()
+	fmt.Println("注册服务启动。")
 	<-ctx.Done()
+	// 等待处理中的请求完成，包括阻塞查询和事件流，最多等待10秒
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+	}
 	fmt.Println("服务已停止。")
 }
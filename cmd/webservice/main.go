@@ -2,17 +2,21 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	stlog "log"
 
 	"github.com/linshule/go-distributed/registry"
 	"github.com/linshule/go-distributed/service"
+	"github.com/linshule/go-distributed/tlsutil"
 	"github.com/linshule/go-distributed/web"
 )
 
 func main() {
+	registry.AddFlags(flag.CommandLine)
+	flag.Parse()
 	host, port := "localhost", "5002"
-	serviceAddress := fmt.Sprintf("http://%s:%s", host, port)
+	serviceAddress := fmt.Sprintf("%s://%s:%s", tlsutil.Scheme(), host, port)
 	r := registry.Registration{
 		ServiceName:    registry.WebService,
 		ServiceUrl:     serviceAddress,
@@ -24,11 +28,13 @@ func main() {
 		Tags:           []string{"ui", "management"},
 		HealthCheckURL: serviceAddress,
 	}
-	ctx, err := service.Start(context.Background(), host, port, r, web.RegisterHandlers)
+	svc, err := service.Start(context.Background(), host, port, r, web.RegisterHandlers)
 	if err != nil {
 		stlog.Fatalln(err)
 	}
-	<-ctx.Done()
+	if err := svc.Wait(); err != nil {
+		stlog.Println(err)
+	}
 
 	fmt.Println("Shutting down web service")
 }
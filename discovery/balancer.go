@@ -0,0 +1,279 @@
+package discovery
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Balancer 负载均衡策略，从一个服务的健康实例中选择一个
+// instances 不为空；key 是调用方提供的路由键，只有一致性哈希会用到，可以为空。
+// 没有可选的实例时返回 nil
+type Balancer interface {
+	Pick(instances []*ServiceInstance, key string) *ServiceInstance
+}
+
+// InflightTracker 需要统计进行中请求数的策略实现该接口，Discovery.Acquire 在请求开始和结束时调用
+type InflightTracker interface {
+	Begin(inst *ServiceInstance)
+	End(inst *ServiceInstance)
+}
+
+// Pruner 按实例保存状态的策略实现该接口，Discovery 每次刷新服务列表后调用 Prune，
+// instances 是所有服务当前的实例，策略丢弃已经下线的实例的状态
+type Pruner interface {
+	Prune(instances []*ServiceInstance)
+}
+
+// 内置策略的名称，见 NewBalancer
+const (
+	RoundRobin     = "round-robin"
+	Weighted       = "weighted"
+	LeastLatency   = "least-latency"
+	PowerOfTwo     = "p2c"
+	ConsistentHash = "consistent-hash"
+)
+
+// WeightKey 加权策略从实例元数据的这个键读取权重，没有设置或无效时为 1，为 0 时不分配请求
+const WeightKey = "weight"
+
+// NewBalancer 按名称创建内置策略
+func NewBalancer(name string) (Balancer, error) {
+	switch name {
+	case RoundRobin:
+		return NewRoundRobin(), nil
+	case Weighted:
+		return NewWeighted(), nil
+	case LeastLatency:
+		return NewLeastLatency(), nil
+	case PowerOfTwo:
+		return NewPowerOfTwo(), nil
+	case ConsistentHash:
+		return NewConsistentHash(0), nil
+	}
+	return nil, fmt.Errorf("unknown balancer %q", name)
+}
+
+// roundRobin 轮询
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+// NewRoundRobin 创建轮询策略
+func NewRoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+func (b *roundRobin) Pick(instances []*ServiceInstance, key string) *ServiceInstance {
+	n := b.next.Add(1) - 1
+	return instances[n%uint64(len(instances))]
+}
+
+// weighted 平滑加权轮询，权重大的实例按比例获得更多请求，并且请求在实例之间交错分布
+type weighted struct {
+	mutex   sync.Mutex
+	current map[string]int // 每个实例的当前权重，以实例地址为键
+}
+
+// NewWeighted 创建加权轮询策略，权重从实例元数据 WeightKey 读取
+func NewWeighted() Balancer {
+	return &weighted{current: make(map[string]int)}
+}
+
+// Weight 返回实例的权重
+func Weight(inst *ServiceInstance) int {
+	w, err := strconv.Atoi(inst.Metadata[WeightKey])
+	if err != nil || w < 0 {
+		return 1
+	}
+	return w
+}
+
+func (b *weighted) Pick(instances []*ServiceInstance, key string) *ServiceInstance {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	current := make(map[string]int, len(instances))
+	total := 0
+	var best *ServiceInstance
+	for _, inst := range instances {
+		w := Weight(inst)
+		if w == 0 {
+			continue
+		}
+		current[inst.URL] = b.current[inst.URL] + w
+		total += w
+		if best == nil || current[inst.URL] > current[best.URL] {
+			best = inst
+		}
+	}
+	if best != nil {
+		current[best.URL] -= total
+	}
+	// 只保留当前实例的状态，下线的实例不会一直留在表中
+	b.current = current
+	return best
+}
+
+// leastLatency 选择最近一次健康检查延迟最低的实例，延迟相同时随机选择
+type leastLatency struct{}
+
+// NewLeastLatency 创建最低延迟策略，延迟来自 ServiceInstance.Latency
+func NewLeastLatency() Balancer {
+	return leastLatency{}
+}
+
+func (leastLatency) Pick(instances []*ServiceInstance, key string) *ServiceInstance {
+	var best []*ServiceInstance
+	for _, inst := range instances {
+		switch {
+		case len(best) == 0 || inst.Latency < best[0].Latency:
+			best = append(best[:0], inst)
+		case inst.Latency == best[0].Latency:
+			best = append(best, inst)
+		}
+	}
+	return best[rand.IntN(len(best))]
+}
+
+// powerOfTwo 随机选两个实例，取进行中请求较少的一个
+type powerOfTwo struct {
+	mutex    sync.Mutex
+	inflight map[string]int64 // 以实例地址为键
+}
+
+// NewPowerOfTwo 创建 power-of-two-choices 策略，需要通过 Discovery.Acquire 使用才能统计进行中的请求
+func NewPowerOfTwo() Balancer {
+	return &powerOfTwo{inflight: make(map[string]int64)}
+}
+
+// Inflight 返回实例进行中的请求数
+func (b *powerOfTwo) Inflight(inst *ServiceInstance) int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.inflight[inst.URL]
+}
+
+func (b *powerOfTwo) Begin(inst *ServiceInstance) {
+	b.add(inst, 1)
+}
+
+func (b *powerOfTwo) End(inst *ServiceInstance) {
+	b.add(inst, -1)
+}
+
+func (b *powerOfTwo) add(inst *ServiceInstance, delta int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.inflight[inst.URL] += delta
+}
+
+// Prune 删除已经下线且没有进行中请求的实例的计数
+// 还有请求的实例保留计数，请求结束后由下一次刷新删除
+func (b *powerOfTwo) Prune(instances []*ServiceInstance) {
+	current := make(map[string]bool, len(instances))
+	for _, inst := range instances {
+		current[inst.URL] = true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for url, n := range b.inflight {
+		if !current[url] && n == 0 {
+			delete(b.inflight, url)
+		}
+	}
+}
+
+func (b *powerOfTwo) Pick(instances []*ServiceInstance, key string) *ServiceInstance {
+	if len(instances) == 1 {
+		return instances[0]
+	}
+	i := rand.IntN(len(instances))
+	j := rand.IntN(len(instances) - 1)
+	if j >= i {
+		j++
+	}
+	a, c := instances[i], instances[j]
+	if b.Inflight(c) < b.Inflight(a) {
+		return c
+	}
+	return a
+}
+
+// defaultReplicas 一致性哈希中每个实例的虚拟节点数
+const defaultReplicas = 160
+
+// consistentHash 一致性哈希，相同的 key 总是落到同一个实例上，实例增减时只有少量 key 改变归属
+type consistentHash struct {
+	replicas int
+	fallback Balancer // key 为空时使用轮询
+
+	mutex     sync.Mutex
+	signature string // 生成当前哈希环的实例列表
+	ring      []uint32
+	owners    map[uint32]string // 虚拟节点所属实例的地址
+}
+
+// NewConsistentHash 创建一致性哈希策略，replicas 为每个实例的虚拟节点数，小于等于 0 时使用默认值
+func NewConsistentHash(replicas int) Balancer {
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+	return &consistentHash{replicas: replicas, fallback: NewRoundRobin()}
+}
+
+func (b *consistentHash) Pick(instances []*ServiceInstance, key string) *ServiceInstance {
+	if key == "" {
+		return b.fallback.Pick(instances, key)
+	}
+	b.mutex.Lock()
+	b.build(instances)
+	h := crc32.ChecksumIEEE([]byte(key))
+	i, _ := slices.BinarySearch(b.ring, h)
+	if i == len(b.ring) {
+		i = 0
+	}
+	owner := b.owners[b.ring[i]]
+	b.mutex.Unlock()
+	// 实例对象在每次刷新时重新创建，按地址找到当前的对象
+	for _, inst := range instances {
+		if inst.URL == owner {
+			return inst
+		}
+	}
+	return nil
+}
+
+// build 实例列表变化时重新生成哈希环，调用方需持有锁
+func (b *consistentHash) build(instances []*ServiceInstance) {
+	urls := make([]string, len(instances))
+	for i, inst := range instances {
+		urls[i] = inst.URL
+	}
+	slices.Sort(urls)
+	signature := strings.Join(urls, ",")
+	if signature == b.signature {
+		return
+	}
+	b.signature = signature
+	b.ring = make([]uint32, 0, len(urls)*b.replicas)
+	b.owners = make(map[uint32]string, len(urls)*b.replicas)
+	for _, url := range urls {
+		for r := 0; r < b.replicas; r++ {
+			h := replicaHash(url, r)
+			if _, ok := b.owners[h]; !ok {
+				b.ring = append(b.ring, h)
+			}
+			b.owners[h] = url
+		}
+	}
+	slices.Sort(b.ring)
+}
+
+func replicaHash(url string, replica int) uint32 {
+	return crc32.ChecksumIEEE([]byte(url + "#" + strconv.Itoa(replica)))
+}
@@ -0,0 +1,214 @@
+package discovery
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+// testInstances 创建 n 个地址不同的实例
+func testInstances(n int) []*ServiceInstance {
+	instances := make([]*ServiceInstance, n)
+	for i := range instances {
+		instances[i] = &ServiceInstance{Name: "TestService", InstanceID: "test-" + strconv.Itoa(i), URL: fmt.Sprintf("http://10.0.0.%d:8080", i+1)}
+	}
+	return instances
+}
+
+// distribution 执行 n 次 Pick，返回每个实例地址被选中的次数
+func distribution(b Balancer, instances []*ServiceInstance, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[b.Pick(instances, "").URL]++
+	}
+	return counts
+}
+
+func TestNewBalancer(t *testing.T) {
+	for _, name := range []string{RoundRobin, Weighted, LeastLatency, PowerOfTwo, ConsistentHash} {
+		if b, err := NewBalancer(name); err != nil || b == nil {
+			t.Fatalf("NewBalancer(%q) = %v, %v", name, b, err)
+		}
+	}
+	if _, err := NewBalancer("random"); err == nil {
+		t.Fatal("unknown balancer was created")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	instances := testInstances(3)
+	b := NewRoundRobin()
+	for i := 0; i < 9; i++ {
+		if got := b.Pick(instances, ""); got != instances[i%3] {
+			t.Fatalf("pick %d returned %s, want %s", i, got.URL, instances[i%3].URL)
+		}
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	instances := testInstances(4)
+	for i, w := range []string{"5", "1", "0", "invalid"} {
+		instances[i].Metadata = map[string]string{WeightKey: w}
+	}
+	b := NewWeighted()
+	counts := distribution(b, instances, 70)
+	// 无效权重按 1 计算，权重为 0 的实例不分配请求
+	want := map[string]int{instances[0].URL: 50, instances[1].URL: 10, instances[3].URL: 10}
+	for url, n := range want {
+		if counts[url] != n {
+			t.Fatalf("distribution %v, want %v", counts, want)
+		}
+	}
+	if counts[instances[2].URL] != 0 {
+		t.Fatalf("instance with weight 0 got %d requests", counts[instances[2].URL])
+	}
+
+	// 平滑加权：权重大的实例不会连续获得全部请求
+	run := 0
+	for i := 0; i < 7; i++ {
+		if b.Pick(instances, "") == instances[0] {
+			if run++; run > 3 {
+				t.Fatal("weighted balancer picked the heavy instance more than 3 times in a row")
+			}
+		} else {
+			run = 0
+		}
+	}
+}
+
+func TestLeastLatency(t *testing.T) {
+	instances := testInstances(3)
+	instances[0].Latency = 30
+	instances[1].Latency = 10
+	instances[2].Latency = 10
+	counts := distribution(NewLeastLatency(), instances, 200)
+	if counts[instances[0].URL] != 0 {
+		t.Fatalf("slowest instance was picked %d times", counts[instances[0].URL])
+	}
+	// 延迟相同时随机选择
+	if counts[instances[1].URL] == 0 || counts[instances[2].URL] == 0 {
+		t.Fatalf("instances with equal latency were not both picked: %v", counts)
+	}
+}
+
+func TestPowerOfTwo(t *testing.T) {
+	instances := testInstances(2)
+	b := NewPowerOfTwo().(*powerOfTwo)
+	b.Begin(instances[0])
+	b.Begin(instances[0])
+	b.Begin(instances[1])
+	// 两个实例时总是比较两者，选择进行中请求较少的一个
+	for i := 0; i < 20; i++ {
+		if got := b.Pick(instances, ""); got != instances[1] {
+			t.Fatalf("picked %s with %d inflight", got.URL, b.Inflight(got))
+		}
+	}
+	b.End(instances[0])
+	b.End(instances[0])
+	if b.Inflight(instances[0]) != 0 || b.Inflight(instances[1]) != 1 {
+		t.Fatalf("inflight %d and %d", b.Inflight(instances[0]), b.Inflight(instances[1]))
+	}
+
+	// 请求数相同时在实例之间分散
+	b.End(instances[1])
+	counts := distribution(b, testInstances(4), 400)
+	if len(counts) != 4 {
+		t.Fatalf("distribution %v", counts)
+	}
+}
+
+func TestPowerOfTwoPrune(t *testing.T) {
+	instances := testInstances(3)
+	b := NewPowerOfTwo().(*powerOfTwo)
+	for _, inst := range instances {
+		b.Begin(inst)
+	}
+	b.End(instances[0])
+	b.End(instances[2])
+
+	// instances[2] 下线时没有进行中的请求，删除它的计数；instances[1] 还有请求，保留到请求结束
+	b.Prune(instances[:1])
+	if len(b.inflight) != 2 || b.Inflight(instances[1]) != 1 {
+		t.Fatalf("inflight after prune: %v", b.inflight)
+	}
+	b.End(instances[1])
+	b.Prune(instances[:1])
+	if len(b.inflight) != 1 {
+		t.Fatalf("inflight after the last request ended: %v", b.inflight)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	instances := testInstances(4)
+	b := NewConsistentHash(0)
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := "user-" + strconv.Itoa(i)
+		owners[key] = b.Pick(instances, key).URL
+		counts[owners[key]]++
+	}
+	// 相同的 key 总是落到同一个实例，与实例列表的顺序无关
+	reversed := []*ServiceInstance{instances[3], instances[2], instances[1], instances[0]}
+	for key, owner := range owners {
+		if got := b.Pick(reversed, key).URL; got != owner {
+			t.Fatalf("key %s moved from %s to %s", key, owner, got)
+		}
+	}
+	for _, inst := range instances {
+		if counts[inst.URL] < 100 {
+			t.Fatalf("uneven distribution %v", counts)
+		}
+	}
+	// 没有 key 时轮询
+	if got := distribution(b, instances, 8); len(got) != 4 {
+		t.Fatalf("empty key distribution %v", got)
+	}
+}
+
+func TestConsistentHashStability(t *testing.T) {
+	instances := testInstances(5)
+	b := NewConsistentHash(0)
+	owners := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := "user-" + strconv.Itoa(i)
+		owners[key] = b.Pick(instances, key).URL
+	}
+
+	// 实例下线：只有属于它的 key 改变归属
+	removed := instances[2]
+	remaining := append(append([]*ServiceInstance{}, instances[:2]...), instances[3:]...)
+	for key, owner := range owners {
+		got := b.Pick(remaining, key).URL
+		if owner != removed.URL && got != owner {
+			t.Fatalf("key %s moved from %s to %s when %s was removed", key, owner, got, removed.URL)
+		}
+		if got == removed.URL {
+			t.Fatalf("key %s was routed to the removed instance", key)
+		}
+	}
+
+	// 实例上线：改变归属的 key 都落到新实例上，大约占 1/6
+	added := &ServiceInstance{Name: "TestService", InstanceID: "test-5", URL: "http://10.0.0.6:8080"}
+	moved := 0
+	for key, owner := range owners {
+		got := b.Pick(append(instances, added), key).URL
+		if got != owner {
+			if got != added.URL {
+				t.Fatalf("key %s moved from %s to %s when an instance was added", key, owner, got)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 300 {
+		t.Fatalf("%d of 1000 keys moved to the new instance", moved)
+	}
+
+	// 同一地址的实例对象在刷新时重新创建，key 仍然落到同一个地址
+	refreshed := testInstances(5)
+	for key, owner := range owners {
+		if got := b.Pick(refreshed, key).URL; got != owner {
+			t.Fatalf("key %s moved from %s to %s after a refresh", key, owner, got)
+		}
+	}
+}
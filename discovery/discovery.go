@@ -1,26 +1,33 @@
 package discovery
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/linshule/go-distributed/registry"
+	"github.com/linshule/go-distributed/tlsutil"
 )
 
 // ServiceInstance 服务实例
 type ServiceInstance struct {
-	Name      string            `json:"name"`       // 服务名称
-	URL       string            `json:"url"`        // 服务URL
-	Version   string            `json:"version"`    // 服务版本
-	Metadata  map[string]string `json:"metadata"`   // 元数据
-	Tags      []string          `json:"tags"`       // 标签
-	Healthy   bool              `json:"healthy"`    // 健康状态
-	Latency   int64             `json:"latency"`    // 响应延迟
-	LastCheck time.Time         `json:"lastCheck"`  // 最后检查时间
+	Name       string            `json:"name"`       // 服务名称
+	InstanceID string            `json:"instanceId"` // 注册中心中的实例ID
+	URL        string            `json:"url"`        // 服务URL
+	Version    string            `json:"version"`    // 服务版本
+	Metadata   map[string]string `json:"metadata"`   // 元数据
+	Tags       []string          `json:"tags"`       // 标签
+	Healthy    bool              `json:"healthy"`    // 健康状态
+	Latency    int64             `json:"latency"`    // 响应延迟
+	LastCheck  time.Time         `json:"lastCheck"`  // 最后检查时间
+	Outlier    OutlierStatus     `json:"outlier"`    // 被动异常检测状态的快照，见 OutlierStatus
 }
 
 // ServiceWatcher 服务变化观察者
@@ -31,72 +38,204 @@ type ServiceWatcher struct {
 
 // Discovery 服务发现
 type Discovery struct {
-	instances  map[string][]*ServiceInstance // 服务实例列表
-	watchers   map[string][]*ServiceWatcher // 观察者列表
-	mutex      sync.RWMutex
-	httpClient *http.Client
-	registryURL string
+	instances    map[string][]*ServiceInstance // 服务实例列表
+	watchers     map[string][]*ServiceWatcher  // 观察者列表
+	mutex        sync.RWMutex
+	refreshMutex sync.Mutex                // 保证同一时间只有一个 Refresh
+	refreshing   atomic.Bool               // 是否有后台刷新在进行，见 refreshAsync
+	balancers    map[string]Balancer       // 按服务名称选择的负载均衡策略
+	balancer     Balancer                  // 没有单独设置时使用的策略，默认为轮询
+	outlier      OutlierConfig             // 被动异常检测的配置
+	outliers     map[string]*OutlierStatus // 按实例ID保存的异常检测状态，实例对象刷新后仍然保留
+	httpClient   *http.Client
+	client       *registry.Client // 查询使用的注册中心客户端，为 nil 时使用全局客户端
 }
 
 // 全局服务发现实例
 var d = &Discovery{
 	instances:  make(map[string][]*ServiceInstance),
 	watchers:   make(map[string][]*ServiceWatcher),
-	httpClient: &http.Client{Timeout: 5 * time.Second},
-	registryURL: "http://localhost:3000/services",
+	balancers:  make(map[string]Balancer),
+	balancer:   NewRoundRobin(),
+	outlier:    DefaultOutlierConfig(),
+	outliers:   make(map[string]*OutlierStatus),
+	httpClient: &http.Client{Transport: tlsutil.Client().Transport, Timeout: 5 * time.Second},
 }
 
-// New 创建新的服务发现实例
+// New 创建新的服务发现实例，registryURL 为以逗号分隔的注册中心地址，为空时使用全局客户端的配置
 func New(registryURL string) *Discovery {
+	cfg := registry.DefaultConfig()
+	if addrs := registry.ParseAddresses(registryURL); len(addrs) > 0 {
+		cfg.Addresses = addrs
+	}
+	// 缓存文件属于全局客户端，两个客户端写同一个文件会互相覆盖
+	cfg.CacheFile = ""
 	return &Discovery{
-		instances:   make(map[string][]*ServiceInstance),
-		watchers:    make(map[string][]*ServiceWatcher),
-		httpClient:  &http.Client{Timeout: 5 * time.Second},
-		registryURL: registryURL,
+		instances:  make(map[string][]*ServiceInstance),
+		watchers:   make(map[string][]*ServiceWatcher),
+		balancers:  make(map[string]Balancer),
+		balancer:   NewRoundRobin(),
+		outlier:    DefaultOutlierConfig(),
+		outliers:   make(map[string]*OutlierStatus),
+		httpClient: &http.Client{Transport: tlsutil.Client().Transport, Timeout: 5 * time.Second},
+		client:     registry.NewClient(cfg),
 	}
 }
 
+// maxConcurrentProbes Refresh 同时进行的健康检查数
+const maxConcurrentProbes = 8
+
 // Refresh 刷新服务列表
+// 健康检查在锁外并发进行，全部完成后一次性替换实例列表，检查期间读取的仍是旧的列表
 func (d *Discovery) Refresh() error {
-	regs, err := registry.GetServices()
+	// 同一时间只有一个刷新，避免较早的结果覆盖较新的结果
+	d.refreshMutex.Lock()
+	defer d.refreshMutex.Unlock()
+	return d.refresh()
+}
+
+// lookup 判断 serviceName 是否是注册中心中的服务
+// 服务列表中没有它时查询注册中心客户端的缓存（例如还没有调用过 Refresh 或者服务刚刚注册），
+// 已注册的服务先按注册中心维护的健康状态加入服务列表，探测实例的刷新在后台进行，不占用调用方的请求
+func (d *Discovery) lookup(ctx context.Context, serviceName string) bool {
+	if d.hasInstances(serviceName) {
+		return true
+	}
+	regs, err := d.registrations(ctx)
 	if err != nil {
-		return err
+		log.Printf("Discovery lookup for %s failed: %v\n", serviceName, err)
+		return false
+	}
+	var instances []*ServiceInstance
+	for _, reg := range regs {
+		if string(reg.ServiceName) == serviceName {
+			inst := newInstance(reg)
+			inst.Healthy = reg.Status != registry.HealthCritical
+			instances = append(instances, inst)
+		}
+	}
+	if len(instances) == 0 {
+		return false
 	}
-
 	d.mutex.Lock()
-	defer d.mutex.Unlock()
-
-	// 创建新的实例映射
-	newInstances := make(map[string][]*ServiceInstance)
+	// 期间完成的刷新已经带来了探测过的实例
+	if len(d.instances[serviceName]) == 0 {
+		d.instances[serviceName] = instances
+	}
+	d.mutex.Unlock()
+	d.refreshAsync()
+	return true
+}
 
-	for _, reg := range regs {
-		instance := &ServiceInstance{
-			Name:     string(reg.ServiceName),
-			URL:      reg.ServiceUrl,
-			Version:  reg.ServiceVersion,
-			Metadata: reg.Metadata,
-			Tags:     reg.Tags,
+// refreshAsync 在后台刷新服务列表，已经有后台刷新在进行时不再启动
+func (d *Discovery) refreshAsync() {
+	if !d.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer d.refreshing.Store(false)
+		if err := d.Refresh(); err != nil {
+			log.Printf("Discovery refresh failed: %v\n", err)
 		}
+	}()
+}
+
+// registrations 从注册中心客户端获取所有实例，客户端有缓存时不访问注册中心
+func (d *Discovery) registrations(ctx context.Context) ([]registry.Registration, error) {
+	if d.client != nil {
+		return d.client.GetServices(ctx)
+	}
+	return registry.GetServices()
+}
+
+// newInstance 由注册信息创建还没有检查过健康状态的实例
+func newInstance(reg registry.Registration) *ServiceInstance {
+	return &ServiceInstance{
+		Name:       string(reg.ServiceName),
+		InstanceID: reg.InstanceID,
+		URL:        reg.ServiceUrl,
+		Version:    reg.ServiceVersion,
+		Metadata:   reg.Metadata,
+		Tags:       reg.Tags,
+	}
+}
+
+// hasInstances 服务列表中是否有 serviceName 的实例
+func (d *Discovery) hasInstances(serviceName string) bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return len(d.instances[serviceName]) > 0
+}
+
+// refresh 刷新服务列表，调用方需持有 refreshMutex
+func (d *Discovery) refresh() error {
+	regs, err := d.registrations(context.Background())
+	if err != nil {
+		return err
+	}
+
+	instances := make([]*ServiceInstance, len(regs))
+	sem := make(chan struct{}, maxConcurrentProbes)
+	var wg sync.WaitGroup
+	for i, reg := range regs {
+		instance := newInstance(reg)
+		instances[i] = instance
 
 		// 检查健康状态
-		if reg.HealthCheckURL != "" {
-			instance.Healthy, instance.Latency = d.checkHealth(reg.HealthCheckURL)
-		} else {
-			instance.Healthy, instance.Latency = d.checkHealth(reg.ServiceUrl)
+		healthURL := reg.HealthCheckURL
+		if healthURL == "" {
+			healthURL = reg.ServiceUrl
 		}
-		instance.LastCheck = time.Now()
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			instance.Healthy, instance.Latency = d.checkHealth(healthURL)
+			instance.LastCheck = time.Now()
+		})
+	}
+	wg.Wait()
 
+	d.mutex.Lock()
+	// 创建新的实例映射，异常检测状态按实例ID保存，只删除已经注销的实例的状态
+	newInstances := make(map[string][]*ServiceInstance)
+	current := make(map[string]bool, len(instances))
+	for _, instance := range instances {
 		newInstances[instance.Name] = append(newInstances[instance.Name], instance)
+		current[instanceKey(instance)] = true
+	}
+	for key := range d.outliers {
+		if !current[key] {
+			delete(d.outliers, key)
+		}
 	}
-
 	d.instances = newInstances
+	notify := d.pendingNotifications()
+	pruners := d.pruners()
+	d.mutex.Unlock()
+
+	for _, p := range pruners {
+		p.Prune(instances)
+	}
 
-	// 通知观察者
-	d.notifyWatchers()
+	// 在锁外通知观察者，回调中可以调用 Discovery 的方法
+	for _, fn := range notify {
+		fn()
+	}
 
 	return nil
 }
 
+// pruners 返回所有实现了 Pruner 的策略，同一个策略只出现一次，调用方需持有锁
+func (d *Discovery) pruners() []Pruner {
+	var pruners []Pruner
+	for _, b := range append(slices.Collect(maps.Values(d.balancers)), d.balancer) {
+		if p, ok := b.(Pruner); ok && !slices.Contains(pruners, p) {
+			pruners = append(pruners, p)
+		}
+	}
+	return pruners
+}
+
 // checkHealth 检查服务健康状态
 func (d *Discovery) checkHealth(url string) (bool, int64) {
 	start := time.Now()
@@ -111,46 +250,118 @@ func (d *Discovery) checkHealth(url string) (bool, int64) {
 	return resp.StatusCode == http.StatusOK, latency
 }
 
-// notifyWatchers 通知所有观察者
-func (d *Discovery) notifyWatchers() {
+// pendingNotifications 返回通知所有观察者的函数，调用方需持有锁
+func (d *Discovery) pendingNotifications() []func() {
+	var notify []func()
 	for name, instances := range d.instances {
 		if watchers, ok := d.watchers[name]; ok {
 			for _, w := range watchers {
 				if len(instances) > 0 {
-					w.callback(instances[0])
+					inst := d.copyInstance(instances[0], time.Now())
+					notify = append(notify, func() { w.callback(inst) })
 				}
 			}
 		}
 	}
+	return notify
 }
 
 // GetInstances 获取所有服务实例
+// 返回实例的副本，与 GetAllServices 一样，调用方读取时不会与异常检测的更新冲突
 func (d *Discovery) GetInstances(serviceName string) []*ServiceInstance {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
-	return d.instances[serviceName]
+	return d.copyInstances(d.instances[serviceName], time.Now())
 }
 
-// GetHealthyInstance 获取一个健康的服务实例（负载均衡）
+// SetBalancer 设置服务 serviceName 使用的负载均衡策略，b 为 nil 时恢复使用默认策略
+func (d *Discovery) SetBalancer(serviceName string, b Balancer) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if b == nil {
+		delete(d.balancers, serviceName)
+		return
+	}
+	d.balancers[serviceName] = b
+}
+
+// SetDefaultBalancer 设置没有单独设置策略的服务使用的负载均衡策略
+func (d *Discovery) SetDefaultBalancer(b Balancer) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.balancer = b
+}
+
+// GetHealthyInstance 按服务的负载均衡策略获取一个健康的服务实例
 func (d *Discovery) GetHealthyInstance(serviceName string) (*ServiceInstance, error) {
-	d.mutex.RLock()
-	instances := d.instances[serviceName]
-	d.mutex.RUnlock()
+	inst, _, err := d.pick(serviceName, "", nil)
+	return inst, err
+}
 
+// GetInstanceForKey 获取一个健康的服务实例，key 为一致性哈希的路由键，其他策略忽略它
+func (d *Discovery) GetInstanceForKey(serviceName, key string) (*ServiceInstance, error) {
+	inst, _, err := d.pick(serviceName, key, nil)
+	return inst, err
+}
+
+// Acquire 获取一个健康的服务实例，请求结束后必须调用返回的 release
+// 策略实现了 InflightTracker 时（例如 p2c），会统计每个实例进行中的请求数
+func (d *Discovery) Acquire(serviceName, key string) (*ServiceInstance, func(), error) {
+	return d.acquire(serviceName, key, nil)
+}
+
+// acquire 同 Acquire，跳过 exclude 中的实例地址
+func (d *Discovery) acquire(serviceName, key string, exclude map[string]bool) (*ServiceInstance, func(), error) {
+	inst, b, err := d.pick(serviceName, key, exclude)
+	if err != nil {
+		return nil, nil, err
+	}
+	tracker, ok := b.(InflightTracker)
+	if !ok {
+		return inst, func() {}, nil
+	}
+	tracker.Begin(inst)
+	var once sync.Once
+	return inst, func() { once.Do(func() { tracker.End(inst) }) }, nil
+}
+
+// pick 从健康且没有被驱逐的实例中按策略选择一个，返回实例的副本和使用的策略
+func (d *Discovery) pick(serviceName, key string, exclude map[string]bool) (*ServiceInstance, Balancer, error) {
+	d.mutex.RLock()
+	b, ok := d.balancers[serviceName]
+	if !ok {
+		b = d.balancer
+	}
+	now := time.Now()
 	var healthyInstances []*ServiceInstance
-	for _, inst := range instances {
-		if inst.Healthy {
-			healthyInstances = append(healthyInstances, inst)
+	for _, inst := range d.instances[serviceName] {
+		if inst.Healthy && !d.ejected(inst, now) && !exclude[inst.URL] {
+			healthyInstances = append(healthyInstances, d.copyInstance(inst, now))
 		}
 	}
+	d.mutex.RUnlock()
 
 	if len(healthyInstances) == 0 {
-		return nil, fmt.Errorf("no healthy instance found for %s", serviceName)
+		return nil, nil, fmt.Errorf("no healthy instance found for %s", serviceName)
+	}
+	inst := b.Pick(healthyInstances, key)
+	if inst == nil {
+		return nil, nil, fmt.Errorf("no eligible instance found for %s", serviceName)
 	}
+	return inst, b, nil
+}
 
-	// 简单轮询负载均衡
-	index := time.Now().UnixNano() % int64(len(healthyInstances))
-	return healthyInstances[index], nil
+// MarkUnhealthy 把调用失败的实例标记为不健康，在下次 Refresh 重新检查之前不再选择它
+// inst 可以是 GetInstances 等方法返回的副本，按实例ID找到服务列表中的实例
+func (d *Discovery) MarkUnhealthy(inst *ServiceInstance) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, live := range d.instances[inst.Name] {
+		if instanceKey(live) == instanceKey(inst) && live.Healthy {
+			live.Healthy = false
+			log.Printf("Marked %s instance %s unhealthy\n", inst.Name, inst.URL)
+		}
+	}
 }
 
 // Watch 观察服务变化
@@ -182,13 +393,42 @@ func (d *Discovery) GetAllServices() map[string][]*ServiceInstance {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 
+	// 返回实例的副本，调用方读取时不会与异常检测的更新冲突
+	now := time.Now()
 	result := make(map[string][]*ServiceInstance)
 	for k, v := range d.instances {
-		result[k] = v
+		result[k] = d.copyInstances(v, now)
 	}
 	return result
 }
 
+// copyInstances 复制实例列表，见 copyInstance，调用方需持有锁
+func (d *Discovery) copyInstances(instances []*ServiceInstance, now time.Time) []*ServiceInstance {
+	copies := make([]*ServiceInstance, len(instances))
+	for i, inst := range instances {
+		copies[i] = d.copyInstance(inst, now)
+	}
+	return copies
+}
+
+// copyInstance 复制实例，填入异常检测状态并按 now 计算实例是否仍被驱逐，调用方需持有锁
+func (d *Discovery) copyInstance(inst *ServiceInstance, now time.Time) *ServiceInstance {
+	c := *inst
+	if s := d.outliers[instanceKey(inst)]; s != nil {
+		c.Outlier = *s
+	}
+	c.Outlier.Ejected = c.Outlier.ejected(now)
+	return &c
+}
+
+// instanceKey 异常检测状态的键，没有实例ID时（例如调用方自己构造的实例）使用地址
+func instanceKey(inst *ServiceInstance) string {
+	if inst.InstanceID != "" {
+		return inst.InstanceID
+	}
+	return inst.URL
+}
+
 // 全局函数
 
 // Refresh 刷新全局服务发现实例
@@ -206,6 +446,31 @@ func GetHealthyInstance(serviceName string) (*ServiceInstance, error) {
 	return d.GetHealthyInstance(serviceName)
 }
 
+// GetInstanceForKey 按路由键获取健康服务实例
+func GetInstanceForKey(serviceName, key string) (*ServiceInstance, error) {
+	return d.GetInstanceForKey(serviceName, key)
+}
+
+// Acquire 获取健康服务实例，请求结束后调用 release
+func Acquire(serviceName, key string) (*ServiceInstance, func(), error) {
+	return d.Acquire(serviceName, key)
+}
+
+// MarkUnhealthy 把实例标记为不健康
+func MarkUnhealthy(inst *ServiceInstance) {
+	d.MarkUnhealthy(inst)
+}
+
+// SetBalancer 设置服务使用的负载均衡策略
+func SetBalancer(serviceName string, b Balancer) {
+	d.SetBalancer(serviceName, b)
+}
+
+// SetDefaultBalancer 设置默认的负载均衡策略
+func SetDefaultBalancer(b Balancer) {
+	d.SetDefaultBalancer(b)
+}
+
 // Watch 观察服务变化
 func Watch(serviceName string, callback func(*ServiceInstance)) {
 	d.Watch(serviceName, callback)
@@ -248,7 +513,7 @@ func (h *ServiceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// RegisterHandlers 注册HTTP处理器
-func RegisterHandlers() {
-	http.Handle("/discovery", &ServiceHandler{})
+// RegisterHandlers 在 mux 上注册HTTP处理器
+func RegisterHandlers(mux *http.ServeMux) {
+	mux.Handle("/discovery", &ServiceHandler{})
 }
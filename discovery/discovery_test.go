@@ -0,0 +1,300 @@
+package discovery
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linshule/go-distributed/registry"
+)
+
+// newTestDiscovery 启动一个进程内的注册中心，注册 n 个健康的 TestService 实例，返回访问它并刷新过的服务发现实例
+func newTestDiscovery(t *testing.T, n int) *Discovery {
+	t.Helper()
+	disc := New(newTestRegistry(t, n))
+	if err := disc.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	return disc
+}
+
+// newTestRegistry 启动一个进程内的注册中心，注册 n 个健康的 TestService 实例，返回注册中心地址
+// 实例对所有请求返回 200，响应体为请求的路径
+func newTestRegistry(t *testing.T, n int) string {
+	t.Helper()
+	server := registry.NewServer()
+	rs := httptest.NewServer(server)
+	t.Cleanup(func() {
+		// 客户端在后台以阻塞查询跟踪注册中心，先断开它的连接
+		rs.CloseClientConnections()
+		rs.Close()
+	})
+	client := registry.NewClient(registry.ClientConfig{Addresses: []string{rs.URL}, MaxRetries: -1})
+	for i := 0; i < n; i++ {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.URL.Path)
+		}))
+		t.Cleanup(backend.Close)
+		reg := registry.Registration{ServiceName: "TestService", ServiceUrl: backend.URL, InstanceID: "test-" + strconv.Itoa(i)}
+		if err := client.RegistrationService(context.Background(), reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rs.URL
+}
+
+// newRegistryWith 启动一个进程内的注册中心，为每个处理器注册一个 TestService 实例，返回注册中心地址
+func newRegistryWith(t *testing.T, backends ...http.Handler) string {
+	t.Helper()
+	server := registry.NewServer()
+	rs := httptest.NewServer(server)
+	t.Cleanup(func() {
+		// 客户端在后台以阻塞查询跟踪注册中心，先断开它的连接
+		rs.CloseClientConnections()
+		rs.Close()
+	})
+	client := registry.NewClient(registry.ClientConfig{Addresses: []string{rs.URL}, MaxRetries: -1})
+	for i, h := range backends {
+		backend := httptest.NewServer(h)
+		t.Cleanup(backend.Close)
+		reg := registry.Registration{ServiceName: "TestService", ServiceUrl: backend.URL, InstanceID: "test-" + strconv.Itoa(i)}
+		if err := client.RegistrationService(context.Background(), reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rs.URL
+}
+
+func TestNewDoesNotShareCacheFile(t *testing.T) {
+	prev := registry.DefaultConfig()
+	cfg := prev
+	cfg.CacheFile = filepath.Join(t.TempDir(), "registry-cache.json")
+	registry.Configure(cfg)
+	defer registry.Configure(prev)
+
+	newTestDiscovery(t, 1)
+	if _, err := os.Stat(cfg.CacheFile); !os.IsNotExist(err) {
+		t.Fatalf("discovery instance wrote the global client's cache file: %v", err)
+	}
+}
+
+func TestGetInstancesReturnsCopies(t *testing.T) {
+	disc := newTestDiscovery(t, 2)
+	instances := disc.GetInstances("TestService")
+	if len(instances) != 2 {
+		t.Fatalf("got %d instances, want 2", len(instances))
+	}
+	instances[0].Healthy = false
+	instances[0].Outlier.ConsecutiveFailures = 100
+	for _, inst := range disc.GetInstances("TestService") {
+		if !inst.Healthy || inst.Outlier.ConsecutiveFailures != 0 {
+			t.Fatalf("modifying a returned instance changed %s", inst.URL)
+		}
+	}
+}
+
+// TestConcurrentAccess 在 -race 下并发刷新、查询、选择实例和报告调用结果
+func TestConcurrentAccess(t *testing.T) {
+	disc := newTestDiscovery(t, 4)
+	disc.SetOutlierConfig(OutlierConfig{
+		ConsecutiveFailures: 2,
+		BaseEjectionTime:    time.Millisecond,
+		MaxEjectionTime:     10 * time.Millisecond,
+		MaxEjectionPercent:  50,
+	})
+	disc.Watch("TestService", func(inst *ServiceInstance) {
+		_ = inst.URL
+	})
+
+	const iterations = 50
+	var wg sync.WaitGroup
+	run := func(fn func(i int)) {
+		wg.Go(func() {
+			for i := 0; i < iterations; i++ {
+				fn(i)
+			}
+		})
+	}
+	run(func(int) {
+		if err := disc.Refresh(); err != nil {
+			t.Error(err)
+		}
+	})
+	run(func(int) {
+		for _, inst := range disc.GetInstances("TestService") {
+			_ = inst.Healthy && inst.Outlier.Ejected && inst.Outlier.ConsecutiveFailures > 0
+		}
+	})
+	run(func(int) {
+		for _, instances := range disc.GetAllServices() {
+			for _, inst := range instances {
+				_ = inst.Healthy && inst.Outlier.Ejected
+			}
+		}
+	})
+	for _, name := range []string{RoundRobin, Weighted, LeastLatency, PowerOfTwo, ConsistentHash} {
+		b, err := NewBalancer(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		run(func(i int) {
+			if i == 0 {
+				disc.SetBalancer("TestService", b)
+			}
+			inst, release, err := disc.Acquire("TestService", strconv.Itoa(i))
+			if err != nil {
+				// 刷新之前所有实例都可能被驱逐或标记为不健康
+				return
+			}
+			if i%2 == 0 {
+				disc.ReportFailure(inst)
+			} else {
+				disc.ReportSuccess(inst)
+			}
+			if i%7 == 0 {
+				disc.MarkUnhealthy(inst)
+			}
+			release()
+		})
+	}
+	wg.Wait()
+}
+
+func TestOutlierEjection(t *testing.T) {
+	disc := newTestDiscovery(t, 2)
+	disc.SetOutlierConfig(OutlierConfig{
+		ConsecutiveFailures: 3,
+		BaseEjectionTime:    100 * time.Millisecond,
+		MaxEjectionTime:     time.Second,
+		MaxEjectionPercent:  50,
+	})
+	// 调用方拿到的是副本，报告结果按实例ID记录
+	inst := disc.GetInstances("TestService")[0]
+	status := func() OutlierStatus {
+		for _, i := range disc.GetInstances("TestService") {
+			if i.InstanceID == inst.InstanceID {
+				return i.Outlier
+			}
+		}
+		t.Fatalf("instance %s is gone", inst.InstanceID)
+		return OutlierStatus{}
+	}
+	picked := func() bool {
+		for range 20 {
+			if got, err := disc.GetHealthyInstance("TestService"); err == nil && got.InstanceID == inst.InstanceID {
+				return true
+			}
+		}
+		return false
+	}
+
+	disc.ReportFailure(inst)
+	disc.ReportFailure(inst)
+	if s := status(); s.Ejected || s.ConsecutiveFailures != 2 {
+		t.Fatalf("after 2 failures the instance is %+v", s)
+	}
+	disc.ReportFailure(inst)
+	if s := status(); !s.Ejected || s.Ejections != 1 {
+		t.Fatalf("after 3 failures the instance is %+v", s)
+	}
+	// 刷新重新创建实例对象，驱逐状态仍然保留
+	if err := disc.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if !status().Ejected || picked() {
+		t.Fatal("ejected instance was picked")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if status().Ejected || !picked() {
+		t.Fatal("instance did not come back after the ejection period")
+	}
+}
+
+func TestRefreshPrunesBalancers(t *testing.T) {
+	disc := newTestDiscovery(t, 2)
+	b := NewPowerOfTwo().(*powerOfTwo)
+	disc.SetBalancer("TestService", b)
+	gone := &ServiceInstance{Name: "TestService", URL: "http://127.0.0.1:1"}
+	b.Begin(gone)
+	b.End(gone)
+	inst, release, err := disc.Acquire("TestService", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	if err := disc.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.inflight[gone.URL]; ok || len(b.inflight) != 1 {
+		t.Fatalf("inflight after refresh: %v, want only %s", b.inflight, inst.URL)
+	}
+}
+
+func TestNewUsesRegistryURL(t *testing.T) {
+	// 全局客户端指向一个不可用的地址，服务发现实例只访问自己的注册中心
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	prev := registry.DefaultConfig()
+	registry.Configure(registry.ClientConfig{Addresses: []string{dead.URL}, MaxRetries: -1})
+	defer registry.Configure(prev)
+
+	disc := newTestDiscovery(t, 2)
+	if n := len(disc.GetInstances("TestService")); n != 2 {
+		t.Fatalf("got %d instances, want 2", n)
+	}
+}
+
+func TestRefreshChecksConcurrently(t *testing.T) {
+	const n, delay = 4, 300 * time.Millisecond
+	probed := make(chan struct{}, 2*n)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probed <- struct{}{}
+		time.Sleep(delay)
+	})
+	backends := make([]http.Handler, n)
+	for i := range backends {
+		backends[i] = slow
+	}
+	disc := New(newRegistryWith(t, backends...))
+
+	// 逐个检查需要 n*delay
+	start := time.Now()
+	if err := disc.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= n*delay {
+		t.Fatalf("refresh took %v, health checks ran one after another", elapsed)
+	}
+	if got := len(disc.GetInstances("TestService")); got != n {
+		t.Fatalf("got %d instances, want %d", got, n)
+	}
+	for len(probed) > 0 {
+		<-probed
+	}
+
+	// 检查进行期间读取不需要等待
+	done := make(chan error)
+	go func() { done <- disc.Refresh() }()
+	<-probed
+	start = time.Now()
+	if got := len(disc.GetInstances("TestService")); got != n {
+		t.Fatalf("during refresh got %d instances, want %d", got, n)
+	}
+	if elapsed := time.Since(start); elapsed >= delay/2 {
+		t.Fatalf("GetInstances waited %v for the health checks", elapsed)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
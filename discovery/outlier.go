@@ -0,0 +1,136 @@
+package discovery
+
+import (
+	"log"
+	"time"
+)
+
+// OutlierConfig 被动异常检测的配置
+// 调用方通过 ReportSuccess/ReportFailure 报告每次调用的结果，实例连续失败 ConsecutiveFailures 次后
+// 在一段时间内不再被 GetHealthyInstance 选择。第 n 次驱逐的时长为 BaseEjectionTime * 2^(n-1)，
+// 不超过 MaxEjectionTime；实例恢复后持续正常，驱逐次数会逐渐减少
+type OutlierConfig struct {
+	ConsecutiveFailures int           // 触发驱逐的连续失败次数，为 0 时关闭异常检测
+	BaseEjectionTime    time.Duration // 第一次驱逐的时长
+	MaxEjectionTime     time.Duration // 驱逐时长的上限
+	MaxEjectionPercent  int           // 一个服务同时被驱逐的实例最多占多少百分比
+}
+
+// DefaultOutlierConfig 返回默认的异常检测配置
+func DefaultOutlierConfig() OutlierConfig {
+	return OutlierConfig{
+		ConsecutiveFailures: 5,
+		BaseEjectionTime:    30 * time.Second,
+		MaxEjectionTime:     5 * time.Minute,
+		MaxEjectionPercent:  50,
+	}
+}
+
+// OutlierStatus 实例的异常检测状态，按实例ID保存在 Discovery 中，Refresh 时保留，实例注销后删除
+// ServiceInstance.Outlier 是读取实例时的快照
+type OutlierStatus struct {
+	ConsecutiveFailures int       `json:"consecutiveFailures"`   // 当前连续失败的次数
+	Ejections           int       `json:"ejections"`             // 驱逐次数，决定下次驱逐的时长
+	Ejected             bool      `json:"ejected"`               // 当前是否被驱逐
+	EjectedUntil        time.Time `json:"ejectedUntil,omitzero"` // 驱逐结束的时间
+}
+
+// ejected 实例在 now 时是否处于驱逐期
+func (s *OutlierStatus) ejected(now time.Time) bool {
+	return now.Before(s.EjectedUntil)
+}
+
+// SetOutlierConfig 设置异常检测的配置
+func (d *Discovery) SetOutlierConfig(cfg OutlierConfig) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.outlier = cfg
+}
+
+// ejected 实例在 now 时是否处于驱逐期，调用方需持有锁
+func (d *Discovery) ejected(inst *ServiceInstance, now time.Time) bool {
+	s := d.outliers[instanceKey(inst)]
+	return s != nil && s.ejected(now)
+}
+
+// outlierStatus 返回实例的异常检测状态，不存在时创建，调用方需持有写锁
+func (d *Discovery) outlierStatus(inst *ServiceInstance) *OutlierStatus {
+	key := instanceKey(inst)
+	s, ok := d.outliers[key]
+	if !ok {
+		s = &OutlierStatus{}
+		d.outliers[key] = s
+	}
+	return s
+}
+
+// ReportSuccess 报告一次成功的调用，清零实例的连续失败次数
+// inst 可以是 GetInstances、GetHealthyInstance 或 Acquire 返回的副本，状态按实例ID记录
+func (d *Discovery) ReportSuccess(inst *ServiceInstance) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	s, ok := d.outliers[instanceKey(inst)]
+	if !ok {
+		return
+	}
+	s.ConsecutiveFailures = 0
+	// 驱逐结束后又正常运行了一个基础驱逐时长，驱逐次数减一
+	if s.Ejections > 0 && !s.EjectedUntil.IsZero() && time.Since(s.EjectedUntil) > d.outlier.BaseEjectionTime {
+		// 以当前时间作为下一次减少的起点，驱逐次数清零后不再记录
+		s.Ejections--
+		s.EjectedUntil = time.Time{}
+		if s.Ejections > 0 {
+			s.EjectedUntil = time.Now()
+		}
+	}
+}
+
+// ReportFailure 报告一次失败的调用（连接错误或 5xx 响应），连续失败次数达到阈值时驱逐实例
+func (d *Discovery) ReportFailure(inst *ServiceInstance) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	cfg := d.outlier
+	now := time.Now()
+	if cfg.ConsecutiveFailures <= 0 || d.ejected(inst, now) {
+		return
+	}
+	s := d.outlierStatus(inst)
+	s.ConsecutiveFailures++
+	if s.ConsecutiveFailures < cfg.ConsecutiveFailures {
+		return
+	}
+	// 被驱逐的实例达到上限时不再驱逐，避免所有实例都被摘除
+	instances := d.instances[inst.Name]
+	ejected := 0
+	for _, other := range instances {
+		if d.ejected(other, now) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > len(instances)*cfg.MaxEjectionPercent {
+		return
+	}
+	eject := cfg.BaseEjectionTime << min(s.Ejections, 16)
+	if eject <= 0 || eject > cfg.MaxEjectionTime {
+		eject = cfg.MaxEjectionTime
+	}
+	s.Ejections++
+	s.ConsecutiveFailures = 0
+	s.EjectedUntil = now.Add(eject)
+	log.Printf("Ejected %s instance %s for %v after %d consecutive failures\n", inst.Name, inst.URL, eject, cfg.ConsecutiveFailures)
+}
+
+// ReportSuccess 向全局服务发现实例报告一次成功的调用
+func ReportSuccess(inst *ServiceInstance) {
+	d.ReportSuccess(inst)
+}
+
+// ReportFailure 向全局服务发现实例报告一次失败的调用
+func ReportFailure(inst *ServiceInstance) {
+	d.ReportFailure(inst)
+}
+
+// SetOutlierConfig 设置全局服务发现实例的异常检测配置
+func SetOutlierConfig(cfg OutlierConfig) {
+	d.SetOutlierConfig(cfg)
+}
@@ -0,0 +1,223 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/linshule/go-distributed/breaker"
+	"github.com/linshule/go-distributed/tlsutil"
+)
+
+// DefaultMaxAttempts Transport 对幂等请求默认最多尝试的实例数
+const DefaultMaxAttempts = 3
+
+// Transport 按逻辑服务名称发送请求的 http.RoundTripper
+// 请求 http://LibraryService/library/books 时，主机名 LibraryService 会通过 Discovery 解析为
+// 一个健康实例的地址，实例由服务的负载均衡策略选择。
+// 每次调用的结果都会报告给异常检测（见 OutlierConfig），连接失败和 5xx 响应计为失败；
+// 连接失败或实例返回 502/503/504 时，幂等请求会换一个没有尝试过的实例重试。
+// 只有注册中心中有实例的主机名才按服务名称解析，其他主机名的请求原样发送，
+// 因此同一个客户端也可以访问普通地址；这样的主机名无法解析时返回 "unknown service" 错误。
+// 解析服务名称只读取注册中心客户端的缓存，不会在请求中探测实例。
+// 每个上游有一个熔断器，服务名称使用服务的熔断器，普通地址按 host:port 使用熔断器；
+// 熔断器打开时请求直接返回 breaker.ErrOpen
+type Transport struct {
+	// Discovery 解析服务名称使用的服务发现实例，为 nil 时使用全局实例
+	Discovery *Discovery
+	// Base 实际发送请求的 RoundTripper，为 nil 时使用 tlsutil 配置的客户端
+	Base http.RoundTripper
+	// MaxAttempts 幂等请求最多尝试的实例数，为 0 时使用 DefaultMaxAttempts
+	MaxAttempts int
+	// Key 返回请求的路由键，供一致性哈希策略使用，可以为 nil
+	Key func(*http.Request) string
+	// Breakers 上游的熔断器，为 nil 时使用 breaker.Default
+	Breakers *breaker.Set
+}
+
+// NewHTTPClient 返回使用全局服务发现解析服务名称的 HTTP 客户端
+func NewHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: &Transport{}, Timeout: timeout}
+}
+
+// RoundTrip 实现 http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	disc := t.Discovery
+	if disc == nil {
+		disc = d
+	}
+	base := t.Base
+	if base == nil {
+		base = tlsutil.Client().Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+	}
+	breakers := t.Breakers
+	if breakers == nil {
+		breakers = breaker.Default
+	}
+	serviceName := req.URL.Hostname()
+	logical := req.URL.Port() == "" && disc.lookup(req.Context(), serviceName)
+	name := req.URL.Host
+	if logical {
+		name = serviceName
+	}
+	done, err := breakers.Get(name).Allow()
+	if err != nil {
+		closeBody(req)
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	var res *http.Response
+	if logical {
+		res, err = t.roundTrip(req, disc, base, serviceName)
+	} else {
+		res, err = base.RoundTrip(req)
+		// 没有端口、注册中心和 DNS 都不认识的主机名多半是写错或还没有注册的服务名称
+		var dnsErr *net.DNSError
+		if err != nil && req.URL.Port() == "" && errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			err = fmt.Errorf("unknown service %s: not in the registry and %w", serviceName, err)
+		}
+	}
+	// 调用方取消的请求不是上游的问题，不计为失败
+	done(req.Context().Err() != nil || err == nil && res.StatusCode < http.StatusInternalServerError)
+	return res, err
+}
+
+// roundTrip 把请求发送到服务的实例，失败时换一个实例重试
+func (t *Transport) roundTrip(req *http.Request, disc *Discovery, base http.RoundTripper, serviceName string) (*http.Response, error) {
+	attempts := 1
+	if retryable(req) {
+		attempts = t.MaxAttempts
+		if attempts <= 0 {
+			attempts = DefaultMaxAttempts
+		}
+	}
+	var key string
+	if t.Key != nil {
+		key = t.Key(req)
+	}
+
+	var lastErr error
+	var lastRes *http.Response
+	tried := make(map[string]bool)
+	for attempt := 0; attempt < attempts; attempt++ {
+		inst, release, err := disc.acquire(serviceName, key, tried)
+		if err != nil {
+			// 没有可用的实例时返回上一次的结果
+			if lastRes != nil || lastErr != nil {
+				break
+			}
+			closeBody(req)
+			return nil, err
+		}
+		out, err := rewrite(req, inst, attempt)
+		if err != nil {
+			release()
+			closeBody(req)
+			return nil, err
+		}
+		tried[inst.URL] = true
+		if lastRes != nil {
+			lastRes.Body.Close()
+			lastRes = nil
+		}
+
+		res, err := base.RoundTrip(out)
+		if err != nil {
+			release()
+			if req.Context().Err() != nil {
+				return nil, err
+			}
+			disc.ReportFailure(inst)
+			lastErr = fmt.Errorf("%s %s: %w", inst.Name, inst.URL, err)
+			log.Printf("Request to %s instance %s failed: %v\n", inst.Name, inst.URL, err)
+			continue
+		}
+		if res.StatusCode >= http.StatusInternalServerError {
+			disc.ReportFailure(inst)
+		} else {
+			disc.ReportSuccess(inst)
+		}
+		if failed(res.StatusCode) {
+			log.Printf("%s instance %s returned %s\n", inst.Name, inst.URL, res.Status)
+		}
+		res.Body = &releaseBody{ReadCloser: res.Body, release: release}
+		if !failed(res.StatusCode) || attempt == attempts-1 {
+			return res, nil
+		}
+		lastRes, lastErr = res, nil
+	}
+	if lastRes != nil {
+		return lastRes, nil
+	}
+	return nil, lastErr
+}
+
+// rewrite 复制请求并把目标地址替换为实例地址，实例地址中的路径作为前缀
+// 重试时通过 GetBody 重新获取请求体
+func rewrite(req *http.Request, inst *ServiceInstance, attempt int) (*http.Request, error) {
+	target, err := url.Parse(inst.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q for %s: %w", inst.URL, inst.Name, err)
+	}
+	out := req.Clone(req.Context())
+	out.URL.Scheme = target.Scheme
+	out.URL.Host = target.Host
+	out.URL.Path = strings.TrimSuffix(target.Path, "/") + req.URL.Path
+	if req.URL.RawPath != "" {
+		out.URL.RawPath = strings.TrimSuffix(target.EscapedPath(), "/") + req.URL.RawPath
+	}
+	out.Host = ""
+	if attempt > 0 && req.GetBody != nil {
+		if out.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// closeBody 没有把请求交给 Base 就返回错误时关闭请求体，RoundTripper 总是要关闭请求体
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// retryable 请求是否可以在另一个实例上重试
+// 与 net/http 一致，幂等方法或带 Idempotency-Key 的请求才会重试；有请求体时还需要能够重新获取请求体
+func retryable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	_, ok := req.Header["Idempotency-Key"]
+	return ok
+}
+
+// failed 实例是否因为自身故障无法处理请求
+func failed(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// releaseBody 在响应体关闭时结束对实例的占用
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+// Close 关闭响应体并释放实例
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
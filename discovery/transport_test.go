@@ -0,0 +1,118 @@
+package discovery
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/linshule/go-distributed/breaker"
+	"github.com/linshule/go-distributed/registry"
+)
+
+func TestTransportResolvesRegisteredService(t *testing.T) {
+	// 还没有调用过 Refresh，第一次请求时从注册中心客户端找到服务
+	disc := New(newTestRegistry(t, 1))
+	client := &http.Client{Transport: &Transport{Discovery: disc}}
+	res, err := client.Get("http://TestService/books")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "/books" {
+		t.Fatalf("request returned %d %q", res.StatusCode, body)
+	}
+}
+
+// newBlockingRegistry 启动一个注册中心，注册一个 TestService 实例，它的 /health 在测试结束前不会返回
+func newBlockingRegistry(t *testing.T, checks ...registry.CheckDefinition) string {
+	t.Helper()
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			<-release
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+	t.Cleanup(backend.Close)
+	t.Cleanup(func() { close(release) })
+	server := registry.NewServer()
+	rs := httptest.NewServer(server)
+	t.Cleanup(func() {
+		rs.CloseClientConnections()
+		rs.Close()
+		server.Stop()
+	})
+	client := registry.NewClient(registry.ClientConfig{Addresses: []string{rs.URL}, MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+	reg := registry.Registration{ServiceName: "TestService", ServiceUrl: backend.URL, InstanceID: "test-0", Checks: checks}
+	if err := client.RegistrationService(context.Background(), reg); err != nil {
+		t.Fatal(err)
+	}
+	return rs.URL
+}
+
+func TestTransportDoesNotProbeOnRequest(t *testing.T) {
+	disc := New(newBlockingRegistry(t))
+	client := &http.Client{Transport: &Transport{Discovery: disc}, Timeout: 2 * time.Second}
+	res, err := client.Get("http://TestService/books")
+	if err != nil {
+		t.Fatalf("request waited for the health probe: %v", err)
+	}
+	res.Body.Close()
+}
+
+// closeRecorder 记录请求体是否被关闭
+type closeRecorder struct {
+	io.Reader
+	closed atomic.Bool
+}
+
+func (b *closeRecorder) Close() error {
+	b.closed.Store(true)
+	return nil
+}
+
+func TestTransportClosesBodyOnError(t *testing.T) {
+	// 实例的检查还没有执行过，注册中心报告为 critical，没有可用的实例
+	disc := New(newBlockingRegistry(t, registry.CheckDefinition{ID: "ttl", Type: registry.CheckTTL, TTL: "30s"}))
+	transport := &Transport{Discovery: disc, Breakers: breaker.NewSet(breaker.DefaultConfig())}
+	body := &closeRecorder{Reader: strings.NewReader("book")}
+	req, _ := http.NewRequest(http.MethodPost, "http://TestService/books", body)
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Fatal("request to a service without healthy instances succeeded")
+	}
+	if !body.closed.Load() {
+		t.Fatal("request body was not closed")
+	}
+}
+
+// roundTripperFunc 把函数转换为 http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTransportUnknownService(t *testing.T) {
+	disc := New(newTestRegistry(t, 1))
+	// 模拟 DNS 也不认识这个主机名
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: req.URL.Hostname(), IsNotFound: true}
+	})
+	client := &http.Client{Transport: &Transport{Discovery: disc, Base: base}}
+	_, err := client.Get("http://NoSuchService/books")
+	if err == nil || !strings.Contains(err.Error(), "unknown service NoSuchService") {
+		t.Fatalf("request to an unknown service returned %v", err)
+	}
+	// 不认识的主机名不会让服务发现探测实例
+	if disc.hasInstances("TestService") {
+		t.Fatal("the miss refreshed the service list")
+	}
+}
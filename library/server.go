@@ -2,15 +2,28 @@ package library
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/linshule/go-distributed/breaker"
+	"github.com/linshule/go-distributed/registry"
+	"github.com/linshule/go-distributed/tlsutil"
 )
 
-// LogServiceURL 日志服务地址
-var LogServiceURL = "http://localhost:4000/log"
+// LogServiceURL 日志服务地址，为空时从注册中心查找日志服务
+var LogServiceURL string
+
+// logTimeout 发送一条日志的超时
+const logTimeout = 2 * time.Second
+
+// logBreaker 日志服务的熔断器，日志服务不可用时直接丢弃日志，不再等待超时
+var logBreaker = breaker.Get(string(registry.LogService))
 
 // Book 书籍结构
 type Book struct {
@@ -26,25 +39,26 @@ type BorrowRecord struct {
 }
 
 type library struct {
-	books        map[string]Book
+	books         map[string]Book
 	borrowRecords []BorrowRecord
-	mutex        *sync.Mutex
+	mutex         *sync.Mutex
 }
 
 var lib = library{
-	books:        make(map[string]Book),
+	books:         make(map[string]Book),
 	borrowRecords: make([]BorrowRecord, 0),
-	mutex:        new(sync.Mutex),
+	mutex:         new(sync.Mutex),
 }
 
 func (l *library) addBook(book Book) error {
 	l.mutex.Lock()
-	defer l.mutex.Unlock()
 	if _, exists := l.books[book.ID]; exists {
+		l.mutex.Unlock()
 		return fmt.Errorf("book %s already exists", book.ID)
 	}
 	l.books[book.ID] = book
-	// 发送添加书籍日志
+	l.mutex.Unlock()
+	// 发送添加书籍日志，不持有锁，日志服务变慢时不会阻塞其他请求
 	sendLog(fmt.Sprintf("Book added: ID=%s, Title=%s, Author=%s", book.ID, book.Title, book.Author))
 	return nil
 }
@@ -71,11 +85,12 @@ func (l *library) listBooks() []Book {
 
 func (l *library) borrowBook(record BorrowRecord) error {
 	l.mutex.Lock()
-	defer l.mutex.Unlock()
 	if _, exists := l.books[record.BookID]; !exists {
+		l.mutex.Unlock()
 		return fmt.Errorf("book %s not found", record.BookID)
 	}
 	l.borrowRecords = append(l.borrowRecords, record)
+	l.mutex.Unlock()
 	// 发送借阅日志
 	sendLog(fmt.Sprintf("Book borrowed: BookID=%s, Borrower=%s", record.BookID, record.Borrower))
 	return nil
@@ -163,9 +178,15 @@ func (s LibraryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// RegisterHandlers 注册HTTP处理器
-func RegisterHandlers() {
-	http.Handle("/library", &LibraryService{})
+// RegisterHandlers 在 mux 上注册HTTP处理器
+func RegisterHandlers(mux *http.ServeMux) {
+	mux.Handle("/library", &LibraryService{})
+}
+
+// OnReady 服务就绪后发送启动日志，此时已经等待过日志服务
+func OnReady(ctx context.Context) error {
+	sendLog("LibraryService started")
+	return nil
 }
 
 // AddBook 添加书籍（供外部调用）
@@ -188,15 +209,75 @@ func GetBorrowRecords() []BorrowRecord {
 	return lib.getBorrowRecords()
 }
 
-// sendLog 发送日志到日志服务
+// logServiceURL 返回日志服务的地址
+func logServiceURL() (string, error) {
+	if LogServiceURL != "" {
+		return LogServiceURL, nil
+	}
+	reg, err := registry.FindService(registry.LogService, registry.Passing())
+	if err != nil {
+		return "", err
+	}
+	return reg.ServiceUrl + "/log", nil
+}
+
+// CheckLogService 就绪检查：日志服务是否可以访问
+func CheckLogService(ctx context.Context) error {
+	url, err := logServiceURL()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(url, "/log")+"/health/live", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := tlsutil.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("log service returned %v", resp.Status)
+	}
+	return nil
+}
+
+// sendLog 发送日志到日志服务，受日志服务熔断器保护
 func sendLog(message string) {
-	buf := bytes.NewBuffer([]byte(message))
-	resp, err := http.Post(LogServiceURL, "text/plain", buf)
+	done, err := logBreaker.Allow()
 	if err != nil {
-		log.Printf("Failed to send log: %v\n", err)
+		log.Printf("Dropped log %q: %v %v\n", message, registry.LogService, err)
 		return
 	}
+	err = postLog(message)
+	done(err == nil)
+	if err != nil {
+		log.Printf("Failed to send log: %v\n", err)
+	}
+}
+
+// postLog 把一条日志发送到日志服务
+func postLog(message string) error {
+	url, err := logServiceURL()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), logTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBufferString(message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := tlsutil.Client().Do(req)
+	if err != nil {
+		return err
+	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("log service returned %v", resp.Status)
+	}
+	return nil
 }
 
 // 初始化一些示例数据
@@ -205,7 +286,4 @@ func init() {
 	lib.books["1"] = Book{ID: "1", Title: "Go编程实战", Author: "张三"}
 	lib.books["2"] = Book{ID: "2", Title: "分布式系统设计", Author: "李四"}
 	lib.books["3"] = Book{ID: "3", Title: "HTTP协议详解", Author: "王五"}
-
-	// 发送启动日志
-	sendLog("LibraryService started")
 }
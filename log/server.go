@@ -24,8 +24,9 @@ func Run(destination string) {
 	log = stlog.New(fileLog(destination), "go: ", stlog.LstdFlags)
 }
 
-func RegisterHandlers() {
-	http.HandleFunc("/log", func(w http.ResponseWriter, r *http.Request) {
+// RegisterHandlers 在 mux 上注册日志接口
+func RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/log", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
 			msg, err := io.ReadAll(r.Body)
@@ -5,31 +5,51 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/linshule/go-distributed/breaker"
 	"github.com/linshule/go-distributed/registry"
+	"github.com/linshule/go-distributed/tlsutil"
 )
 
 // ServiceStatus 服务状态
 type ServiceStatus struct {
-	Name      string    `json:"name"`
-	URL       string    `json:"url"`
-	Status    string    `json:"status"`     // "healthy", "unhealthy", "unknown"
-	LastCheck time.Time `json:"last_check"` // 最后检查时间
-	Latency   int64     `json:"latency"`    // 响应延迟（毫秒）
+	Name       string           `json:"name"`
+	InstanceID string           `json:"instanceId"` // 同一服务的多个实例分别记录
+	URL        string           `json:"url"`
+	Status     string           `json:"status"`             // "healthy", "unhealthy", "unknown"
+	LastCheck  time.Time        `json:"last_check"`         // 最后检查时间
+	Latency    int64            `json:"latency"`            // 响应延迟（毫秒）
+	Breakers   []breaker.Status `json:"breakers,omitempty"` // 服务进程中熔断器的状态
 }
 
+// BreakerEvent 从服务收集到的熔断器状态变化
+type BreakerEvent struct {
+	Service    string `json:"service"`
+	InstanceID string `json:"instanceId"`
+	URL        string `json:"url"`
+	breaker.Event
+}
+
+// maxBreakerEvents 监控服务保留的最近熔断器事件数
+const maxBreakerEvents = 200
+
 // MonitorService 监控服务
 type MonitorService struct {
-	checks    map[string]*ServiceStatus
+	checks    map[string]*ServiceStatus // 按实例ID记录
 	checkLock sync.RWMutex
 	interval  time.Duration
+	events    []BreakerEvent    // 最近的熔断器状态变化
+	eventSeq  map[string]uint64 // 每个实例已收集到的事件序号
 }
 
 var monitor = MonitorService{
 	checks:   make(map[string]*ServiceStatus),
 	interval: 10 * time.Second,
+	eventSeq: make(map[string]uint64),
 }
 
 // StartMonitoring 启动监控
@@ -42,6 +62,7 @@ func (m *MonitorService) StartMonitoring() {
 	}()
 }
 
+// checkAllServices 检查所有实例，请求实例时不持有锁，全部完成后再合并结果
 func (m *MonitorService) checkAllServices() {
 	regs, err := registry.GetServices()
 	if err != nil {
@@ -49,58 +70,108 @@ func (m *MonitorService) checkAllServices() {
 		return
 	}
 
+	statuses := make([]*ServiceStatus, 0, len(regs))
+	reports := make([]*breaker.Report, 0, len(regs))
+	for _, reg := range regs {
+		status, report := checkService(reg)
+		statuses = append(statuses, status)
+		reports = append(reports, report)
+	}
+
 	m.checkLock.Lock()
 	defer m.checkLock.Unlock()
 
-	// 标记所有服务为unknown，然后检查
-	currentServices := make(map[string]bool)
-	for _, reg := range regs {
-		currentServices[string(reg.ServiceName)] = true
-		if _, exists := m.checks[string(reg.ServiceName)]; !exists {
-			m.checks[string(reg.ServiceName)] = &ServiceStatus{
-				Name: string(reg.ServiceName),
-				URL:  reg.ServiceUrl,
-			}
+	// 已注销的实例不再出现在新的结果中
+	checks := make(map[string]*ServiceStatus, len(statuses))
+	for i, status := range statuses {
+		if reports[i] != nil {
+			m.mergeBreakerEvents(status, reports[i].Events)
 		}
+		checks[status.InstanceID] = status
 	}
-
-	// 检查每个服务
-	for _, reg := range regs {
-		m.checkService(reg.ServiceName, reg.ServiceUrl)
-	}
-
-	// 清理已注销的服务
-	for name := range m.checks {
-		if !currentServices[name] {
-			delete(m.checks, name)
+	for id := range m.eventSeq {
+		if checks[id] == nil {
+			delete(m.eventSeq, id)
 		}
 	}
+	m.checks = checks
 }
 
-func (m *MonitorService) checkService(name registry.ServiceName, url string) {
+// checkService 探测实例的 /health，可用时读取它的 /breakers
+func checkService(reg registry.Registration) (*ServiceStatus, *breaker.Report) {
 	start := time.Now()
-	resp, err := http.Get(url)
+	resp, err := tlsutil.Client().Get(reg.ServiceUrl + "/health")
 	latency := time.Since(start).Milliseconds()
 
 	status := &ServiceStatus{
-		Name:      string(name),
-		URL:       url,
-		LastCheck: time.Now(),
-		Latency:   latency,
+		Name:       string(reg.ServiceName),
+		InstanceID: reg.InstanceID,
+		URL:        reg.ServiceUrl,
+		LastCheck:  time.Now(),
+		Latency:    latency,
 	}
 
 	if err != nil {
 		status.Status = "unhealthy"
+		return status, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		status.Status = "healthy"
 	} else {
-		defer resp.Body.Close()
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			status.Status = "healthy"
-		} else {
-			status.Status = "unhealthy"
+		status.Status = "unhealthy"
+	}
+
+	report := fetchBreakers(reg.ServiceUrl)
+	if report != nil {
+		status.Breakers = report.Breakers
+	}
+	return status, report
+}
+
+// fetchBreakers 读取实例的 /breakers，失败时返回 nil
+func fetchBreakers(url string) *breaker.Report {
+	resp, err := tlsutil.Client().Get(url + "/breakers")
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	var report breaker.Report
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil
+	}
+	return &report
+}
+
+// mergeBreakerEvents 记录实例新的熔断器状态变化事件，调用方需持有锁
+func (m *MonitorService) mergeBreakerEvents(status *ServiceStatus, events []breaker.Event) {
+	last := m.eventSeq[status.InstanceID]
+	// 序号变小说明服务重启了，重新收集
+	if n := len(events); n > 0 && events[n-1].Seq < last {
+		last = 0
+	}
+	for _, ev := range events {
+		if ev.Seq <= last {
+			continue
 		}
+		log.Printf("Circuit breaker %s in %s (%s): %v -> %v\n", ev.Name, status.Name, status.InstanceID, ev.From, ev.To)
+		m.events = append(m.events, BreakerEvent{Service: status.Name, InstanceID: status.InstanceID, URL: status.URL, Event: ev})
+		last = ev.Seq
+	}
+	if len(m.events) > maxBreakerEvents {
+		m.events = append(m.events[:0], m.events[len(m.events)-maxBreakerEvents:]...)
 	}
+	m.eventSeq[status.InstanceID] = last
+}
 
-	m.checks[string(name)] = status
+// GetBreakerEvents 获取最近的熔断器状态变化
+func (m *MonitorService) GetBreakerEvents() []BreakerEvent {
+	m.checkLock.RLock()
+	defer m.checkLock.RUnlock()
+	return append([]BreakerEvent{}, m.events...)
 }
 
 // GetStatus 获取所有服务状态
@@ -115,15 +186,22 @@ func (m *MonitorService) GetStatus() []ServiceStatus {
 	return result
 }
 
-// GetServiceStatus 获取单个服务状态
-func (m *MonitorService) GetServiceStatus(name string) (ServiceStatus, error) {
+// GetServiceStatus 获取一个服务所有实例的状态，按实例ID排序
+func (m *MonitorService) GetServiceStatus(name string) ([]ServiceStatus, error) {
 	m.checkLock.RLock()
 	defer m.checkLock.RUnlock()
 
-	if status, exists := m.checks[name]; exists {
-		return *status, nil
+	var result []ServiceStatus
+	for _, status := range m.checks {
+		if status.Name == name {
+			result = append(result, *status)
+		}
 	}
-	return ServiceStatus{}, fmt.Errorf("service %s not found", name)
+	if len(result) == 0 {
+		return nil, fmt.Errorf("service %s not found", name)
+	}
+	slices.SortFunc(result, func(a, b ServiceStatus) int { return strings.Compare(a.InstanceID, b.InstanceID) })
+	return result, nil
 }
 
 // MonitorHTTPService HTTP服务
@@ -138,9 +216,23 @@ func (s MonitorHTTPService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			statuses := monitor.GetStatus()
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(statuses)
-		} else if len(path) > 7 && path[:7] == "/health/" {
-			// 获取单个服务健康状态
-			name := path[7:]
+		} else if path == "/breakers" {
+			// 获取所有实例的熔断器状态和最近的状态变化，按实例ID分组
+			statuses := monitor.GetStatus()
+			breakers := make(map[string][]breaker.Status)
+			for _, status := range statuses {
+				if len(status.Breakers) > 0 {
+					breakers[status.InstanceID] = status.Breakers
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{
+				"breakers": breakers,
+				"events":   monitor.GetBreakerEvents(),
+			})
+		} else if strings.HasPrefix(path, "/health/") {
+			// 获取单个服务所有实例的健康状态
+			name := strings.TrimPrefix(path, "/health/")
 			status, err := monitor.GetServiceStatus(name)
 			if err != nil {
 				w.WriteHeader(http.StatusNotFound)
@@ -156,9 +248,10 @@ func (s MonitorHTTPService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// RegisterHandlers 注册HTTP处理器
-func RegisterHandlers() {
-	http.Handle("/monitor", &MonitorHTTPService{})
+// RegisterHandlers 在 mux 上注册HTTP处理器
+func RegisterHandlers(mux *http.ServeMux) {
+	mux.Handle("/monitor", &MonitorHTTPService{})
+	mux.Handle("/monitor/", http.StripPrefix("/monitor", &MonitorHTTPService{}))
 	// 启动监控
 	monitor.StartMonitoring()
 }
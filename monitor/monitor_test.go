@@ -0,0 +1,90 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/linshule/go-distributed/breaker"
+	"github.com/linshule/go-distributed/registry"
+)
+
+// newTestInstance 启动一个实例，/breakers 返回一个以实例ID命名的打开的熔断器
+// 处理 /breakers 时读取监控状态，检查时持有锁会让读取超时
+func newTestInstance(t *testing.T, m *MonitorService, id string) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/breakers", func(w http.ResponseWriter, r *http.Request) {
+		read := make(chan struct{})
+		go func() {
+			m.GetStatus()
+			close(read)
+		}()
+		select {
+		case <-read:
+		case <-time.After(time.Second):
+			t.Errorf("monitor held its lock while fetching /breakers of %s", id)
+		}
+		json.NewEncoder(w).Encode(breaker.Report{
+			Breakers: []breaker.Status{{Name: id, State: breaker.Open}},
+			Events:   []breaker.Event{{Seq: 1, Name: id, From: breaker.Closed, To: breaker.Open}},
+		})
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+func TestMonitorTracksInstances(t *testing.T) {
+	m := &MonitorService{checks: make(map[string]*ServiceStatus), eventSeq: make(map[string]uint64)}
+
+	rs := httptest.NewServer(registry.NewServer())
+	t.Cleanup(func() {
+		rs.CloseClientConnections()
+		rs.Close()
+	})
+	prev := registry.DefaultConfig()
+	cfg := prev
+	cfg.Addresses = []string{rs.URL}
+	cfg.MaxRetries = -1
+	registry.Configure(cfg)
+	defer registry.Configure(prev)
+
+	client := registry.NewClient(cfg)
+	for _, id := range []string{"orders-1", "orders-2"} {
+		reg := registry.Registration{ServiceName: "Orders", InstanceID: id, ServiceUrl: newTestInstance(t, m, id)}
+		if err := client.RegistrationService(context.Background(), reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.checkAllServices()
+	m.checkAllServices()
+
+	statuses, err := m.GetServiceStatus("Orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("got %d statuses for two instances of one service", len(statuses))
+	}
+	for i, id := range []string{"orders-1", "orders-2"} {
+		st := statuses[i]
+		if st.InstanceID != id || st.Status != "healthy" || len(st.Breakers) != 1 || st.Breakers[0].Name != id {
+			t.Fatalf("status of %s is %+v", id, st)
+		}
+	}
+
+	// 两个实例的事件都收集到，第二轮检查不重复收集
+	events := m.GetBreakerEvents()
+	if len(events) != 2 || events[0].InstanceID == events[1].InstanceID {
+		t.Fatalf("events %+v", events)
+	}
+	if _, err := m.GetServiceStatus("Unknown"); err == nil {
+		t.Fatal("unknown service has a status")
+	}
+}
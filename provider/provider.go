@@ -1,11 +1,13 @@
 package provider
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/linshule/go-distributed/registry"
 )
@@ -15,6 +17,7 @@ type ServiceProvider struct {
 	registrations []registry.Registration
 	notifyLock    sync.RWMutex
 	notifyMap     map[string][]chan<- registry.Registration
+	watching      bool // 是否正在通过事件流跟踪注册中心
 }
 
 var sp = ServiceProvider{
@@ -63,10 +66,8 @@ func (p *ServiceProvider) UpdateServices(regs []registry.Registration) {
 	}
 }
 
+// notifyAll 通知某个服务的所有订阅者，调用方需持有锁
 func (p *ServiceProvider) notifyAll(serviceName string, reg registry.Registration) {
-	p.notifyLock.RLock()
-	defer p.notifyLock.RUnlock()
-
 	if channels, ok := p.notifyMap[serviceName]; ok {
 		for _, ch := range channels {
 			select {
@@ -78,6 +79,81 @@ func (p *ServiceProvider) notifyAll(serviceName string, reg registry.Registratio
 	}
 }
 
+// ApplyEvent 把注册中心的一个事件应用到服务列表，并通知订阅者
+// 实例被移除时，通知的注册信息中 ServiceUrl 为空
+func (p *ServiceProvider) ApplyEvent(ev registry.Event) {
+	p.notifyLock.Lock()
+	defer p.notifyLock.Unlock()
+
+	r := ev.Registration
+	index := -1
+	for i, existing := range p.registrations {
+		if existing.InstanceID == r.InstanceID {
+			index = i
+			break
+		}
+	}
+
+	switch ev.Type {
+	case registry.EventRegistered, registry.EventUpdated, registry.EventHealthChanged:
+		if index >= 0 {
+			p.registrations[index] = r
+		} else {
+			p.registrations = append(p.registrations, r)
+		}
+		p.notifyAll(string(r.ServiceName), r)
+	case registry.EventDeregistered, registry.EventExpired:
+		if index >= 0 {
+			p.registrations = append(p.registrations[:index], p.registrations[index+1:]...)
+		}
+		p.notifyAll(string(r.ServiceName), registry.Registration{
+			ServiceName: r.ServiceName,
+			InstanceID:  r.InstanceID,
+			ServiceUrl:  "",
+		})
+	}
+}
+
+// WatchEvents 通过注册中心的事件流跟踪服务变化，代替轮询和列表比对，ctx 结束时停止
+func (p *ServiceProvider) WatchEvents(ctx context.Context) {
+	defer func() {
+		p.notifyLock.Lock()
+		p.watching = false
+		p.notifyLock.Unlock()
+	}()
+	for ctx.Err() == nil {
+		// 先取得全量列表和对应的修改序号，再从该序号之后订阅事件
+		regs, index, err := registry.WatchServices(0, time.Second)
+		if err != nil {
+			log.Println("Failed to get services:", err)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		p.UpdateServices(regs)
+		p.notifyLock.Lock()
+		p.watching = true
+		p.notifyLock.Unlock()
+
+		p.consumeEvents(ctx, index)
+	}
+}
+
+// consumeEvents 应用事件直到事件流要求重新获取全量列表
+func (p *ServiceProvider) consumeEvents(ctx context.Context, index uint64) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for ev := range registry.SubscribeEvents(ctx, index) {
+		if ev.Type == registry.EventReset {
+			log.Println("Registry event history lost, reloading services")
+			return
+		}
+		p.ApplyEvent(ev)
+	}
+}
+
 // Subscribe 订阅服务变化
 func (p *ServiceProvider) Subscribe(serviceName string) chan registry.Registration {
 	p.notifyLock.Lock()
@@ -106,6 +182,16 @@ func (p *ServiceProvider) Unsubscribe(serviceName string, ch chan registry.Regis
 
 // GetServices 获取所有服务
 func (p *ServiceProvider) GetServices() []registry.Registration {
+	p.notifyLock.RLock()
+	if p.watching {
+		// 事件流保证本地列表是最新的
+		defer p.notifyLock.RUnlock()
+		result := make([]registry.Registration, len(p.registrations))
+		copy(result, p.registrations)
+		return result
+	}
+	p.notifyLock.RUnlock()
+
 	regs, err := registry.GetServices()
 	if err != nil {
 		log.Println("Failed to get services:", err)
@@ -140,7 +226,12 @@ func (s ProviderService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// RegisterHandlers 注册HTTP处理器
-func RegisterHandlers() {
-	http.Handle("/providers", &ProviderService{})
+// StartWatching 在后台通过事件流跟踪服务变化
+func StartWatching(ctx context.Context) {
+	go sp.WatchEvents(ctx)
+}
+
+// RegisterHandlers 在 mux 上注册HTTP处理器
+func RegisterHandlers(mux *http.ServeMux) {
+	mux.Handle("/providers", &ProviderService{})
 }
@@ -0,0 +1,220 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	stateFileName = "raft.state"
+	logFileName   = "raft.log"
+)
+
+// FileStorage 基于文件的存储
+//
+// 任期和投票保存在一个小文件中，先写临时文件再重命名，任何时刻磁盘上都是完整的状态。
+// 日志每行一条，格式为 "<crc32> <json>"；覆盖冲突的条目时先截断文件再追加。
+// 进程在写入中途崩溃时最后一行可能不完整或校验失败，Load 会从该行截断日志，
+// 这条日志没有同步完成，节点也就没有向 Leader 确认过它。
+type FileStorage struct {
+	dir     string
+	log     *os.File
+	offsets []int64 // offsets[i] 是索引为 i+1 的条目在文件中的位置
+	size    int64
+	mutex   sync.Mutex
+}
+
+// NewFileStorage 在 dir 目录下打开（或创建）文件存储，追加日志之前需要先调用 Load（NewNode 会调用）
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir, log: f}, nil
+}
+
+// Load 读取任期、投票和日志，并截断日志末尾损坏的记录
+func (s *FileStorage) Load() (HardState, []Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var st HardState
+	data, err := os.ReadFile(filepath.Join(s.dir, stateFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return st, nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &st); err != nil {
+			return st, nil, fmt.Errorf("raft: corrupt state file: %v", err)
+		}
+	}
+
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return st, nil, err
+	}
+	var entries []Entry
+	var offset int64
+	s.offsets = s.offsets[:0]
+	reader := bufio.NewReader(s.log)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("raft: discarding incomplete log record at offset %d\n", offset)
+			}
+			break
+		}
+		if err != nil {
+			return st, nil, err
+		}
+		e, ok := decodeEntry(line)
+		if !ok || e.Index != uint64(len(entries))+1 {
+			log.Printf("raft: discarding corrupt log record at offset %d\n", offset)
+			break
+		}
+		s.offsets = append(s.offsets, offset)
+		entries = append(entries, e)
+		offset += int64(len(line))
+	}
+
+	// 丢弃损坏的尾部，后续追加从最后一条完整记录之后开始
+	if err := s.truncate(offset); err != nil {
+		return st, nil, err
+	}
+	return st, entries, nil
+}
+
+// SaveState 原子地替换任期和投票
+func (s *FileStorage) SaveState(st HardState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tmp := filepath.Join(s.dir, stateFileName+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, stateFileName)); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// Append 追加日志并同步到磁盘，先删除索引冲突的旧条目
+func (s *FileStorage) Append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "%08x %s\n", crc32.ChecksumIEEE(data), data)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	first := entries[0].Index
+	if first > uint64(len(s.offsets))+1 {
+		return errGap(first, uint64(len(s.offsets)))
+	}
+	if first <= uint64(len(s.offsets)) {
+		if err := s.truncate(s.offsets[first-1]); err != nil {
+			return err
+		}
+		s.offsets = s.offsets[:first-1]
+	}
+
+	offset := s.size
+	for _, line := range bytes.SplitAfter(buf.Bytes(), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		s.offsets = append(s.offsets, offset)
+		offset += int64(len(line))
+	}
+	if _, err := s.log.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	s.size = offset
+	return s.log.Sync()
+}
+
+// Close 关闭日志文件
+func (s *FileStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.log.Close()
+}
+
+// truncate 把日志截断到 size 字节，之后的写入从这里开始，调用方需持有锁
+func (s *FileStorage) truncate(size int64) error {
+	if err := s.log.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
+// decodeEntry 解析并校验一行日志记录
+func decodeEntry(line []byte) (Entry, bool) {
+	var e Entry
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	sum, data, found := bytes.Cut(line, []byte(" "))
+	if !found {
+		return e, false
+	}
+	var crc uint32
+	if _, err := fmt.Sscanf(string(sum), "%08x", &crc); err != nil {
+		return e, false
+	}
+	if crc32.ChecksumIEEE(data) != crc {
+		return e, false
+	}
+	if err := json.Unmarshal(data, &e); err != nil {
+		return e, false
+	}
+	return e, true
+}
+
+// syncDir 同步目录，保证重命名已持久化
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,98 @@
+package raft
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openFileStorage 打开 dir 下的存储并加载，测试结束时关闭
+func openFileStorage(t *testing.T, dir string) (*FileStorage, HardState, []Entry) {
+	t.Helper()
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	st, entries, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, st, entries
+}
+
+// checkTerms 检查日志的索引连续，任期依次为 terms
+func checkTerms(t *testing.T, entries []Entry, terms ...uint64) {
+	t.Helper()
+	if len(entries) != len(terms) {
+		t.Fatalf("loaded %d entries %v, want %d", len(entries), entries, len(terms))
+	}
+	for i, e := range entries {
+		if e.Index != uint64(i)+1 || e.Term != terms[i] {
+			t.Fatalf("entry %d is {index %d, term %d}, want {index %d, term %d}", i, e.Index, e.Term, i+1, terms[i])
+		}
+	}
+}
+
+func TestFileStorageState(t *testing.T) {
+	dir := t.TempDir()
+	s, _, _ := openFileStorage(t, dir)
+	if err := s.SaveState(HardState{Term: 3, VotedFor: "http://b"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	_, st, _ := openFileStorage(t, dir)
+	if st.Term != 3 || st.VotedFor != "http://b" {
+		t.Fatalf("loaded state %+v", st)
+	}
+}
+
+func TestFileStorageOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	s, _, _ := openFileStorage(t, dir)
+	if err := s.Append([]Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2}, {Term: 1, Index: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	// 新 Leader 覆盖了索引 2 之后的条目
+	if err := s.Append([]Entry{{Term: 2, Index: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append([]Entry{{Term: 2, Index: 3}, {Term: 2, Index: 4}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append([]Entry{{Term: 2, Index: 6}}); err == nil {
+		t.Fatal("append with a gap succeeded")
+	}
+	s.Close()
+
+	_, _, entries := openFileStorage(t, dir)
+	checkTerms(t, entries, 1, 2, 2, 2)
+}
+
+func TestFileStorageTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s, _, _ := openFileStorage(t, dir)
+	if err := s.Append([]Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// 进程在写第 3 条记录时崩溃
+	f, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`0badc0de {"term":1,"ind`)
+	f.Close()
+
+	s, _, entries := openFileStorage(t, dir)
+	checkTerms(t, entries, 1, 1)
+	if err := s.Append([]Entry{{Term: 1, Index: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	_, _, entries = openFileStorage(t, dir)
+	checkTerms(t, entries, 1, 1, 1)
+}
@@ -0,0 +1,596 @@
+// Package raft 实现了一个精简的 Raft 共识算法，用于在多个注册中心节点之间复制变更日志。
+//
+// 节点之间通过 HTTP+JSON 通信，Handler 返回的处理器需要挂载在节点地址的 /raft/ 路径下。
+// 投票和日志复制请求必须通过认证（共享密钥或 mTLS 客户端证书），否则任何人都可以伪造日志。
+// 任期、投票和日志在回复其他节点之前写入 Config.Storage，重启的节点从存储恢复后重新加入集群。
+// 日志没有压缩：重启后已提交的条目会从头重新应用一遍，状态机需要从空状态开始。
+package raft
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrNotLeader 当前节点不是 Leader，无法处理写请求
+var ErrNotLeader = errors.New("raft: not the leader")
+
+// ErrLeadershipLost 提案提交前 Leader 发生了变化，提案可能没有生效
+var ErrLeadershipLost = errors.New("raft: leadership lost before commit")
+
+// ErrStopped 节点已停止
+var ErrStopped = errors.New("raft: node stopped")
+
+// ErrNoAuth 没有配置节点之间的认证方式
+var ErrNoAuth = errors.New("raft: peer authentication requires Secret or PeerIdentities")
+
+// State 节点角色
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "unknown"
+}
+
+// Entry 日志条目
+type Entry struct {
+	Term  uint64 `json:"term"`
+	Index uint64 `json:"index"`
+	Data  []byte `json:"data"` // 为空表示 Leader 上任时追加的空操作
+}
+
+// Config 节点配置
+type Config struct {
+	ID                string              // 本节点地址，例如 "http://localhost:3000"
+	Peers             []string            // 其他节点的地址
+	ElectionTimeout   time.Duration       // 选举超时下限，实际超时在 [T, 2T) 之间随机
+	HeartbeatInterval time.Duration       // Leader 发送心跳的间隔
+	Apply             func(data []byte)   // 按日志顺序应用已提交的条目
+	OnLeaderChange    func(isLeader bool) // 本节点成为或不再是 Leader 时回调
+	Transport         http.RoundTripper   // 访问其他节点使用的传输层，为空时使用 http.DefaultTransport
+	Storage           Storage             // 持久化任期、投票和日志，为空时只保存在内存中
+	Secret            string              // 节点之间共享的密钥，通过 SecretHeader 请求头携带
+	PeerIdentities    []string            // 允许的节点证书名称（CN），请求方必须出示经过验证的客户端证书
+}
+
+// Node Raft 节点
+type Node struct {
+	cfg    Config
+	client *http.Client
+
+	mutex       sync.Mutex
+	state       State
+	currentTerm uint64
+	votedFor    string
+	leaderID    string
+	entries     []Entry // entries[0] 是索引为 0 的哨兵
+	commitIndex uint64
+	lastApplied uint64
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+
+	lastContact     time.Time
+	electionTimeout time.Duration
+	lastBroadcast   time.Time
+
+	applyCond *sync.Cond
+	appliedCh chan struct{} // 每应用一批条目关闭一次，用于唤醒等待者
+	stopCh    chan struct{}
+	stopped   bool
+}
+
+// NewNode 创建节点并从存储恢复任期、投票和日志，调用 Start 后开始参与选举
+// Secret 和 PeerIdentities 至少要配置一个，都配置时请求需要同时满足两者
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.Secret == "" && len(cfg.PeerIdentities) == 0 {
+		return nil, ErrNoAuth
+	}
+	if cfg.Storage == nil {
+		cfg.Storage = NewMemoryStorage()
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = 300 * time.Millisecond
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = cfg.ElectionTimeout / 5
+	}
+	n := &Node{
+		cfg:        cfg,
+		client:     &http.Client{Transport: cfg.Transport, Timeout: cfg.ElectionTimeout},
+		entries:    []Entry{{}},
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		appliedCh:  make(chan struct{}),
+		stopCh:     make(chan struct{}),
+	}
+	n.applyCond = sync.NewCond(&n.mutex)
+
+	st, entries, err := cfg.Storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	n.currentTerm = st.Term
+	n.votedFor = st.VotedFor
+	n.entries = append(n.entries, entries...)
+	if len(entries) > 0 {
+		log.Printf("raft: %s recovered term %d and %d log entries\n", cfg.ID, st.Term, len(entries))
+	}
+	return n, nil
+}
+
+// Start 启动选举计时和日志应用
+func (n *Node) Start() {
+	n.mutex.Lock()
+	n.lastContact = time.Now()
+	n.resetElectionTimeout()
+	n.mutex.Unlock()
+	go n.run()
+	go n.applyLoop()
+}
+
+// Stop 停止节点
+func (n *Node) Stop() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.stopped {
+		return
+	}
+	n.stopped = true
+	close(n.stopCh)
+	n.applyCond.Broadcast()
+}
+
+// ID 返回本节点地址
+func (n *Node) ID() string {
+	return n.cfg.ID
+}
+
+// IsLeader 本节点当前是否是 Leader，停止的节点不是 Leader
+func (n *Node) IsLeader() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.state == Leader && !n.stopped
+}
+
+// Leader 返回当前已知的 Leader 地址，未知时返回空字符串
+func (n *Node) Leader() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.state == Leader {
+		return n.cfg.ID
+	}
+	return n.leaderID
+}
+
+// Status 节点状态，用于展示
+type Status struct {
+	ID          string `json:"id"`
+	State       string `json:"state"`
+	Term        uint64 `json:"term"`
+	Leader      string `json:"leader"`
+	LastIndex   uint64 `json:"lastIndex"`
+	CommitIndex uint64 `json:"commitIndex"`
+	LastApplied uint64 `json:"lastApplied"`
+}
+
+// Status 返回节点当前状态
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	leader := n.leaderID
+	if n.state == Leader {
+		leader = n.cfg.ID
+	}
+	return Status{
+		ID:          n.cfg.ID,
+		State:       n.state.String(),
+		Term:        n.currentTerm,
+		Leader:      leader,
+		LastIndex:   n.lastIndex(),
+		CommitIndex: n.commitIndex,
+		LastApplied: n.lastApplied,
+	}
+}
+
+// Propose 提交一条数据，等到它在本节点应用后返回
+// 只有 Leader 可以提案，其他节点返回 ErrNotLeader
+func (n *Node) Propose(ctx context.Context, data []byte) error {
+	n.mutex.Lock()
+	if n.state != Leader {
+		n.mutex.Unlock()
+		return ErrNotLeader
+	}
+	term := n.currentTerm
+	index := n.lastIndex() + 1
+	e := Entry{Term: term, Index: index, Data: data}
+	if err := n.cfg.Storage.Append([]Entry{e}); err != nil {
+		n.mutex.Unlock()
+		return err
+	}
+	n.entries = append(n.entries, e)
+	n.matchIndex[n.cfg.ID] = index
+	n.advanceCommitIndex()
+	n.mutex.Unlock()
+
+	n.broadcast()
+	return n.waitApplied(ctx, index, term)
+}
+
+// ReadIndex 确认本节点仍是 Leader，并等待状态机追上当前提交位置
+// 之后在本节点读取的状态是线性一致的
+func (n *Node) ReadIndex(ctx context.Context) error {
+	n.mutex.Lock()
+	if n.state != Leader {
+		n.mutex.Unlock()
+		return ErrNotLeader
+	}
+	term := n.currentTerm
+	// Leader 需要先提交一条本任期的日志，才能确定提交位置是最新的
+	if n.entries[n.commitIndex].Term != term {
+		n.mutex.Unlock()
+		return ErrLeadershipLost
+	}
+	readIndex := n.commitIndex
+	n.mutex.Unlock()
+
+	if !n.confirmLeadership(term) {
+		return ErrLeadershipLost
+	}
+	return n.waitApplied(ctx, readIndex, 0)
+}
+
+// waitApplied 等待 index 被应用，term 不为 0 时还会检查该位置的条目没有被覆盖
+func (n *Node) waitApplied(ctx context.Context, index, term uint64) error {
+	for {
+		n.mutex.Lock()
+		if n.stopped {
+			n.mutex.Unlock()
+			return ErrStopped
+		}
+		if n.lastApplied >= index {
+			overwritten := term != 0 && n.entries[index].Term != term
+			n.mutex.Unlock()
+			if overwritten {
+				return ErrLeadershipLost
+			}
+			return nil
+		}
+		ch := n.appliedCh
+		n.mutex.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-n.stopCh:
+			return ErrStopped
+		}
+	}
+}
+
+// run 驱动选举超时和 Leader 心跳
+func (n *Node) run() {
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		n.mutex.Lock()
+		state := n.state
+		electionDue := state != Leader && time.Since(n.lastContact) >= n.electionTimeout
+		heartbeatDue := state == Leader && time.Since(n.lastBroadcast) >= n.cfg.HeartbeatInterval
+		n.mutex.Unlock()
+
+		if electionDue {
+			n.startElection()
+		} else if heartbeatDue {
+			n.broadcast()
+		}
+	}
+}
+
+// startElection 成为候选人并向所有节点请求投票
+func (n *Node) startElection() {
+	n.mutex.Lock()
+	n.state = Candidate
+	n.currentTerm++
+	n.votedFor = n.cfg.ID
+	n.leaderID = ""
+	n.lastContact = time.Now()
+	n.resetElectionTimeout()
+	if err := n.saveState(); err != nil {
+		// 没有记下给自己的一票就不能拉票，否则重启后可能在同一任期再投给别人
+		n.state = Follower
+		n.mutex.Unlock()
+		log.Printf("raft: %s failed to persist state, not starting election: %v\n", n.cfg.ID, err)
+		return
+	}
+	term := n.currentTerm
+	args := VoteRequest{
+		Term:         term,
+		CandidateID:  n.cfg.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.entries[n.lastIndex()].Term,
+	}
+	n.mutex.Unlock()
+	log.Printf("raft: %s starting election for term %d\n", n.cfg.ID, term)
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader(term)
+		return
+	}
+	var voteMutex sync.Mutex
+	for _, peer := range n.cfg.Peers {
+		go func(peer string) {
+			var reply VoteReply
+			if err := n.call(peer, "/raft/vote", args, &reply); err != nil {
+				return
+			}
+			if n.stepDownIfStale(reply.Term) || !reply.Granted {
+				return
+			}
+			voteMutex.Lock()
+			votes++
+			won := votes == n.quorum()
+			voteMutex.Unlock()
+			if won {
+				n.becomeLeader(term)
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader 在 term 仍然有效时成为 Leader
+func (n *Node) becomeLeader(term uint64) {
+	n.mutex.Lock()
+	if n.state != Candidate || n.currentTerm != term {
+		n.mutex.Unlock()
+		return
+	}
+	last := n.lastIndex()
+	// 追加一条空操作，使之前任期的日志能够尽快提交
+	noop := Entry{Term: term, Index: last + 1}
+	if err := n.cfg.Storage.Append([]Entry{noop}); err != nil {
+		n.state = Follower
+		n.mutex.Unlock()
+		log.Printf("raft: %s failed to persist log, not becoming leader: %v\n", n.cfg.ID, err)
+		return
+	}
+	n.state = Leader
+	n.leaderID = n.cfg.ID
+	for _, peer := range n.cfg.Peers {
+		n.nextIndex[peer] = last + 1
+		n.matchIndex[peer] = 0
+	}
+	n.entries = append(n.entries, noop)
+	n.matchIndex[n.cfg.ID] = last + 1
+	n.advanceCommitIndex()
+	n.mutex.Unlock()
+
+	log.Printf("raft: %s became leader for term %d\n", n.cfg.ID, term)
+	n.notifyLeaderChange(true)
+	n.broadcast()
+}
+
+// stepDownIfStale 发现更高的任期时退回 Follower，返回是否发生了退位
+func (n *Node) stepDownIfStale(term uint64) bool {
+	n.mutex.Lock()
+	if term <= n.currentTerm {
+		n.mutex.Unlock()
+		return false
+	}
+	wasLeader := n.state == Leader
+	n.becomeFollower(term)
+	n.mutex.Unlock()
+	if wasLeader {
+		n.notifyLeaderChange(false)
+	}
+	return true
+}
+
+// becomeFollower 进入新的任期并成为 Follower，调用方需持有锁
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.currentTerm {
+		// 进入新任期才能重新投票，同一任期内只能投一次
+		n.currentTerm = term
+		n.votedFor = ""
+		if err := n.saveState(); err != nil {
+			log.Printf("raft: %s failed to persist state: %v\n", n.cfg.ID, err)
+		}
+	}
+	n.state = Follower
+	n.leaderID = ""
+}
+
+// saveState 持久化任期和投票，调用方需持有锁
+func (n *Node) saveState() error {
+	return n.cfg.Storage.SaveState(HardState{Term: n.currentTerm, VotedFor: n.votedFor})
+}
+
+func (n *Node) notifyLeaderChange(isLeader bool) {
+	if n.cfg.OnLeaderChange != nil {
+		go n.cfg.OnLeaderChange(isLeader)
+	}
+}
+
+// broadcast 向所有节点复制日志（同时作为心跳）
+func (n *Node) broadcast() {
+	n.mutex.Lock()
+	if n.state != Leader {
+		n.mutex.Unlock()
+		return
+	}
+	n.lastBroadcast = time.Now()
+	term := n.currentTerm
+	n.mutex.Unlock()
+
+	for _, peer := range n.cfg.Peers {
+		go n.replicateTo(peer, term)
+	}
+}
+
+// replicateTo 向一个节点发送 AppendEntries，并根据结果调整复制进度
+func (n *Node) replicateTo(peer string, term uint64) bool {
+	n.mutex.Lock()
+	if n.state != Leader || n.currentTerm != term {
+		n.mutex.Unlock()
+		return false
+	}
+	next := n.nextIndex[peer]
+	if next == 0 {
+		next = 1
+	}
+	prev := next - 1
+	args := AppendRequest{
+		Term:         term,
+		LeaderID:     n.cfg.ID,
+		PrevLogIndex: prev,
+		PrevLogTerm:  n.entries[prev].Term,
+		Entries:      append([]Entry(nil), n.entries[next:]...),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mutex.Unlock()
+
+	var reply AppendReply
+	if err := n.call(peer, "/raft/append", args, &reply); err != nil {
+		return false
+	}
+	if n.stepDownIfStale(reply.Term) {
+		return false
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.state != Leader || n.currentTerm != term {
+		return false
+	}
+	if reply.Success {
+		match := prev + uint64(len(args.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = match + 1
+		n.advanceCommitIndex()
+		return true
+	}
+	// 日志不一致，回退到对方的日志末尾之后重试
+	next = prev
+	if reply.LastIndex+1 < next {
+		next = reply.LastIndex + 1
+	}
+	if next < 1 {
+		next = 1
+	}
+	n.nextIndex[peer] = next
+	return true
+}
+
+// confirmLeadership 发送一轮心跳，确认多数节点仍承认本节点是 Leader
+func (n *Node) confirmLeadership(term uint64) bool {
+	acks := 1
+	if acks >= n.quorum() {
+		return true
+	}
+	var wg sync.WaitGroup
+	var ackMutex sync.Mutex
+	for _, peer := range n.cfg.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			if n.replicateTo(peer, term) {
+				ackMutex.Lock()
+				acks++
+				ackMutex.Unlock()
+			}
+		}(peer)
+	}
+	wg.Wait()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return acks >= n.quorum() && n.state == Leader && n.currentTerm == term
+}
+
+// advanceCommitIndex 提交已复制到多数节点的本任期日志，调用方需持有锁
+func (n *Node) advanceCommitIndex() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.entries[index].Term != n.currentTerm {
+			break
+		}
+		count := 0
+		if n.matchIndex[n.cfg.ID] >= index {
+			count++
+		}
+		for _, peer := range n.cfg.Peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+// applyLoop 按顺序把已提交的条目交给状态机
+func (n *Node) applyLoop() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for {
+		for !n.stopped && n.lastApplied >= n.commitIndex {
+			n.applyCond.Wait()
+		}
+		if n.stopped {
+			return
+		}
+		pending := append([]Entry(nil), n.entries[n.lastApplied+1:n.commitIndex+1]...)
+		n.mutex.Unlock()
+		for _, e := range pending {
+			if e.Data != nil && n.cfg.Apply != nil {
+				n.cfg.Apply(e.Data)
+			}
+		}
+		n.mutex.Lock()
+		n.lastApplied = pending[len(pending)-1].Index
+		close(n.appliedCh)
+		n.appliedCh = make(chan struct{})
+	}
+}
+
+// quorum 多数派数量
+func (n *Node) quorum() int {
+	return (len(n.cfg.Peers)+1)/2 + 1
+}
+
+// lastIndex 最后一条日志的索引，调用方需持有锁
+func (n *Node) lastIndex() uint64 {
+	return n.entries[len(n.entries)-1].Index
+}
+
+// resetElectionTimeout 随机化选举超时，调用方需持有锁
+func (n *Node) resetElectionTimeout() {
+	n.electionTimeout = n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+}
@@ -0,0 +1,401 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testNode 测试集群中的一个节点，可以停止并用同一个存储重新启动
+type testNode struct {
+	t       *testing.T
+	server  *httptest.Server
+	peers   []string
+	storage Storage
+
+	mutex   sync.Mutex
+	node    *Node    // 停止时为 nil，请求返回 503
+	applied []string // 本次启动以来按顺序应用的数据
+}
+
+func (tn *testNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tn.mutex.Lock()
+	node := tn.node
+	tn.mutex.Unlock()
+	if node == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	node.Handler().ServeHTTP(w, r)
+}
+
+// start 用节点的存储创建并启动一个新的 Node
+func (tn *testNode) start() {
+	tn.t.Helper()
+	tn.mutex.Lock()
+	tn.applied = nil
+	tn.mutex.Unlock()
+	node, err := NewNode(Config{
+		ID:                tn.server.URL,
+		Peers:             tn.peers,
+		ElectionTimeout:   100 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+		Storage:           tn.storage,
+		Secret:            testSecret,
+		Apply: func(data []byte) {
+			tn.mutex.Lock()
+			defer tn.mutex.Unlock()
+			tn.applied = append(tn.applied, string(data))
+		},
+	})
+	if err != nil {
+		tn.t.Fatal(err)
+	}
+	tn.mutex.Lock()
+	tn.node = node
+	tn.mutex.Unlock()
+	node.Start()
+}
+
+// stop 停止节点，之后它不再响应其他节点
+func (tn *testNode) stop() {
+	tn.mutex.Lock()
+	node := tn.node
+	tn.node = nil
+	tn.mutex.Unlock()
+	if node != nil {
+		node.Stop()
+	}
+}
+
+func (tn *testNode) current() *Node {
+	tn.mutex.Lock()
+	defer tn.mutex.Unlock()
+	return tn.node
+}
+
+func (tn *testNode) appliedData() []string {
+	tn.mutex.Lock()
+	defer tn.mutex.Unlock()
+	return append([]string(nil), tn.applied...)
+}
+
+// newTestCluster 启动 size 个节点的集群，storage 为每个节点创建存储
+func newTestCluster(t *testing.T, size int, storage func(i int) Storage) []*testNode {
+	nodes := make([]*testNode, size)
+	for i := range nodes {
+		nodes[i] = &testNode{t: t, storage: storage(i)}
+		nodes[i].server = httptest.NewServer(nodes[i])
+	}
+	for i, tn := range nodes {
+		for j, other := range nodes {
+			if i != j {
+				tn.peers = append(tn.peers, other.server.URL)
+			}
+		}
+	}
+	t.Cleanup(func() {
+		for _, tn := range nodes {
+			tn.stop()
+			tn.server.Close()
+		}
+	})
+	for _, tn := range nodes {
+		tn.start()
+	}
+	return nodes
+}
+
+// waitFor 等待 cond 成立，超时时测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitLeader 等待运行中的节点选出 Leader
+func waitLeader(t *testing.T, nodes []*testNode) *testNode {
+	t.Helper()
+	var leader *testNode
+	waitFor(t, "leader election", func() bool {
+		for _, tn := range nodes {
+			if node := tn.current(); node != nil && node.IsLeader() {
+				leader = tn
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+// propose 在 Leader 上提交数据，Leader 变化时重试
+func propose(t *testing.T, nodes []*testNode, data string) {
+	t.Helper()
+	for attempt := 0; attempt < 5; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := waitLeader(t, nodes).current().Propose(ctx, []byte(data))
+		cancel()
+		if err == nil {
+			return
+		}
+		t.Logf("propose %q: %v", data, err)
+	}
+	t.Fatalf("could not commit %q", data)
+}
+
+// waitApplied 等待运行中的每个节点都按顺序应用了 want
+func waitApplied(t *testing.T, nodes []*testNode, want []string) {
+	t.Helper()
+	for _, tn := range nodes {
+		if tn.current() == nil {
+			continue
+		}
+		waitFor(t, fmt.Sprintf("%s to apply %v", tn.server.URL, want), func() bool {
+			return slices.Equal(tn.appliedData(), want)
+		})
+	}
+}
+
+// testSecret 测试集群的共享密钥
+const testSecret = "test-secret"
+
+func memoryStorage(int) Storage {
+	return NewMemoryStorage()
+}
+
+func TestReplication(t *testing.T) {
+	nodes := newTestCluster(t, 3, memoryStorage)
+	want := []string{"a", "b", "c"}
+	for _, data := range want {
+		propose(t, nodes, data)
+	}
+	waitApplied(t, nodes, want)
+}
+
+func TestLeaderFailover(t *testing.T) {
+	nodes := newTestCluster(t, 3, memoryStorage)
+	propose(t, nodes, "a")
+
+	old := waitLeader(t, nodes)
+	term := old.current().Status().Term
+	old.stop()
+
+	leader := waitLeader(t, nodes)
+	if got := leader.current().Status().Term; got <= term {
+		t.Fatalf("new leader has term %d, want > %d", got, term)
+	}
+	propose(t, nodes, "b")
+	waitApplied(t, nodes, []string{"a", "b"})
+
+	// 旧 Leader 重启后追上集群
+	old.start()
+	waitApplied(t, nodes, []string{"a", "b"})
+}
+
+func TestVoteOncePerTerm(t *testing.T) {
+	node, err := NewNode(Config{ID: "http://a", Peers: []string{"http://b", "http://c"}, Secret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply := node.handleVote(VoteRequest{Term: 5, CandidateID: "http://b"}); !reply.Granted {
+		t.Fatal("first vote in term 5 was not granted")
+	}
+	if reply := node.handleVote(VoteRequest{Term: 5, CandidateID: "http://c"}); reply.Granted {
+		t.Fatal("node voted twice in term 5")
+	}
+	if reply := node.handleVote(VoteRequest{Term: 5, CandidateID: "http://b"}); !reply.Granted {
+		t.Fatal("node refused to repeat its vote")
+	}
+	if reply := node.handleVote(VoteRequest{Term: 4, CandidateID: "http://c"}); reply.Granted || reply.Term != 5 {
+		t.Fatalf("vote for a stale term returned %+v", reply)
+	}
+	if reply := node.handleVote(VoteRequest{Term: 6, CandidateID: "http://c"}); !reply.Granted {
+		t.Fatal("vote in a new term was not granted")
+	}
+}
+
+func TestVoteRequiresUpToDateLog(t *testing.T) {
+	node, err := NewNode(Config{ID: "http://a", Peers: []string{"http://b", "http://c"}, Secret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := node.handleAppend(AppendRequest{
+		Term:     2,
+		LeaderID: "http://b",
+		Entries:  []Entry{{Term: 2, Index: 1, Data: []byte("a")}, {Term: 2, Index: 2, Data: []byte("b")}},
+	})
+	if !reply.Success {
+		t.Fatal("append was rejected")
+	}
+	if reply := node.handleVote(VoteRequest{Term: 3, CandidateID: "http://c", LastLogIndex: 1, LastLogTerm: 2}); reply.Granted {
+		t.Fatal("node voted for a candidate whose log is behind")
+	}
+	if reply := node.handleVote(VoteRequest{Term: 3, CandidateID: "http://b", LastLogIndex: 2, LastLogTerm: 2}); !reply.Granted {
+		t.Fatal("node refused an up-to-date candidate")
+	}
+}
+
+func TestRestartRecoversLog(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	open := func(i int) Storage {
+		s, err := NewFileStorage(dirs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	nodes := newTestCluster(t, 3, open)
+	want := []string{"a", "b", "c"}
+	for _, data := range want {
+		propose(t, nodes, data)
+	}
+	waitApplied(t, nodes, want)
+	var terms []uint64
+	for _, tn := range nodes {
+		terms = append(terms, tn.current().Status().Term)
+		tn.stop()
+	}
+
+	// 整个集群重启，每个节点从自己的目录恢复
+	for i, tn := range nodes {
+		tn.storage.Close()
+		tn.storage = open(i)
+		tn.start()
+		if got := tn.current().Status().Term; got < terms[i] {
+			t.Fatalf("node %d restarted with term %d, want >= %d", i, got, terms[i])
+		}
+	}
+	waitLeader(t, nodes)
+	waitApplied(t, nodes, want)
+	propose(t, nodes, "d")
+	waitApplied(t, nodes, append(want, "d"))
+}
+
+func TestNoDoubleVoteAfterRestart(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	cfg := Config{ID: "http://a", Peers: []string{"http://b", "http://c"}, Storage: storage, Secret: testSecret}
+	node, err := NewNode(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply := node.handleVote(VoteRequest{Term: 5, CandidateID: "http://b"}); !reply.Granted {
+		t.Fatal("first vote in term 5 was not granted")
+	}
+
+	// 重启后同一任期只能再投给同一个候选人
+	node, err = NewNode(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply := node.handleVote(VoteRequest{Term: 5, CandidateID: "http://c"}); reply.Granted {
+		t.Fatal("restarted node voted twice in term 5")
+	}
+	if reply := node.handleVote(VoteRequest{Term: 5, CandidateID: "http://b"}); !reply.Granted {
+		t.Fatal("restarted node refused to repeat its vote")
+	}
+	if reply := node.handleVote(VoteRequest{Term: 6, CandidateID: "http://c"}); !reply.Granted {
+		t.Fatal("vote in a new term was not granted")
+	}
+}
+
+func TestStaleCandidateRejectedAfterRestart(t *testing.T) {
+	storage := NewMemoryStorage()
+	cfg := Config{ID: "http://a", Peers: []string{"http://b", "http://c"}, Storage: storage, Secret: testSecret}
+	node, err := NewNode(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := node.handleAppend(AppendRequest{
+		Term:     2,
+		LeaderID: "http://b",
+		Entries:  []Entry{{Term: 2, Index: 1, Data: []byte("a")}, {Term: 2, Index: 2, Data: []byte("b")}},
+	})
+	if !reply.Success {
+		t.Fatal("append was rejected")
+	}
+
+	// 重启的节点保留了日志，不会投给日志落后的候选人
+	node, err = NewNode(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := node.Status().LastIndex; got != 2 {
+		t.Fatalf("restarted node has last index %d, want 2", got)
+	}
+	if reply := node.handleVote(VoteRequest{Term: 3, CandidateID: "http://c"}); reply.Granted {
+		t.Fatal("restarted node voted for a candidate with an empty log")
+	}
+	if reply := node.handleVote(VoteRequest{Term: 3, CandidateID: "http://b", LastLogIndex: 2, LastLogTerm: 2}); !reply.Granted {
+		t.Fatal("restarted node refused an up-to-date candidate")
+	}
+}
+
+func TestNewNodeRequiresAuth(t *testing.T) {
+	if _, err := NewNode(Config{ID: "http://a"}); err != ErrNoAuth {
+		t.Fatalf("NewNode without authentication returned %v, want ErrNoAuth", err)
+	}
+}
+
+func TestHandlerRejectsUnauthenticatedPeers(t *testing.T) {
+	node, err := NewNode(Config{ID: "http://a", Peers: []string{"http://b"}, Secret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(node.Handler())
+	defer server.Close()
+
+	forged, _ := json.Marshal(AppendRequest{
+		Term:     100,
+		LeaderID: "http://attacker",
+		Entries:  []Entry{{Term: 100, Index: 1, Data: []byte("forged")}},
+	})
+	for _, secret := range []string{"", "wrong-secret"} {
+		for _, path := range []string{"/raft/append", "/raft/vote"} {
+			req, _ := http.NewRequest(http.MethodPost, server.URL+path, bytes.NewReader(forged))
+			if secret != "" {
+				req.Header.Set(SecretHeader, secret)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusForbidden {
+				t.Fatalf("%s with secret %q returned %d, want 403", path, secret, res.StatusCode)
+			}
+		}
+	}
+	if st := node.Status(); st.Term != 0 || st.LastIndex != 0 {
+		t.Fatalf("forged requests changed the node: %+v", st)
+	}
+
+	// 携带正确密钥的请求正常处理
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/raft/append", bytes.NewReader(forged))
+	req.Header.Set(SecretHeader, testSecret)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || node.Status().LastIndex != 1 {
+		t.Fatalf("authenticated append returned %d, last index %d", res.StatusCode, node.Status().LastIndex)
+	}
+}
@@ -0,0 +1,219 @@
+package raft
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// SecretHeader 节点之间携带共享密钥的请求头
+const SecretHeader = "X-Raft-Secret"
+
+// VoteRequest RequestVote 请求
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidateId"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+// VoteReply RequestVote 响应
+type VoteReply struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest AppendEntries 请求
+type AppendRequest struct {
+	Term         uint64  `json:"term"`
+	LeaderID     string  `json:"leaderId"`
+	PrevLogIndex uint64  `json:"prevLogIndex"`
+	PrevLogTerm  uint64  `json:"prevLogTerm"`
+	Entries      []Entry `json:"entries"`
+	LeaderCommit uint64  `json:"leaderCommit"`
+}
+
+// AppendReply AppendEntries 响应
+type AppendReply struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex uint64 `json:"lastIndex"` // 跟随者的最后日志索引，用于快速回退
+}
+
+// Handler 返回节点间通信的HTTP处理器，需要挂载在 /raft/ 路径下
+// 投票和日志复制请求没有通过认证时返回 403，/raft/status 只用于展示，不需要认证
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/raft/vote", func(w http.ResponseWriter, r *http.Request) {
+		if !n.authenticate(w, r) {
+			return
+		}
+		var args VoteRequest
+		if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(n.handleVote(args))
+	})
+	mux.HandleFunc("/raft/append", func(w http.ResponseWriter, r *http.Request) {
+		if !n.authenticate(w, r) {
+			return
+		}
+		var args AppendRequest
+		if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(n.handleAppend(args))
+	})
+	mux.HandleFunc("/raft/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(n.Status())
+	})
+	return mux
+}
+
+// authenticate 校验请求来自集群中的节点，不是时写出 403 并返回 false
+// 配置了 Secret 时请求必须携带相同的密钥；配置了 PeerIdentities 时请求方必须出示经过验证、
+// 名称在列表中的客户端证书
+func (n *Node) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	ok := n.cfg.Secret != "" || len(n.cfg.PeerIdentities) > 0
+	if n.cfg.Secret != "" {
+		ok = ok && subtle.ConstantTimeCompare([]byte(r.Header.Get(SecretHeader)), []byte(n.cfg.Secret)) == 1
+	}
+	if len(n.cfg.PeerIdentities) > 0 {
+		ok = ok && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 &&
+			slices.Contains(n.cfg.PeerIdentities, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+	if !ok {
+		log.Printf("raft: %s rejected unauthenticated %s from %s\n", n.cfg.ID, r.URL.Path, r.RemoteAddr)
+		http.Error(w, "raft: peer authentication failed", http.StatusForbidden)
+	}
+	return ok
+}
+
+// handleVote 处理投票请求
+func (n *Node) handleVote(args VoteRequest) VoteReply {
+	n.mutex.Lock()
+	wasLeader := false
+	if args.Term > n.currentTerm {
+		wasLeader = n.state == Leader
+		n.becomeFollower(args.Term)
+	}
+	reply := VoteReply{Term: n.currentTerm}
+	if args.Term == n.currentTerm && (n.votedFor == "" || n.votedFor == args.CandidateID) {
+		// 只投给日志至少和自己一样新的候选人
+		lastTerm := n.entries[n.lastIndex()].Term
+		upToDate := args.LastLogTerm > lastTerm ||
+			(args.LastLogTerm == lastTerm && args.LastLogIndex >= n.lastIndex())
+		if upToDate {
+			// 先记下这一票再回复，重启后同一任期不会再投给别人
+			n.votedFor = args.CandidateID
+			if err := n.saveState(); err != nil {
+				log.Printf("raft: %s failed to persist vote: %v\n", n.cfg.ID, err)
+				n.votedFor = ""
+			} else {
+				n.lastContact = time.Now()
+				reply.Granted = true
+			}
+		}
+	}
+	n.mutex.Unlock()
+	if wasLeader {
+		n.notifyLeaderChange(false)
+	}
+	return reply
+}
+
+// handleAppend 处理日志复制请求
+func (n *Node) handleAppend(args AppendRequest) AppendReply {
+	n.mutex.Lock()
+	wasLeader := false
+	defer func() {
+		if wasLeader {
+			n.notifyLeaderChange(false)
+		}
+	}()
+	defer n.mutex.Unlock()
+
+	if args.Term < n.currentTerm {
+		return AppendReply{Term: n.currentTerm, LastIndex: n.lastIndex()}
+	}
+	if args.Term > n.currentTerm || n.state != Follower {
+		wasLeader = n.state == Leader
+		n.becomeFollower(args.Term)
+	}
+	n.leaderID = args.LeaderID
+	n.lastContact = time.Now()
+
+	reply := AppendReply{Term: n.currentTerm}
+	if args.PrevLogIndex > n.lastIndex() || n.entries[args.PrevLogIndex].Term != args.PrevLogTerm {
+		reply.LastIndex = n.lastIndex()
+		if args.PrevLogIndex <= n.lastIndex() {
+			// 前一条日志任期不一致，整段都需要重新复制
+			reply.LastIndex = args.PrevLogIndex - 1
+		}
+		return reply
+	}
+
+	for i, e := range args.Entries {
+		if e.Index <= n.lastIndex() && n.entries[e.Index].Term == e.Term {
+			continue
+		}
+		// 冲突的条目及其之后的全部删除，新条目写入存储之后才向 Leader 确认
+		if err := n.cfg.Storage.Append(args.Entries[i:]); err != nil {
+			log.Printf("raft: %s failed to persist log: %v\n", n.cfg.ID, err)
+			// 存储中冲突之后的条目可能已经删除，内存中也丢弃它们（它们还没有提交）
+			if e.Index <= n.lastIndex() {
+				n.entries = n.entries[:e.Index]
+			}
+			reply.LastIndex = n.lastIndex()
+			return reply
+		}
+		n.entries = append(n.entries[:e.Index], args.Entries[i:]...)
+		break
+	}
+
+	if args.LeaderCommit > n.commitIndex {
+		last := args.PrevLogIndex + uint64(len(args.Entries))
+		if commit := min(args.LeaderCommit, last); commit > n.commitIndex {
+			n.commitIndex = commit
+			n.applyCond.Broadcast()
+		}
+	}
+	reply.Success = true
+	reply.LastIndex = n.lastIndex()
+	return reply
+}
+
+// call 向另一个节点发送请求
+func (n *Node) call(peer, path string, args, reply interface{}) error {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, peer+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.cfg.Secret != "" {
+		req.Header.Set(SecretHeader, n.cfg.Secret)
+	}
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft: %s%s returned %v", peer, path, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(reply)
+}
@@ -0,0 +1,80 @@
+package raft
+
+import (
+	"fmt"
+	"sync"
+)
+
+// HardState 必须在回复其他节点之前持久化的状态
+type HardState struct {
+	Term     uint64 `json:"term"`     // 当前任期
+	VotedFor string `json:"votedFor"` // 当前任期投票给的节点，没有投票时为空
+}
+
+// Storage 持久化节点的任期、投票和日志
+//
+// 节点在投票、确认日志复制和提案之前写入存储，重启后从存储恢复，
+// 因此同一任期内不会投出两票，也不会丢失已经向 Leader 确认过的日志。
+type Storage interface {
+	// Load 返回保存的状态和全部日志，日志的索引从 1 开始连续
+	Load() (HardState, []Entry, error)
+	// SaveState 保存任期和投票，返回前必须已经持久化
+	SaveState(st HardState) error
+	// Append 追加日志，索引不小于 entries[0].Index 的旧条目先被删除，返回前必须已经持久化
+	Append(entries []Entry) error
+	// Close 关闭存储
+	Close() error
+}
+
+// MemoryStorage 保存在内存中的存储
+// 进程退出后状态丢失，同一个 MemoryStorage 可以交给重新创建的节点，用于测试重启
+type MemoryStorage struct {
+	mutex   sync.Mutex
+	state   HardState
+	entries []Entry
+}
+
+// NewMemoryStorage 创建内存存储（默认存储）
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+// Load 返回保存的状态和日志
+func (s *MemoryStorage) Load() (HardState, []Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state, append([]Entry(nil), s.entries...), nil
+}
+
+// SaveState 保存任期和投票
+func (s *MemoryStorage) SaveState(st HardState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state = st
+	return nil
+}
+
+// Append 追加日志，覆盖索引冲突的旧条目
+func (s *MemoryStorage) Append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	first := entries[0].Index
+	if first > uint64(len(s.entries))+1 {
+		return errGap(first, uint64(len(s.entries)))
+	}
+	s.entries = append(s.entries[:first-1], entries...)
+	return nil
+}
+
+// Close 内存存储不需要关闭
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+// errGap 追加的日志与已有日志之间有空缺
+func errGap(first, last uint64) error {
+	return fmt.Errorf("raft: appending entry %d after last entry %d", first, last)
+}
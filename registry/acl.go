@@ -0,0 +1,352 @@
+package registry
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// TokenHeader 携带ACL令牌的请求头，也可以使用 "Authorization: Bearer <token>"
+	TokenHeader = "X-Registry-Token"
+	// TokenEnv 客户端读取ACL令牌的环境变量
+	TokenEnv = "REGISTRY_TOKEN"
+)
+
+// ACLPolicy 令牌可以访问的服务
+//
+// 服务名称可以写完整名称，可以用 "*" 表示所有服务，也可以用 "Log*" 这样的前缀匹配。
+// Namespaces 为空时对所有命名空间生效。
+type ACLPolicy struct {
+	Namespaces []string `json:"namespaces,omitempty"` // 生效的命名空间
+	Register   []string `json:"register,omitempty"`   // 可以注册、续约和上报检查的服务
+	Deregister []string `json:"deregister,omitempty"` // 可以注销的服务
+	Read       []string `json:"read,omitempty"`       // 可以查询的服务
+}
+
+// ACLToken ACL令牌
+// AccessorID 用于管理令牌，可以公开；SecretID 是请求时携带的凭证，只在创建时返回
+type ACLToken struct {
+	AccessorID  string    `json:"accessorId"`
+	SecretID    string    `json:"secretId,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Management  bool      `json:"management,omitempty"` // 管理令牌拥有所有权限，并且可以管理令牌
+	Policy      ACLPolicy `json:"policy"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// aclAction 需要授权的操作
+type aclAction int
+
+const (
+	aclRead aclAction = iota
+	aclRegister
+	aclDeregister
+)
+
+var (
+	errPermissionDenied = errors.New("permission denied")
+	errTokenNotFound    = errors.New("ACL token not found")
+)
+
+// EnableACL 启用ACL，需要在注册中心开始处理请求之前调用
+//
+// bootstrapToken 是初始的管理令牌，只保存在内存中，集群的每个节点都需要配置相同的值。
+// 启用之后，没有令牌的请求只能在 anonymousRead 为 true 时查询服务，其他操作都需要令牌。
+func (s *Server) EnableACL(bootstrapToken string, anonymousRead bool) error {
+	if bootstrapToken == "" {
+		return errors.New("ACL bootstrap token must not be empty")
+	}
+	s.reg.mutex.Lock()
+	defer s.reg.mutex.Unlock()
+	s.reg.aclEnabled = true
+	s.reg.bootstrapToken = bootstrapToken
+	if anonymousRead {
+		s.reg.anonymous = ACLPolicy{Read: []string{"*"}}
+	}
+	return nil
+}
+
+// EnableACL 为默认的注册中心实例启用ACL
+func EnableACL(bootstrapToken string, anonymousRead bool) error {
+	return defaultServer.EnableACL(bootstrapToken, anonymousRead)
+}
+
+// resolveToken 根据请求携带的 secret 找到令牌，ACL 未启用时返回 nil 表示允许一切
+func (r *registry) resolveToken(secret string) (*ACLToken, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.aclEnabled {
+		return nil, nil
+	}
+	if secret == "" {
+		return &ACLToken{AccessorID: "anonymous", Policy: r.anonymous}, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(r.bootstrapToken)) == 1 {
+		return &ACLToken{AccessorID: "bootstrap", Management: true}, nil
+	}
+	for _, t := range r.tokens {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(t.SecretID)) == 1 {
+			return &t, nil
+		}
+	}
+	return nil, errTokenNotFound
+}
+
+// allows 令牌是否可以对命名空间 ns 中的服务 name 执行 action
+func (t *ACLToken) allows(action aclAction, ns string, name ServiceName) bool {
+	if t == nil || t.Management {
+		return true
+	}
+	p := t.Policy
+	if len(p.Namespaces) > 0 && !matchAny(p.Namespaces, ns) {
+		return false
+	}
+	switch action {
+	case aclRead:
+		return matchAny(p.Read, string(name))
+	case aclRegister:
+		return matchAny(p.Register, string(name))
+	case aclDeregister:
+		return matchAny(p.Deregister, string(name))
+	}
+	return false
+}
+
+// matchAny 名称是否匹配任意一个模式，模式以 "*" 结尾时按前缀匹配
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if p == name || strings.HasSuffix(p, "*") && strings.HasPrefix(name, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestToken 取出请求携带的令牌
+func requestToken(r *http.Request) string {
+	if t := r.Header.Get(TokenHeader); t != "" {
+		return t
+	}
+	if t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(t)
+	}
+	return ""
+}
+
+// newTokenID 生成随机的令牌ID
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s-%s-%s-%s", hex.EncodeToString(b[0:4]), hex.EncodeToString(b[4:6]),
+		hex.EncodeToString(b[6:8]), hex.EncodeToString(b[8:10]), hex.EncodeToString(b[10:16])), nil
+}
+
+// getTokens 返回所有令牌，不包含 SecretID
+func (r *registry) getTokens() []ACLToken {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	result := make([]ACLToken, 0, len(r.tokens))
+	for _, t := range r.tokens {
+		t.SecretID = ""
+		result = append(result, t)
+	}
+	return result
+}
+
+// getToken 按 AccessorID 查找令牌，不包含 SecretID
+func (r *registry) getToken(accessorID string) (ACLToken, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	t, ok := r.tokens[accessorID]
+	t.SecretID = ""
+	return t, ok
+}
+
+// snapshotTokens 返回所有令牌用于快照，调用方需持有锁
+func (r *registry) snapshotTokens() []ACLToken {
+	tokens := make([]ACLToken, 0, len(r.tokens))
+	for _, t := range r.tokens {
+		tokens = append(tokens, t)
+	}
+	return tokens
+}
+
+// requestACL 解析请求携带的令牌，令牌无效时写出 403 并返回 false
+func (s *Server) requestACL(w http.ResponseWriter, r *http.Request) (*ACLToken, bool) {
+	token, err := s.reg.resolveToken(requestToken(r))
+	if err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return nil, false
+	}
+	return token, true
+}
+
+// authorize 检查请求方能否对命名空间 ns 中的服务 name 执行 action，不能时写出 403 并返回 false
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, action aclAction, ns string, name ServiceName) bool {
+	token, ok := s.requestACL(w, r)
+	if !ok {
+		return false
+	}
+	if !token.allows(action, ns, name) {
+		writeError(w, http.StatusForbidden, errPermissionDenied.Error())
+		return false
+	}
+	return true
+}
+
+// authorizeManagement 只允许管理令牌，ACL 未启用时总是允许
+func (s *Server) authorizeManagement(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := s.requestACL(w, r)
+	if !ok {
+		return false
+	}
+	if token != nil && !token.Management {
+		writeError(w, http.StatusForbidden, errPermissionDenied.Error())
+		return false
+	}
+	return true
+}
+
+// readable 去掉令牌无权查询的实例
+func (t *ACLToken) readable(regs []Registration) []Registration {
+	if t == nil || t.Management {
+		return regs
+	}
+	result := make([]Registration, 0, len(regs))
+	for _, reg := range regs {
+		if t.allows(aclRead, registrationNamespace(reg), reg.ServiceName) {
+			result = append(result, reg)
+		}
+	}
+	return result
+}
+
+// registrationNamespace 返回实例所在的命名空间
+func registrationNamespace(reg Registration) string {
+	if reg.Namespace == "" {
+		return DefaultNamespace
+	}
+	return reg.Namespace
+}
+
+// handleCreateToken 创建令牌，响应中包含 SecretID，之后不会再返回
+func (s *Server) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeManagement(w, r) {
+		return
+	}
+	var token ACLToken
+	if err := json.NewDecoder(r.Body).Decode(&token); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid token: "+err.Error())
+		return
+	}
+	var err error
+	if token.AccessorID, err = newTokenID(); err == nil {
+		token.SecretID, err = newTokenID()
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	token.CreatedAt = time.Now()
+	if err := s.reg.submit(Operation{Type: OpTokenSet, Token: &token}); err != nil {
+		log.Println(err)
+		writeError(w, clusterError(err), err.Error())
+		return
+	}
+	log.Printf("Created ACL token %s (%s)\n", token.AccessorID, token.Description)
+	writeJSON(w, http.StatusOK, token)
+}
+
+// handleListTokens 列出所有令牌
+func (s *Server) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeManagement(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.reg.getTokens())
+}
+
+// handleGetToken 查看一个令牌
+func (s *Server) handleGetToken(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeManagement(w, r) {
+		return
+	}
+	token, ok := s.reg.getToken(r.PathValue("accessor"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errTokenNotFound.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, token)
+}
+
+// handleUpdateToken 修改令牌的描述和权限，SecretID 保持不变
+func (s *Server) handleUpdateToken(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeManagement(w, r) {
+		return
+	}
+	var update ACLToken
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid token: "+err.Error())
+		return
+	}
+	s.reg.mutex.Lock()
+	token, ok := s.reg.tokens[r.PathValue("accessor")]
+	s.reg.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, errTokenNotFound.Error())
+		return
+	}
+	token.Description = update.Description
+	token.Management = update.Management
+	token.Policy = update.Policy
+	if err := s.reg.submit(Operation{Type: OpTokenSet, Token: &token}); err != nil {
+		log.Println(err)
+		writeError(w, clusterError(err), err.Error())
+		return
+	}
+	token.SecretID = ""
+	writeJSON(w, http.StatusOK, token)
+}
+
+// handleDeleteToken 删除令牌
+func (s *Server) handleDeleteToken(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeManagement(w, r) {
+		return
+	}
+	accessorID := r.PathValue("accessor")
+	if _, ok := s.reg.getToken(accessorID); !ok {
+		writeError(w, http.StatusNotFound, errTokenNotFound.Error())
+		return
+	}
+	if err := s.reg.submit(Operation{Type: OpTokenDelete, Token: &ACLToken{AccessorID: accessorID}}); err != nil {
+		log.Println(err)
+		writeError(w, clusterError(err), err.Error())
+		return
+	}
+	log.Printf("Deleted ACL token %s\n", accessorID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleTokenSelf 查看请求所用令牌的权限
+func (s *Server) handleTokenSelf(w http.ResponseWriter, r *http.Request) {
+	token, ok := s.requestACL(w, r)
+	if !ok {
+		return
+	}
+	if token == nil {
+		writeError(w, http.StatusNotFound, "ACL is not enabled")
+		return
+	}
+	self := *token
+	self.SecretID = ""
+	writeJSON(w, http.StatusOK, self)
+}
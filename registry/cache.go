@@ -0,0 +1,151 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CacheMetrics 客户端缓存的统计信息
+type CacheMetrics struct {
+	Hits       uint64        `json:"hits"`       // 缓存有效时直接返回的次数
+	Misses     uint64        `json:"misses"`     // 需要向注册中心查询的次数
+	StaleHits  uint64        `json:"staleHits"`  // 缓存过期后仍然返回旧数据的次数
+	Stale      bool          `json:"stale"`      // 当前缓存是否已经过期
+	Age        time.Duration `json:"age"`        // 距离上次从注册中心更新缓存的时间
+	LastUpdate time.Time     `json:"lastUpdate"` // 上次更新缓存的时间
+	Index      uint64        `json:"index"`      // 缓存对应的目录修改序号
+	Watching   bool          `json:"watching"`   // 阻塞查询是否正常工作
+	Size       int           `json:"size"`       // 缓存中的实例数
+}
+
+// cacheFile 缓存文件的内容
+type cacheFile struct {
+	Index      uint64         `json:"index"`
+	LastUpdate time.Time      `json:"lastUpdate"`
+	Services   []Registration `json:"services"`
+}
+
+// CacheStats 返回全局客户端的缓存统计
+func CacheStats() CacheMetrics {
+	return defaultClient.CacheStats()
+}
+
+// CacheStats 返回缓存统计
+func (c *Client) CacheStats() CacheMetrics {
+	c.cacheMutex.RLock()
+	defer c.cacheMutex.RUnlock()
+	m := CacheMetrics{
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		StaleHits:  c.staleHits.Load(),
+		Stale:      len(c.cache) > 0 && !c.cacheValid(),
+		LastUpdate: c.lastUpdate,
+		Index:      c.index,
+		Watching:   c.watching,
+		Size:       len(c.cache),
+	}
+	if !c.lastUpdate.IsZero() {
+		m.Age = time.Since(c.lastUpdate)
+	}
+	return m
+}
+
+// staleUsable 缓存过期后能否继续使用，调用方需持有读锁
+// 只有启用了 StaleWhileRevalidate 才会使用过期缓存，MaxStale 为 0 时不限制缓存的年龄
+func (c *Client) staleUsable() bool {
+	if !c.config.StaleWhileRevalidate || len(c.cache) == 0 {
+		return false
+	}
+	return c.config.MaxStale <= 0 || time.Since(c.lastUpdate) < c.config.MaxStale
+}
+
+// revalidate 在后台刷新过期的缓存，同一时间只有一个刷新在进行
+// 刷新由查询触发，Close 之后缓存按过期时间刷新，同样需要它
+func (c *Client) revalidate() {
+	if !c.revalidating.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer c.revalidating.Store(false)
+		if _, err := c.GetServicesFresh(context.Background()); err != nil {
+			log.Printf("Failed to revalidate registry cache: %v\n", err)
+		}
+	}()
+}
+
+// fallback 配置了缓存文件时，注册中心不可用（err 包装了 ErrUnavailable）的查询返回过期的缓存，
+// 缓存的年龄不超过 MaxStale；没有启用 StaleWhileRevalidate 时，只有这种情况才会返回过期数据
+func (c *Client) fallback(err error) ([]Registration, bool) {
+	if c.config.CacheFile == "" || !errors.Is(err, ErrUnavailable) {
+		return nil, false
+	}
+	c.cacheMutex.RLock()
+	defer c.cacheMutex.RUnlock()
+	if len(c.cache) == 0 || c.config.MaxStale > 0 && time.Since(c.lastUpdate) >= c.config.MaxStale {
+		return nil, false
+	}
+	log.Printf("Registry unavailable, using cached registrations from %v ago: %v\n", time.Since(c.lastUpdate).Round(time.Second), err)
+	return c.cache, true
+}
+
+// storeCache 用注册中心返回的全量数据更新缓存，配置了缓存文件时同时写入文件
+func (c *Client) storeCache(regs []Registration, index uint64, watching bool) {
+	now := time.Now()
+	c.cacheMutex.Lock()
+	c.cache = regs
+	c.lastUpdate = now
+	c.index = index
+	c.watching = watching
+	c.cacheMutex.Unlock()
+
+	if c.config.CacheFile != "" {
+		if err := c.saveCacheFile(cacheFile{Index: index, LastUpdate: now, Services: regs}); err != nil {
+			log.Printf("Failed to write registry cache file: %v\n", err)
+		}
+	}
+}
+
+// saveCacheFile 先写临时文件再重命名，避免进程中途退出留下不完整的文件
+func (c *Client) saveCacheFile(f cacheFile) error {
+	c.fileMutex.Lock()
+	defer c.fileMutex.Unlock()
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	tmp := c.config.CacheFile + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(tmp), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.config.CacheFile)
+}
+
+// loadCacheFile 从缓存文件恢复上次的服务列表，缓存的年龄按文件中记录的更新时间计算
+func (c *Client) loadCacheFile() error {
+	data, err := os.ReadFile(c.config.CacheFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var f cacheFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	c.cacheMutex.Lock()
+	c.cache = f.Services
+	c.lastUpdate = f.LastUpdate
+	c.index = f.Index
+	c.cacheMutex.Unlock()
+	log.Printf("Loaded %d cached registrations from %s (age %v)\n", len(f.Services), c.config.CacheFile, time.Since(f.LastUpdate).Round(time.Second))
+	return nil
+}
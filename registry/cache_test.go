@@ -0,0 +1,147 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFlakyRegistry 启动一个注册中心，down 为 true 时所有请求返回 503
+func newFlakyRegistry(t *testing.T) (string, *atomic.Bool) {
+	t.Helper()
+	server := NewServer()
+	var down atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		server.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		ts.CloseClientConnections()
+		ts.Close()
+		server.Stop()
+	})
+	return ts.URL, &down
+}
+
+// newCachingClient 创建一个不在后台跟踪注册中心的客户端，缓存只按过期时间刷新
+func newCachingClient(addr string, cfg ClientConfig) *Client {
+	cfg.Addresses = []string{addr}
+	cfg.MaxRetries = -1
+	cfg.CacheExpiry = 50 * time.Millisecond
+	client := NewClient(cfg)
+	client.Close()
+	return client
+}
+
+func serviceNames(regs []Registration) map[ServiceName]bool {
+	names := make(map[ServiceName]bool)
+	for _, reg := range regs {
+		names[reg.ServiceName] = true
+	}
+	return names
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	addr, down := newFlakyRegistry(t)
+	ctx := context.Background()
+	client := newCachingClient(addr, ClientConfig{StaleWhileRevalidate: true})
+	if err := client.RegistrationService(ctx, Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetServices(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 缓存过期后注册中心不可用，仍然返回过期的数据
+	time.Sleep(60 * time.Millisecond)
+	down.Store(true)
+	regs, err := client.GetServices(ctx)
+	if err != nil || !serviceNames(regs)["Orders"] {
+		t.Fatalf("stale query returned %v, %v", instanceIDs(regs), err)
+	}
+	if _, err := client.FindService(ctx, "Orders"); err != nil {
+		t.Fatalf("stale FindService: %v", err)
+	}
+	if stats := client.CacheStats(); stats.StaleHits != 2 || !stats.Stale {
+		t.Fatalf("cache stats %+v", stats)
+	}
+
+	// 注册中心恢复后，返回过期数据的同时在后台刷新
+	waitFor(t, "failed revalidation to finish", func() bool { return !client.revalidating.Load() })
+	down.Store(false)
+	if err := client.RegistrationService(ctx, Registration{ServiceName: "Payments", ServiceUrl: "http://localhost:9200"}); err != nil {
+		t.Fatal(err)
+	}
+	regs, err = client.GetServices(ctx)
+	if err != nil || serviceNames(regs)["Payments"] {
+		t.Fatalf("stale query returned %v, %v", instanceIDs(regs), err)
+	}
+	waitFor(t, "background revalidation", func() bool {
+		return client.CacheStats().Size == 2
+	})
+	if stats := client.CacheStats(); stats.Stale {
+		t.Fatalf("cache is still stale after revalidation: %+v", stats)
+	}
+}
+
+func TestExpiredCacheWithoutStaleWhileRevalidate(t *testing.T) {
+	addr, down := newFlakyRegistry(t)
+	ctx := context.Background()
+	client := newCachingClient(addr, ClientConfig{})
+	if err := client.RegistrationService(ctx, Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetServices(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	down.Store(true)
+	if _, err := client.GetServices(ctx); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expired cache without a cache file returned %v", err)
+	}
+}
+
+func TestCacheFileWithoutStaleWhileRevalidate(t *testing.T) {
+	addr, down := newFlakyRegistry(t)
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "registry-cache.json")
+	writer := newCachingClient(addr, ClientConfig{CacheFile: file})
+	if err := writer.RegistrationService(ctx, Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.GetServices(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后注册中心还不可用，没有启用 StaleWhileRevalidate 也使用文件中已经过期的数据
+	time.Sleep(60 * time.Millisecond)
+	down.Store(true)
+	client := newCachingClient(addr, ClientConfig{CacheFile: file})
+	regs, err := client.GetServices(ctx)
+	if err != nil || !serviceNames(regs)["Orders"] {
+		t.Fatalf("query with a cache file returned %v, %v", instanceIDs(regs), err)
+	}
+	if reg, err := client.FindService(ctx, "Orders"); err != nil || reg.ServiceName != "Orders" {
+		t.Fatalf("FindService with a cache file returned %+v, %v", reg, err)
+	}
+	if _, err := client.FindService(ctx, "Payments"); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("service missing from the cache file returned %v", err)
+	}
+	if stats := client.CacheStats(); stats.StaleHits != 2 {
+		t.Fatalf("cache stats %+v", stats)
+	}
+
+	// 超过 MaxStale 的文件不再使用
+	old := newCachingClient(addr, ClientConfig{CacheFile: file, MaxStale: time.Nanosecond})
+	if _, err := old.GetServices(ctx); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("cache older than MaxStale returned %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package registry
+
+import (
+	"fmt"
+	"time"
+)
+
+// CheckType 健康检查类型
+type CheckType string
+
+const (
+	CheckHTTP CheckType = "http" // 注册中心定期请求一个HTTP地址
+	CheckTCP  CheckType = "tcp"  // 注册中心定期建立TCP连接
+	CheckTTL  CheckType = "ttl"  // 服务自己定期上报状态，超过TTL没有上报视为失败
+)
+
+// HealthStatus 健康状态
+type HealthStatus string
+
+const (
+	HealthPassing  HealthStatus = "passing"
+	HealthWarning  HealthStatus = "warning"
+	HealthCritical HealthStatus = "critical"
+)
+
+// CheckDefinition 健康检查定义，时间字段使用 "10s"、"1m" 这样的格式
+type CheckDefinition struct {
+	ID                      string    `json:"id"`                                // 检查ID，同一实例内唯一
+	Name                    string    `json:"name,omitempty"`                    // 检查名称
+	Type                    CheckType `json:"type"`                              // 检查类型
+	HTTP                    string    `json:"http,omitempty"`                    // HTTP检查的地址
+	Method                  string    `json:"method,omitempty"`                  // HTTP方法，默认 GET
+	ExpectedStatus          int       `json:"expectedStatus,omitempty"`          // 期望的状态码，默认任意2xx
+	ExpectedBody            string    `json:"expectedBody,omitempty"`            // 响应体中必须包含的内容
+	TCP                     string    `json:"tcp,omitempty"`                     // TCP检查的地址，host:port
+	Interval                string    `json:"interval,omitempty"`                // 检查间隔，默认10s
+	Timeout                 string    `json:"timeout,omitempty"`                 // 单次检查超时，默认5s
+	TTL                     string    `json:"ttl,omitempty"`                     // TTL检查的上报期限
+	DeregisterCriticalAfter string    `json:"deregisterCriticalAfter,omitempty"` // 持续失败超过该时长后注销实例
+}
+
+// CheckStatus 一个检查的最新结果
+type CheckStatus struct {
+	CheckID       string       `json:"checkId"`
+	Name          string       `json:"name,omitempty"`
+	Status        HealthStatus `json:"status"`
+	Output        string       `json:"output"`
+	LastChecked   time.Time    `json:"lastChecked"`
+	CriticalSince time.Time    `json:"criticalSince,omitempty"` // 进入 critical 的时间
+}
+
+const (
+	defaultCheckInterval = 10 * time.Second
+	defaultCheckTimeout  = 5 * time.Second
+	// minCheckInterval 检查间隔和TTL的下限，过短的间隔会让注册中心忙于检查
+	minCheckInterval = time.Second
+)
+
+// Validate 检查定义是否合法
+func (c CheckDefinition) Validate() error {
+	if c.ID == "" {
+		return fmt.Errorf("check id is required")
+	}
+	switch c.Type {
+	case CheckHTTP:
+		if c.HTTP == "" {
+			return fmt.Errorf("check %s: http address is required", c.ID)
+		}
+	case CheckTCP:
+		if c.TCP == "" {
+			return fmt.Errorf("check %s: tcp address is required", c.ID)
+		}
+	case CheckTTL:
+		if c.TTL == "" {
+			return fmt.Errorf("check %s: ttl is required", c.ID)
+		}
+	default:
+		return fmt.Errorf("check %s: unknown type %q", c.ID, c.Type)
+	}
+	for _, d := range []string{c.Interval, c.Timeout, c.TTL, c.DeregisterCriticalAfter} {
+		if d == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d); err != nil || v <= 0 {
+			return fmt.Errorf("check %s: invalid duration %q", c.ID, d)
+		}
+	}
+	for _, d := range []string{c.Interval, c.TTL} {
+		if v, _ := time.ParseDuration(d); d != "" && v < minCheckInterval {
+			return fmt.Errorf("check %s: interval and ttl must be at least %v, got %q", c.ID, minCheckInterval, d)
+		}
+	}
+	return nil
+}
+
+// interval 检查间隔，TTL检查按TTL的一半检查是否超期
+// 不低于 minCheckInterval 的一半，存储中没有经过 Validate 的旧定义也不会得到非正数的间隔
+func (c CheckDefinition) interval() time.Duration {
+	d := parseDuration(c.Interval, defaultCheckInterval)
+	if c.Type == CheckTTL {
+		d = c.ttl() / 2
+	}
+	return max(d, minCheckInterval/2)
+}
+
+func (c CheckDefinition) timeout() time.Duration {
+	return parseDuration(c.Timeout, defaultCheckTimeout)
+}
+
+func (c CheckDefinition) ttl() time.Duration {
+	return parseDuration(c.TTL, defaultCheckInterval)
+}
+
+// deregisterAfter 返回 0 表示不自动注销
+func (c CheckDefinition) deregisterAfter() time.Duration {
+	return parseDuration(c.DeregisterCriticalAfter, 0)
+}
+
+func parseDuration(s string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return fallback
+	}
+	return d
+}
+
+// aggregateStatus 汇总多个检查的状态，取最差的一个；没有检查时视为 passing
+func aggregateStatus(checks []CheckStatus) HealthStatus {
+	status := HealthPassing
+	for _, c := range checks {
+		switch c.Status {
+		case HealthCritical:
+			return HealthCritical
+		case HealthWarning:
+			status = HealthWarning
+		}
+	}
+	return status
+}
@@ -0,0 +1,25 @@
+package registry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckInterval(t *testing.T) {
+	cases := []struct {
+		check CheckDefinition
+		want  time.Duration
+	}{
+		{CheckDefinition{Type: CheckHTTP}, defaultCheckInterval},
+		{CheckDefinition{Type: CheckHTTP, Interval: "30s"}, 30 * time.Second},
+		{CheckDefinition{Type: CheckTTL, TTL: "30s"}, 15 * time.Second},
+		// 没有经过 Validate 的定义（例如存储中的旧数据）也不能让 ticker 得到非正数的周期
+		{CheckDefinition{Type: CheckTTL, TTL: "1ns"}, minCheckInterval / 2},
+		{CheckDefinition{Type: CheckTCP, Interval: "1ms"}, minCheckInterval / 2},
+	}
+	for _, c := range cases {
+		if got := c.check.interval(); got != c.want {
+			t.Errorf("interval of %+v = %v, want %v", c.check, got, c.want)
+		}
+	}
+}
@@ -1,106 +1,303 @@
 package registry
 
 import (
-	"bytes"
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// 服务发现客户端结构
-type DiscoveryClient struct {
-	cache          []Registration
-	cacheMutex     sync.RWMutex
-	cacheExpiry    time.Duration
-	lastUpdate     time.Time
-	serviceUrl     string
+// Client 注册中心客户端
+// 所有请求都有超时，注册中心暂时不可用时按指数退避加随机抖动重试，见 ClientConfig。
+// 第一次查询后，客户端会在后台以阻塞查询跟踪注册中心的变化，
+// 跟踪正常时缓存始终是最新的，不再受过期时间限制；不再使用客户端时调用 Close 停止跟踪
+type Client struct {
+	cache      []Registration
+	cacheMutex sync.RWMutex
+	config     ClientConfig // 地址、命名空间、ACL令牌等配置
+	current    atomic.Int32 // 当前使用的注册中心地址
+	lastUpdate time.Time
+	index      uint64 // 缓存对应的目录修改序号
+	watching   bool   // 阻塞查询是否正常工作
+	watchOnce  sync.Once
+	ctx        context.Context // 后台跟踪和刷新使用的上下文，Close 时结束
+	cancel     context.CancelFunc
+
+	hits         atomic.Uint64 // 缓存统计，见 CacheStats
+	misses       atomic.Uint64
+	staleHits    atomic.Uint64
+	revalidating atomic.Bool // 是否正在后台刷新过期缓存
+	fileMutex    sync.Mutex  // 保护缓存文件的写入
 }
 
-// 全局服务发现客户端
+// DiscoveryClient Client 的旧名称
+type DiscoveryClient = Client
+
+// watchWait 每次阻塞查询的最长等待时间
+const watchWait = 30 * time.Second
+
 var (
-	defaultClient = &DiscoveryClient{
-		serviceUrl:  ServiceUrl,
-		cacheExpiry: 30 * time.Second,
+	// ErrNotFound 要查找的服务或实例不存在
+	ErrNotFound = errors.New("registry: not found")
+	// ErrUnavailable 所有注册中心地址都无法处理请求，重试之后仍然失败
+	ErrUnavailable = errors.New("registry: unavailable")
+)
+
+// checkStatus 把非 200 的响应转换为错误，404 对应 ErrNotFound
+func checkStatus(res *http.Response, action string) error {
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("failed to %s: %w", action, ErrNotFound)
 	}
+	return fmt.Errorf("failed to %s:%v", action, res.Status)
+}
+
+// 全局服务发现客户端，配置从环境变量读取，见 ConfigFromEnv
+var (
+	defaultClient = NewClient(ConfigFromEnv())
 )
 
-// RegistrationService 向注册中心注册服务
+// NewClient 按配置创建客户端
+// 查询只会返回配置的命名空间中的实例；命名空间为 AllNamespaces 时跨所有命名空间查询，此时不能注册或注销实例
+func NewClient(cfg ClientConfig) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{config: cfg.withDefaults(), ctx: ctx, cancel: cancel}
+}
+
+// Close 停止后台跟踪注册中心的阻塞查询，之后缓存按过期时间刷新
+// 客户端仍然可以发送请求，可以重复调用
+func (c *Client) Close() error {
+	c.cancel()
+	c.cacheMutex.Lock()
+	c.watching = false
+	c.cacheMutex.Unlock()
+	return nil
+}
+
+// NewDiscoveryClient 创建访问命名空间 namespace 的客户端，其他配置与全局客户端相同
+// 命名空间不同时不使用全局客户端的缓存文件，避免两个客户端写同一个文件
+func NewDiscoveryClient(namespace string) *Client {
+	cfg := DefaultConfig()
+	if namespace != cfg.Namespace {
+		cfg.CacheFile = ""
+	}
+	cfg.Namespace = namespace
+	return NewClient(cfg)
+}
+
+// UseNamespace 让全局客户端改为访问命名空间 namespace，需要在第一次查询之前调用
+func UseNamespace(namespace string) {
+	cfg := DefaultConfig()
+	cfg.Namespace = namespace
+	Configure(cfg)
+}
+
+// SetToken 设置全局客户端的ACL令牌，覆盖环境变量中的值
+func SetToken(token string) {
+	defaultClient.SetToken(token)
+}
+
+// Token 返回全局客户端的ACL令牌
+func Token() string {
+	return defaultClient.config.Token
+}
+
+// SetToken 设置客户端的ACL令牌，需要在第一次请求之前调用
+func (c *Client) SetToken(token string) {
+	c.config.Token = token
+}
+
+// Namespace 返回客户端访问的命名空间
+func (c *Client) Namespace() string {
+	return c.config.Namespace
+}
+
+// RegistrationService 向注册中心注册服务，注册到 r.Namespace 指定的命名空间
 func RegistrationService(r Registration) error {
-	buf := new(bytes.Buffer)
-	enc := json.NewEncoder(buf)
-	err := enc.Encode(r)
+	return defaultClient.RegistrationService(context.Background(), r)
+}
+
+// RegistrationService 向注册中心注册服务，r.Namespace 为空时注册到客户端的命名空间
+func (c *Client) RegistrationService(ctx context.Context, r Registration) error {
+	if r.Namespace == "" && c.config.Namespace != AllNamespaces {
+		r.Namespace = c.config.Namespace
+	}
+	if r.InstanceID == "" {
+		r.InstanceID = NewInstanceIDIn(r.Namespace, r.ServiceName, r.ServiceUrl)
+	}
+	body, err := json.Marshal(r)
 	if err != nil {
 		return err
 	}
-	res, err := http.Post(ServiceUrl, "application/json", buf)
+	res, err := c.do(ctx, http.MethodPost, namespacePath(r.Namespace)+"/services", body)
 	if err != nil {
 		return err
 	}
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to register service:%v", res.Status)
+	defer res.Body.Close()
+	return checkStatus(res, "register service")
+}
+
+// ShutdownService 通知注册中心服务关闭，只注销 instanceID 对应的实例
+func ShutdownService(instanceID string) error {
+	return defaultClient.ShutdownService(context.Background(), instanceID)
+}
+
+// Heartbeat 向注册中心发送心跳，续约 instanceID 对应的实例
+func Heartbeat(instanceID string) error {
+	return defaultClient.Heartbeat(context.Background(), instanceID)
+}
+
+// UpdateCheck 上报一个TTL检查的状态
+func UpdateCheck(instanceID, checkID string, status HealthStatus, output string) error {
+	return defaultClient.UpdateCheck(context.Background(), instanceID, checkID, status, output)
+}
+
+// ShutdownService 通知注册中心服务关闭，只注销客户端命名空间中 instanceID 对应的实例
+func (c *Client) ShutdownService(ctx context.Context, instanceID string) error {
+	res, err := c.do(ctx, http.MethodDelete, fmt.Sprintf("%s/%s", c.servicePath(), url.PathEscape(instanceID)), nil)
+	if err != nil {
+		return err
 	}
-	return nil
+	defer res.Body.Close()
+	return checkStatus(res, "shutdown service")
 }
 
-// ShutdownService 通知注册中心服务关闭
-func ShutdownService(url string) error {
-	req, err := http.NewRequest(http.MethodDelete, ServiceUrl, bytes.NewBuffer([]byte(url)))
+// Heartbeat 向注册中心发送心跳，续约客户端命名空间中 instanceID 对应的实例
+func (c *Client) Heartbeat(ctx context.Context, instanceID string) error {
+	res, err := c.do(ctx, http.MethodPut, fmt.Sprintf("%s/%s/heartbeat", c.servicePath(), url.PathEscape(instanceID)), nil)
 	if err != nil {
 		return err
 	}
-	req.Header.Add("Content-Type", "text/plain")
-	res, err := http.DefaultClient.Do(req)
+	defer res.Body.Close()
+	return checkStatus(res, "send heartbeat")
+}
+
+// UpdateCheck 上报一个TTL检查的状态
+func (c *Client) UpdateCheck(ctx context.Context, instanceID, checkID string, status HealthStatus, output string) error {
+	body, err := json.Marshal(map[string]string{
+		"status": string(status),
+		"output": output,
+	})
 	if err != nil {
 		return err
 	}
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to shutdown service:%v", res.Status)
+	res, err := c.do(ctx, http.MethodPut, fmt.Sprintf("%s/%s/checks/%s", c.servicePath(), url.PathEscape(instanceID), url.PathEscape(checkID)), body)
+	if err != nil {
+		return err
 	}
-	return nil
+	defer res.Body.Close()
+	return checkStatus(res, "update check")
+}
+
+// QueryOption 查询选项
+type QueryOption func(*queryOptions)
+
+type queryOptions struct {
+	passing bool
+}
+
+// Passing 只返回健康状态不是 critical 的实例
+func Passing() QueryOption {
+	return func(o *queryOptions) {
+		o.passing = true
+	}
+}
+
+func buildQueryOptions(opts []QueryOption) queryOptions {
+	var o queryOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// apply 在客户端按选项过滤实例
+func (o queryOptions) apply(regs []Registration) []Registration {
+	if o.passing {
+		return FilterPassing(regs)
+	}
+	return regs
+}
+
+// query 生成对应的查询参数
+func (o queryOptions) query() string {
+	if o.passing {
+		return "?passing=true"
+	}
+	return ""
 }
 
 // GetServices 获取所有已注册的服务（带缓存）
-func GetServices() ([]Registration, error) {
-	return defaultClient.GetServices()
+func GetServices(opts ...QueryOption) ([]Registration, error) {
+	return defaultClient.GetServices(context.Background(), opts...)
 }
 
 // GetServicesFresh 强制刷新获取所有已注册的服务
-func GetServicesFresh() ([]Registration, error) {
-	return defaultClient.GetServicesFresh()
+func GetServicesFresh(opts ...QueryOption) ([]Registration, error) {
+	return defaultClient.GetServicesFresh(context.Background(), opts...)
 }
 
 // FindService 根据服务名称查找服务（带缓存）
-func FindService(serviceName ServiceName) (Registration, error) {
-	return defaultClient.FindService(serviceName)
+func FindService(serviceName ServiceName, opts ...QueryOption) (Registration, error) {
+	return defaultClient.FindService(context.Background(), serviceName, opts...)
 }
 
 // FindServiceFresh 强制刷新查找服务
-func FindServiceFresh(serviceName ServiceName) (Registration, error) {
-	return defaultClient.FindServiceFresh(serviceName)
+func FindServiceFresh(serviceName ServiceName, opts ...QueryOption) (Registration, error) {
+	return defaultClient.FindServiceFresh(context.Background(), serviceName, opts...)
+}
+
+// FindServicesByTag 根据标签查找服务
+func FindServicesByTag(tag string, opts ...QueryOption) ([]Registration, error) {
+	return defaultClient.FindServicesByTag(context.Background(), tag, opts...)
 }
 
 // FindServicesByTag 根据标签查找服务
-func FindServicesByTag(tag string) ([]Registration, error) {
-	url := fmt.Sprintf("%s/services/tag/%s", ServiceUrl, tag)
-	res, err := http.Get(url)
+func (c *Client) FindServicesByTag(ctx context.Context, tag string, opts ...QueryOption) ([]Registration, error) {
+	o := buildQueryOptions(opts)
+	res, err := c.get(ctx, fmt.Sprintf("%s/tag/%s%s", c.servicePath(), url.PathEscape(tag), o.query()))
 	if err != nil {
 		return nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to find services by tag:%v", res.Status)
-	}
 	defer res.Body.Close()
+	if err := checkStatus(res, "find services by tag"); err != nil {
+		return nil, err
+	}
 	var regs []Registration
 	err = json.NewDecoder(res.Body).Decode(&regs)
 	return regs, err
 }
 
+// WatchServices 阻塞查询所有服务，见 DiscoveryClient.WatchServices
+func WatchServices(index uint64, wait time.Duration) ([]Registration, uint64, error) {
+	return defaultClient.WatchServices(context.Background(), index, wait)
+}
+
+// SubscribeEvents 订阅目录变化事件，见 DiscoveryClient.SubscribeEvents
+func SubscribeEvents(ctx context.Context, index uint64) <-chan Event {
+	return defaultClient.SubscribeEvents(ctx, index)
+}
+
 // HealthCheck 检查服务健康状态
 func HealthCheck(serviceName ServiceName) (bool, int64, error) {
-	url := fmt.Sprintf("%s/health/%s", ServiceUrl, serviceName)
-	res, err := http.Get(url)
+	return defaultClient.HealthCheck(context.Background(), serviceName)
+}
+
+// HealthCheck 检查客户端命名空间中服务的健康状态
+func (c *Client) HealthCheck(ctx context.Context, serviceName ServiceName) (bool, int64, error) {
+	res, err := c.get(ctx, fmt.Sprintf("%s/health/%s", namespacePath(c.config.Namespace), url.PathEscape(string(serviceName))))
 	if err != nil {
 		return false, 0, err
 	}
@@ -122,26 +319,42 @@ func HealthCheck(serviceName ServiceName) (bool, int64, error) {
 }
 
 // GetServices 获取所有服务（带缓存）
-func (c *DiscoveryClient) GetServices() ([]Registration, error) {
+func (c *Client) GetServices(ctx context.Context, opts ...QueryOption) ([]Registration, error) {
+	c.startWatch()
 	c.cacheMutex.RLock()
-	if time.Since(c.lastUpdate) < c.cacheExpiry && len(c.cache) > 0 {
+	if c.cacheValid() {
+		defer c.cacheMutex.RUnlock()
+		c.hits.Add(1)
+		return buildQueryOptions(opts).apply(c.cache), nil
+	}
+	if c.staleUsable() {
+		// 先返回过期的数据，同时在后台刷新
 		defer c.cacheMutex.RUnlock()
-		return c.cache, nil
+		c.staleHits.Add(1)
+		c.revalidate()
+		return buildQueryOptions(opts).apply(c.cache), nil
 	}
 	c.cacheMutex.RUnlock()
-	return c.GetServicesFresh()
+	c.misses.Add(1)
+	regs, err := c.GetServicesFresh(ctx, opts...)
+	if cached, ok := c.fallback(err); ok {
+		c.staleHits.Add(1)
+		return buildQueryOptions(opts).apply(cached), nil
+	}
+	return regs, err
 }
 
 // GetServicesFresh 强制刷新获取所有服务
-func (c *DiscoveryClient) GetServicesFresh() ([]Registration, error) {
-	res, err := http.Get(c.serviceUrl)
+// 缓存中总是保存全部实例，过滤在返回前进行
+func (c *Client) GetServicesFresh(ctx context.Context, opts ...QueryOption) ([]Registration, error) {
+	res, err := c.get(ctx, c.servicePath())
 	if err != nil {
 		return nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get services:%v", res.Status)
-	}
 	defer res.Body.Close()
+	if err := checkStatus(res, "get services"); err != nil {
+		return nil, err
+	}
 	var regs []Registration
 	err = json.NewDecoder(res.Body).Decode(&regs)
 	if err != nil {
@@ -149,22 +362,179 @@ func (c *DiscoveryClient) GetServicesFresh() ([]Registration, error) {
 	}
 
 	// 更新缓存
-	c.cacheMutex.Lock()
-	c.cache = regs
-	c.lastUpdate = time.Now()
-	c.cacheMutex.Unlock()
+	index, _ := strconv.ParseUint(res.Header.Get(IndexHeader), 10, 64)
+	c.cacheMutex.RLock()
+	watching := c.watching
+	c.cacheMutex.RUnlock()
+	c.storeCache(regs, index, watching)
+
+	return buildQueryOptions(opts).apply(regs), nil
+}
 
-	return regs, nil
+// WatchServices 阻塞查询：目录修改序号等于 index 时，注册中心最多等待 wait 再返回
+// 返回所有服务以及最新的修改序号，index 为 0 时立即返回
+func (c *Client) WatchServices(ctx context.Context, index uint64, wait time.Duration) ([]Registration, uint64, error) {
+	path := fmt.Sprintf("%s?index=%d&wait=%s", c.servicePath(), index, wait)
+	// 注册中心最多等待 wait，再加上普通请求的超时
+	res, err := c.send(ctx, c.httpClient(wait+c.config.Timeout), http.MethodGet, path, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	if err := checkStatus(res, "watch services"); err != nil {
+		return nil, 0, err
+	}
+	var regs []Registration
+	err = json.NewDecoder(res.Body).Decode(&regs)
+	if err != nil {
+		return nil, 0, err
+	}
+	newIndex, err := strconv.ParseUint(res.Header.Get(IndexHeader), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid %s header: %v", IndexHeader, err)
+	}
+	return regs, newIndex, nil
+}
+
+// SubscribeEvents 订阅注册中心的目录变化事件，只接收修改序号大于 index 的事件
+// index 为 0 时从订阅时刻开始。连接断开后自动用 Last-Event-ID 续传，
+// ctx 结束时关闭返回的通道。收到 EventReset 说明有事件已经丢失，需要重新获取全量列表
+func (c *Client) SubscribeEvents(ctx context.Context, index uint64) <-chan Event {
+	ch := make(chan Event, 16)
+	go func() {
+		defer close(ch)
+		backoff := time.Second
+		for {
+			connected, err := c.streamEvents(ctx, &index, ch)
+			if ctx.Err() != nil {
+				return
+			}
+			if connected {
+				backoff = time.Second
+			}
+			log.Printf("Registry event stream interrupted, reconnecting in %v: %v\n", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, watchWait)
+		}
+	}()
+	return ch
+}
+
+// streamEvents 读取一次事件流直到连接断开，index 随收到的事件更新
+func (c *Client) streamEvents(ctx context.Context, index *uint64, ch chan<- Event) (bool, error) {
+	header := http.Header{"Accept": {"text/event-stream"}}
+	if *index > 0 {
+		header.Set("Last-Event-ID", strconv.FormatUint(*index, 10))
+	}
+	// 事件流是长连接，不设置超时，由 ctx 控制结束
+	res, err := c.send(ctx, c.httpClient(0), http.MethodGet, c.servicePath()+"/events", nil, header)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if err := checkStatus(res, "subscribe events"); err != nil {
+		return false, err
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data.WriteString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			// id:、event: 以及注释行的信息都已包含在 data 中
+			continue
+		}
+		var ev Event
+		err := json.Unmarshal([]byte(data.String()), &ev)
+		data.Reset()
+		if err != nil {
+			return true, err
+		}
+		*index = ev.Index
+		select {
+		case ch <- ev:
+		case <-ctx.Done():
+			return true, ctx.Err()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return true, err
+	}
+	return true, io.EOF
+}
+
+// startWatch 第一次使用时启动后台跟踪，配置了缓存文件时先从文件恢复缓存
+func (c *Client) startWatch() {
+	c.watchOnce.Do(func() {
+		if c.config.CacheFile != "" {
+			if err := c.loadCacheFile(); err != nil {
+				log.Printf("Failed to load registry cache file: %v\n", err)
+			}
+		}
+		go c.watch()
+	})
+}
+
+// watch 持续以阻塞查询跟踪注册中心，出错时退回到按过期时间刷新缓存，直到调用 Close
+func (c *Client) watch() {
+	var index uint64
+	backoff := time.Second
+	for {
+		regs, newIndex, err := c.WatchServices(c.ctx, index, watchWait)
+		if c.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			c.cacheMutex.Lock()
+			c.watching = false
+			c.cacheMutex.Unlock()
+			log.Printf("Registry watch failed, retrying in %v: %v\n", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-c.ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, watchWait)
+			// 重新获取全量数据
+			index = 0
+			continue
+		}
+		backoff = time.Second
+
+		c.storeCache(regs, newIndex, true)
+		index = newIndex
+	}
 }
 
 // FindService 查找服务（带缓存）
-func (c *DiscoveryClient) FindService(serviceName ServiceName) (Registration, error) {
+func (c *Client) FindService(ctx context.Context, serviceName ServiceName, opts ...QueryOption) (Registration, error) {
+	o := buildQueryOptions(opts)
 	// 先尝试从缓存获取
+	c.startWatch()
 	c.cacheMutex.RLock()
-	if time.Since(c.lastUpdate) < c.cacheExpiry && len(c.cache) > 0 {
+	valid, stale := c.cacheValid(), false
+	if !valid {
+		stale = c.staleUsable()
+	}
+	if valid || stale {
 		for _, reg := range c.cache {
-			if reg.ServiceName == serviceName {
+			if reg.ServiceName == serviceName && (!o.passing || reg.Status != HealthCritical) {
 				c.cacheMutex.RUnlock()
+				if stale {
+					c.staleHits.Add(1)
+					c.revalidate()
+				} else {
+					c.hits.Add(1)
+				}
 				return reg, nil
 			}
 		}
@@ -172,23 +542,41 @@ func (c *DiscoveryClient) FindService(serviceName ServiceName) (Registration, er
 	c.cacheMutex.RUnlock()
 
 	// 缓存未命中，刷新并重试
-	return c.FindServiceFresh(serviceName)
+	c.misses.Add(1)
+	reg, err := c.FindServiceFresh(ctx, serviceName, opts...)
+	if cached, ok := c.fallback(err); ok {
+		for _, reg := range cached {
+			if reg.ServiceName == serviceName && (!o.passing || reg.Status != HealthCritical) {
+				c.staleHits.Add(1)
+				return reg, nil
+			}
+		}
+	}
+	return reg, err
+}
+
+// cacheValid 缓存是否可用，调用方需持有读锁
+func (c *Client) cacheValid() bool {
+	if c.watching {
+		return true
+	}
+	return time.Since(c.lastUpdate) < c.config.CacheExpiry && len(c.cache) > 0
 }
 
 // FindServiceFresh 强制刷新查找服务
-func (c *DiscoveryClient) FindServiceFresh(serviceName ServiceName) (Registration, error) {
-	url := fmt.Sprintf("%s/services/%s", c.serviceUrl, serviceName)
-	res, err := http.Get(url)
+// 服务没有实例时返回的错误包装了 ErrNotFound
+func (c *Client) FindServiceFresh(ctx context.Context, serviceName ServiceName, opts ...QueryOption) (Registration, error) {
+	res, err := c.get(ctx, fmt.Sprintf("%s/%s%s", c.servicePath(), url.PathEscape(string(serviceName)), buildQueryOptions(opts).query()))
 	if err != nil {
 		return Registration{}, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode == http.StatusNotFound {
-		return Registration{}, fmt.Errorf("service %s not found", serviceName)
+		return Registration{}, fmt.Errorf("service %s: %w", serviceName, ErrNotFound)
 	}
-	if res.StatusCode != http.StatusOK {
-		return Registration{}, fmt.Errorf("failed to find service:%v", res.Status)
+	if err := checkStatus(res, "find service"); err != nil {
+		return Registration{}, err
 	}
 
 	var regs []Registration
@@ -198,21 +586,16 @@ func (c *DiscoveryClient) FindServiceFresh(serviceName ServiceName) (Registratio
 	}
 
 	if len(regs) == 0 {
-		return Registration{}, fmt.Errorf("service %s not found", serviceName)
+		return Registration{}, fmt.Errorf("service %s: %w", serviceName, ErrNotFound)
 	}
 
-	// 更新缓存
-	c.cacheMutex.Lock()
-	c.cache = regs
-	c.lastUpdate = time.Now()
-	c.cacheMutex.Unlock()
-
+	// 这里只拿到了一个服务的实例，不能覆盖全量缓存
 	return regs[0], nil
 }
 
 // SetCacheExpiry 设置缓存过期时间
 func SetCacheExpiry(expiry time.Duration) {
-	defaultClient.cacheExpiry = expiry
+	defaultClient.config.CacheExpiry = expiry
 }
 
 // ClearCache 清除缓存
@@ -221,9 +604,10 @@ func ClearCache() {
 }
 
 // ClearCache 清除缓存
-func (c *DiscoveryClient) ClearCache() {
+func (c *Client) ClearCache() {
 	c.cacheMutex.Lock()
 	c.cache = nil
 	c.lastUpdate = time.Time{}
+	c.watching = false
 	c.cacheMutex.Unlock()
 }
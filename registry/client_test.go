@@ -0,0 +1,192 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientCloseStopsWatch(t *testing.T) {
+	server := NewServer()
+	ts := httptest.NewServer(server)
+	client := NewClient(ClientConfig{Addresses: []string{ts.URL}, MaxRetries: -1})
+	if err := client.RegistrationService(context.Background(), Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetServices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// 等待后台的阻塞查询开始
+	waitFor(t, "watch to start", func() bool {
+		client.cacheMutex.RLock()
+		defer client.cacheMutex.RUnlock()
+		return client.watching
+	})
+
+	client.Close()
+	client.cacheMutex.RLock()
+	watching := client.watching
+	client.cacheMutex.RUnlock()
+	if watching {
+		t.Fatal("client is still watching after Close")
+	}
+
+	// 阻塞查询已经结束，注册中心可以立即关闭
+	closed := make(chan struct{})
+	go func() {
+		ts.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		ts.CloseClientConnections()
+		t.Fatal("registry still has an open watch after Close")
+	}
+	client.Close()
+}
+
+// countingServer 启动一个按 respond 返回状态码的服务，返回地址和请求计数
+// respond 返回 0 时交给注册中心处理
+func countingServer(t *testing.T, respond func(n int32) int) (string, *atomic.Int32) {
+	t.Helper()
+	server := NewServer()
+	var count atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := respond(count.Add(1)); code != 0 {
+			w.WriteHeader(code)
+			return
+		}
+		server.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL, &count
+}
+
+func retryingClient(addrs ...string) *Client {
+	return NewClient(ClientConfig{Addresses: addrs, MaxRetries: 3, RetryWait: time.Millisecond, MaxRetryWait: 5 * time.Millisecond})
+}
+
+func TestClientRetryClassification(t *testing.T) {
+	cases := []struct {
+		name     string
+		status   int // 前两次请求的状态码
+		attempts int32
+		err      string // 为空时请求应当成功
+	}{
+		{"retries 503 until success", http.StatusServiceUnavailable, 3, ""},
+		{"retries 502", http.StatusBadGateway, 3, ""},
+		{"retries 504", http.StatusGatewayTimeout, 3, ""},
+		{"no retry on 400", http.StatusBadRequest, 1, "400"},
+		{"no retry on 403", http.StatusForbidden, 1, "403"},
+		{"no retry on 404", http.StatusNotFound, 1, "not found"},
+		{"no retry on 500", http.StatusInternalServerError, 1, "500"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addr, count := countingServer(t, func(n int32) int {
+				if n <= 2 {
+					return c.status
+				}
+				return 0
+			})
+			_, err := retryingClient(addr).GetServicesFresh(context.Background())
+			if got := count.Load(); got != c.attempts {
+				t.Fatalf("sent %d requests, want %d", got, c.attempts)
+			}
+			if c.err == "" {
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				return
+			}
+			if err == nil || errors.Is(err, ErrUnavailable) || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("error %v, want a non-retryable error containing %q", err, c.err)
+			}
+			if notFound := c.status == http.StatusNotFound; errors.Is(err, ErrNotFound) != notFound {
+				t.Fatalf("error %v: errors.Is(ErrNotFound) = %v", err, !notFound)
+			}
+		})
+	}
+}
+
+func TestClientGivesUpAfterMaxRetries(t *testing.T) {
+	addr, count := countingServer(t, func(int32) int { return http.StatusServiceUnavailable })
+	_, err := retryingClient(addr).GetServicesFresh(context.Background())
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("error %v is not ErrUnavailable", err)
+	}
+	if got := count.Load(); got != 4 {
+		t.Fatalf("sent %d requests, want 1 + 3 retries", got)
+	}
+
+	// MaxRetries 小于 0 时不重试
+	count.Store(0)
+	client := NewClient(ClientConfig{Addresses: []string{addr}, MaxRetries: -1})
+	if _, err := client.GetServicesFresh(context.Background()); !errors.Is(err, ErrUnavailable) || count.Load() != 1 {
+		t.Fatalf("without retries sent %d requests: %v", count.Load(), err)
+	}
+}
+
+func TestClientRetriesConnectionErrors(t *testing.T) {
+	// 接受连接后立即关闭，客户端得到连接错误
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conn.Close()
+		}
+	}()
+	_, err = retryingClient("http://" + ln.Addr().String()).GetServicesFresh(context.Background())
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("error %v is not ErrUnavailable", err)
+	}
+	if got := accepted.Load(); got < 4 {
+		t.Fatalf("connected %d times, want at least 1 + 3 retries", got)
+	}
+}
+
+func TestClientRetryStopsOnCancel(t *testing.T) {
+	addr, _ := countingServer(t, func(int32) int { return http.StatusServiceUnavailable })
+	client := NewClient(ClientConfig{Addresses: []string{addr}, MaxRetries: 10, RetryWait: time.Hour, MaxRetryWait: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.GetServicesFresh(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error %v, want the context error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("cancelled request returned after %v", elapsed)
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	client := NewClient(ClientConfig{RetryWait: 100 * time.Millisecond, MaxRetryWait: time.Second})
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		for range 20 {
+			if wait := client.retryWait(attempt); wait < max/2 || wait > max {
+				t.Fatalf("retry %d waits %v, want between %v and %v", attempt, wait, max/2, max)
+			}
+		}
+	}
+	if wait := client.retryWait(100); wait > time.Second {
+		t.Fatalf("retry 100 waits %v", wait)
+	}
+}
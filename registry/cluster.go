@@ -0,0 +1,201 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/linshule/go-distributed/raft"
+	"github.com/linshule/go-distributed/tlsutil"
+)
+
+// proposeTimeout 等待集群提交一条变更的最长时间
+const proposeTimeout = 5 * time.Second
+
+// ClusterConfig 集群模式的配置
+type ClusterConfig struct {
+	Self            string        // 本节点对外的地址，例如 "http://localhost:3000"
+	Peers           []string      // 其他节点的地址
+	Storage         raft.Storage  // 持久化 Raft 的任期、投票和日志，为空时只保存在内存中
+	ElectionTimeout time.Duration // 选举超时，为 0 时使用 raft 的默认值
+	// Secret 节点之间共享的密钥，每个节点需要配置相同的值
+	Secret string
+	// PeerIdentities 允许的节点证书名称，节点之间通过 mTLS 认证时使用
+	PeerIdentities []string
+}
+
+// EnableCluster 以集群模式运行注册中心
+//
+// 注册和注销经过 Raft 复制到所有节点；心跳只在 Leader 上处理，
+// 新 Leader 追上之前的日志后会给所有实例一个完整的租约。
+// 集群模式下 Raft 日志是唯一的持久化状态，节点重启后通过重放日志恢复服务目录，
+// 因此不能和 UseStorage 一起使用。
+// 节点之间的请求可以复制任意变更（包括管理令牌），Secret 和 PeerIdentities 至少要配置一个。
+// 返回的节点需要调用 Start 启动，其 Handler 挂载在 /raft/ 路径下。
+func (s *Server) EnableCluster(cfg ClusterConfig) (*raft.Node, error) {
+	r := s.reg
+	r.mutex.Lock()
+	_, inMemory := r.storage.(memoryStorage)
+	r.mutex.Unlock()
+	if !inMemory {
+		return nil, errors.New("cluster mode keeps its state in the raft log and cannot be combined with UseStorage")
+	}
+	var node *raft.Node
+	node, err := raft.NewNode(raft.Config{
+		ID:              cfg.Self,
+		Peers:           cfg.Peers,
+		ElectionTimeout: cfg.ElectionTimeout,
+		Storage:         cfg.Storage,
+		Secret:          cfg.Secret,
+		PeerIdentities:  cfg.PeerIdentities,
+		Apply: func(data []byte) {
+			var op Operation
+			if err := json.Unmarshal(data, &op); err != nil {
+				log.Println("Failed to decode replicated operation:", err)
+				return
+			}
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			if err := r.commit(op); err != nil {
+				log.Println("Failed to apply replicated operation:", err)
+			}
+		},
+		Transport: tlsutil.Client().Transport,
+		OnLeaderChange: func(isLeader bool) {
+			if isLeader {
+				log.Printf("This node (%s) is now the registry leader\n", cfg.Self)
+				r.takeLeadership(node)
+			} else {
+				log.Printf("This node (%s) is no longer the registry leader\n", cfg.Self)
+				r.mutex.Lock()
+				r.leading = false
+				r.mutex.Unlock()
+			}
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.mutex.Lock()
+	r.node = node
+	r.mutex.Unlock()
+	return node, nil
+}
+
+// EnableCluster 以集群模式运行默认的注册中心实例
+func EnableCluster(cfg ClusterConfig) (*raft.Node, error) {
+	return defaultServer.EnableCluster(cfg)
+}
+
+// propose 把一条变更提交到集群，等它在本节点应用后返回
+func (r *registry) propose(op Operation) error {
+	// 序号由每个节点在应用时各自分配
+	op.Seq = 0
+	if op.Time.IsZero() {
+		op.Time = time.Now()
+	}
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+	defer cancel()
+	return r.node.Propose(ctx, data)
+}
+
+// takeLeadership 新 Leader 等之前任期的日志全部应用之后给所有实例一个完整的租约，
+// 之后才开始回收租约和执行健康检查，避免用重放出来的旧心跳时间移除实例
+func (r *registry) takeLeadership(node *raft.Node) {
+	for node.IsLeader() {
+		ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+		err := node.ReadIndex(ctx)
+		cancel()
+		if err == nil {
+			r.renewAll()
+			return
+		}
+		// 本任期的第一条日志还没有提交
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// renewAll 给所有实例一个完整的租约，并开始以 Leader 身份工作
+// 检查时间只在状态变化时复制，已经上报过的TTL检查也从现在重新计时
+func (r *registry) renewAll() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	for i := range r.registrations {
+		r.registrations[i].LastHeartbeat = now
+		for j := range r.registrations[i].Health {
+			if st := &r.registrations[i].Health[j]; !st.LastChecked.IsZero() {
+				st.LastChecked = now
+			}
+		}
+	}
+	r.leading = true
+}
+
+// isLeader 本节点是否负责心跳、租约回收和健康检查，单机模式下总是 true
+// 集群模式下要求本节点是 Leader，并且已经追上之前任期的日志
+func (r *registry) isLeader() bool {
+	if r.node == nil {
+		return true
+	}
+	r.mutex.Lock()
+	leading := r.leading
+	r.mutex.Unlock()
+	return leading && r.node.IsLeader()
+}
+
+// isWrite 判断请求是否会修改注册表
+func isWrite(r *http.Request) bool {
+	return r.Method == http.MethodPost || r.Method == http.MethodDelete || r.Method == http.MethodPut
+}
+
+// routeToLeader 集群模式下，把写请求和要求一致性读的请求交给 Leader
+// 已经写出响应时返回 true
+func (s *Server) routeToLeader(w http.ResponseWriter, r *http.Request) bool {
+	node := s.reg.node
+	if node == nil {
+		return false
+	}
+	_, consistent := r.URL.Query()["consistent"]
+	if !isWrite(r) && !consistent {
+		// 普通读请求由本节点直接处理，可能读到稍旧的数据
+		return false
+	}
+
+	if !node.IsLeader() {
+		leader := node.Leader()
+		if leader == "" {
+			writeError(w, http.StatusServiceUnavailable, "no leader elected")
+			return true
+		}
+		// 307 会让客户端带着原请求体重新发给 Leader
+		w.Header().Set("X-Registry-Leader", leader)
+		http.Redirect(w, r, leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return true
+	}
+
+	if consistent && !isWrite(r) {
+		if err := node.ReadIndex(r.Context()); err != nil {
+			log.Println(err)
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return true
+		}
+	}
+	return false
+}
+
+// clusterError 把集群错误转换成HTTP状态码
+func clusterError(err error) int {
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
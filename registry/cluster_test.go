@@ -0,0 +1,407 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linshule/go-distributed/raft"
+)
+
+// testNode 进程内的一个注册中心节点，可以停止并用同一个 Raft 存储重新启动
+type testNode struct {
+	t       *testing.T
+	ts      *httptest.Server
+	peers   []string
+	storage raft.Storage
+
+	mutex   sync.Mutex
+	server  *Server
+	node    *raft.Node
+	handler http.Handler // 停止时为 nil，请求返回 503
+}
+
+func (tn *testNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tn.mutex.Lock()
+	h := tn.handler
+	tn.mutex.Unlock()
+	if h == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// start 创建一个新的注册中心实例，从节点的 Raft 存储恢复
+func (tn *testNode) start() {
+	tn.t.Helper()
+	server := NewServer()
+	node, err := server.EnableCluster(ClusterConfig{
+		Self:            tn.ts.URL,
+		Peers:           tn.peers,
+		Storage:         tn.storage,
+		ElectionTimeout: 100 * time.Millisecond,
+		Secret:          testClusterSecret,
+	})
+	if err != nil {
+		tn.t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/raft/", node.Handler())
+	mux.Handle("/", server)
+	tn.mutex.Lock()
+	tn.server, tn.node, tn.handler = server, node, mux
+	tn.mutex.Unlock()
+	node.Start()
+}
+
+// stop 停止节点，之后它不再响应任何请求
+func (tn *testNode) stop() {
+	tn.mutex.Lock()
+	server, node := tn.server, tn.node
+	tn.server, tn.node, tn.handler = nil, nil, nil
+	tn.mutex.Unlock()
+	if node != nil {
+		node.Stop()
+		server.Stop()
+	}
+}
+
+func (tn *testNode) current() (*Server, *raft.Node) {
+	tn.mutex.Lock()
+	defer tn.mutex.Unlock()
+	return tn.server, tn.node
+}
+
+// newTestCluster 在同一个进程中启动 size 个注册中心节点
+func newTestCluster(t *testing.T, size int, storage func(i int) raft.Storage) []*testNode {
+	nodes := make([]*testNode, size)
+	for i := range nodes {
+		nodes[i] = &testNode{t: t, storage: storage(i)}
+		nodes[i].ts = httptest.NewServer(nodes[i])
+	}
+	for i, tn := range nodes {
+		for j, other := range nodes {
+			if i != j {
+				tn.peers = append(tn.peers, other.ts.URL)
+			}
+		}
+	}
+	t.Cleanup(func() {
+		for _, tn := range nodes {
+			tn.stop()
+			tn.ts.Close()
+		}
+	})
+	for _, tn := range nodes {
+		tn.start()
+	}
+	return nodes
+}
+
+// testClusterSecret 测试集群的共享密钥
+const testClusterSecret = "test-cluster-secret"
+
+func memoryRaftStorage(int) raft.Storage {
+	return raft.NewMemoryStorage()
+}
+
+// waitFor 等待 cond 成立，超时时测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitLeader 等待运行中的节点选出 Leader，并且 Leader 已经接管
+func waitLeader(t *testing.T, nodes []*testNode) *testNode {
+	t.Helper()
+	var leader *testNode
+	waitFor(t, "leader election", func() bool {
+		for _, tn := range nodes {
+			if server, _ := tn.current(); server != nil && server.reg.isLeader() {
+				leader = tn
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+// do 发送请求，返回状态码和 X-Registry-Index；307 由客户端自动跟随到 Leader
+func do(t *testing.T, method, url string, body interface{}) (int, uint64) {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	index, _ := strconv.ParseUint(res.Header.Get(IndexHeader), 10, 64)
+	return res.StatusCode, index
+}
+
+// instancesOn 返回节点上服务 name 的实例
+func instancesOn(tn *testNode, name ServiceName) []Registration {
+	server, _ := tn.current()
+	if server == nil {
+		return nil
+	}
+	return server.reg.findByName(DefaultNamespace, name)
+}
+
+// waitConverged 等待运行中的每个节点上服务 name 都有 n 个实例，并且目录修改序号一致
+func waitConverged(t *testing.T, nodes []*testNode, name ServiceName, n int) {
+	t.Helper()
+	waitFor(t, "nodes to converge", func() bool {
+		var index uint64
+		for _, tn := range nodes {
+			server, _ := tn.current()
+			if server == nil {
+				continue
+			}
+			if len(instancesOn(tn, name)) != n {
+				return false
+			}
+			current := server.reg.currentIndex()
+			if index != 0 && current != index {
+				return false
+			}
+			index = current
+		}
+		return true
+	})
+}
+
+func TestClusterReplication(t *testing.T) {
+	nodes := newTestCluster(t, 3, memoryRaftStorage)
+	leader := waitLeader(t, nodes)
+
+	// 发给 Follower 的写请求被重定向到 Leader
+	var follower *testNode
+	for _, tn := range nodes {
+		if tn != leader {
+			follower = tn
+			break
+		}
+	}
+	reg := Registration{ServiceName: "ClusterService", ServiceUrl: "http://localhost:9100", InstanceID: "cluster-1"}
+	if status, _ := do(t, http.MethodPost, follower.ts.URL+"/services", reg); status != http.StatusOK {
+		t.Fatalf("register returned %d", status)
+	}
+	waitConverged(t, nodes, "ClusterService", 1)
+
+	// 每个节点都能查到实例，返回相同的修改序号
+	var index uint64
+	for _, tn := range nodes {
+		status, got := do(t, http.MethodGet, tn.ts.URL+"/services/ClusterService", nil)
+		if status != http.StatusOK {
+			t.Fatalf("%s returned %d", tn.ts.URL, status)
+		}
+		if index != 0 && got != index {
+			t.Fatalf("%s returned index %d, another node returned %d", tn.ts.URL, got, index)
+		}
+		index = got
+	}
+
+	if status, _ := do(t, http.MethodDelete, follower.ts.URL+"/services/cluster-1", nil); status != http.StatusOK {
+		t.Fatalf("deregister returned %d", status)
+	}
+	waitConverged(t, nodes, "ClusterService", 0)
+}
+
+func TestClusterLeaderFailover(t *testing.T) {
+	nodes := newTestCluster(t, 3, memoryRaftStorage)
+	leader := waitLeader(t, nodes)
+	reg := Registration{ServiceName: "ClusterService", ServiceUrl: "http://localhost:9100", InstanceID: "cluster-1"}
+	if status, _ := do(t, http.MethodPost, leader.ts.URL+"/services", reg); status != http.StatusOK {
+		t.Fatalf("register returned %d", status)
+	}
+	waitConverged(t, nodes, "ClusterService", 1)
+
+	leader.stop()
+	leader = waitLeader(t, nodes)
+	reg = Registration{ServiceName: "ClusterService", ServiceUrl: "http://localhost:9101", InstanceID: "cluster-2"}
+	if status, _ := do(t, http.MethodPost, leader.ts.URL+"/services", reg); status != http.StatusOK {
+		t.Fatalf("register after failover returned %d", status)
+	}
+	waitConverged(t, nodes, "ClusterService", 2)
+}
+
+func TestClusterRestart(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	open := func(i int) raft.Storage {
+		s, err := raft.NewFileStorage(dirs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	nodes := newTestCluster(t, 3, open)
+	leader := waitLeader(t, nodes)
+	for i, url := range []string{"http://localhost:9100", "http://localhost:9101"} {
+		reg := Registration{ServiceName: "ClusterService", ServiceUrl: url, InstanceID: "cluster-" + strconv.Itoa(i)}
+		if status, _ := do(t, http.MethodPost, leader.ts.URL+"/services", reg); status != http.StatusOK {
+			t.Fatalf("register returned %d", status)
+		}
+	}
+	waitConverged(t, nodes, "ClusterService", 2)
+
+	// 整个集群重启，每个节点从自己的 Raft 日志恢复服务目录
+	for _, tn := range nodes {
+		tn.stop()
+	}
+	for i, tn := range nodes {
+		tn.storage.Close()
+		tn.storage = open(i)
+		tn.start()
+	}
+	waitLeader(t, nodes)
+	waitConverged(t, nodes, "ClusterService", 2)
+
+	// 恢复出来的实例有完整的租约，不会被立即回收
+	server, _ := waitLeader(t, nodes).current()
+	if removed := server.reg.expire(time.Now()); len(removed) != 0 {
+		t.Fatalf("leader expired %d recovered instances", len(removed))
+	}
+}
+
+func TestClusterRejectsUseStorage(t *testing.T) {
+	server := NewServer()
+	if err := server.UseStorage(openStorage(t, t.TempDir())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.EnableCluster(ClusterConfig{Self: "http://localhost:1", Secret: testClusterSecret}); err == nil {
+		t.Fatal("EnableCluster accepted a server with file storage")
+	}
+}
+
+func TestClusterRequiresPeerAuth(t *testing.T) {
+	if _, err := NewServer().EnableCluster(ClusterConfig{Self: "http://localhost:1"}); err == nil {
+		t.Fatal("EnableCluster accepted a cluster without peer authentication")
+	}
+}
+
+func TestClusterRejectsForgedTokens(t *testing.T) {
+	nodes := newTestCluster(t, 3, memoryRaftStorage)
+	leader := waitLeader(t, nodes)
+	_, node := leader.current()
+
+	// 伪造一条更高任期的日志，试图写入一个管理令牌
+	token := ACLToken{AccessorID: "forged", SecretID: "forged-secret", Management: true}
+	data, _ := json.Marshal(Operation{Type: OpTokenSet, Token: &token})
+	status := node.Status()
+	forged := raft.AppendRequest{
+		Term:         status.Term + 100,
+		LeaderID:     "http://attacker",
+		PrevLogIndex: status.LastIndex,
+		PrevLogTerm:  status.Term,
+		Entries:      []raft.Entry{{Term: status.Term + 100, Index: status.LastIndex + 1, Data: data}},
+		LeaderCommit: status.LastIndex + 1,
+	}
+	for _, tn := range nodes {
+		code, _ := do(t, http.MethodPost, tn.ts.URL+"/raft/append", forged)
+		if code != http.StatusForbidden {
+			t.Fatalf("%s accepted an unauthenticated append with status %d", tn.ts.URL, code)
+		}
+		server, _ := tn.current()
+		if _, ok := server.reg.getToken("forged"); ok {
+			t.Fatalf("%s applied a forged token", tn.ts.URL)
+		}
+	}
+	if !node.IsLeader() {
+		t.Fatal("forged append made the leader step down")
+	}
+}
+
+func TestClusterReplicatesCheckStatus(t *testing.T) {
+	nodes := newTestCluster(t, 3, memoryRaftStorage)
+	leader := waitLeader(t, nodes)
+	var follower *testNode
+	for _, tn := range nodes {
+		if tn != leader {
+			follower = tn
+			break
+		}
+	}
+	reg := Registration{
+		ServiceName: "ClusterService",
+		ServiceUrl:  "http://localhost:9100",
+		InstanceID:  "cluster-1",
+		Checks:      []CheckDefinition{{ID: "ttl", Type: CheckTTL, TTL: "30s"}},
+	}
+	if status, _ := do(t, http.MethodPost, leader.ts.URL+"/services", reg); status != http.StatusOK {
+		t.Fatalf("register returned %d", status)
+	}
+	waitConverged(t, nodes, "ClusterService", 1)
+
+	// 每个节点的检查状态、修改序号和事件历史都与 Leader 一致
+	waitStatus := func(want HealthStatus) {
+		t.Helper()
+		waitConverged(t, nodes, "ClusterService", 1)
+		waitFor(t, "status "+string(want)+" on every node", func() bool {
+			for _, tn := range nodes {
+				regs := instancesOn(tn, "ClusterService")
+				if len(regs) != 1 || regs[0].Status != want || regs[0].Health[0].Status != want {
+					return false
+				}
+			}
+			return true
+		})
+		waitConverged(t, nodes, "ClusterService", 1)
+		for _, tn := range nodes {
+			server, _ := tn.current()
+			server.reg.mutex.Lock()
+			last := server.reg.history[len(server.reg.history)-1]
+			server.reg.mutex.Unlock()
+			if last.Type != EventHealthChanged || last.Registration.Status != want {
+				t.Fatalf("%s last event is %s %s, want health-changed %s", tn.ts.URL, last.Type, last.Registration.Status, want)
+			}
+		}
+	}
+
+	// 发给 Follower 的上报被重定向到 Leader，再复制到所有节点
+	update := map[string]string{"status": string(HealthPassing), "output": "ok"}
+	if status, _ := do(t, http.MethodPut, follower.ts.URL+"/services/cluster-1/checks/ttl", update); status != http.StatusOK {
+		t.Fatalf("check update returned %d", status)
+	}
+	waitStatus(HealthPassing)
+	if status, _ := do(t, http.MethodGet, follower.ts.URL+"/services/ClusterService?passing=true", nil); status != http.StatusOK {
+		t.Fatalf("passing query on follower returned %d", status)
+	}
+
+	update["status"] = string(HealthCritical)
+	if status, _ := do(t, http.MethodPut, follower.ts.URL+"/services/cluster-1/checks/ttl", update); status != http.StatusOK {
+		t.Fatalf("check update returned %d", status)
+	}
+	waitStatus(HealthCritical)
+	if status, _ := do(t, http.MethodGet, follower.ts.URL+"/services/ClusterService?passing=true", nil); status != http.StatusNotFound {
+		t.Fatalf("passing query on follower returned %d, want 404", status)
+	}
+
+	if status, _ := do(t, http.MethodPut, leader.ts.URL+"/services/unknown/checks/ttl", update); status != http.StatusNotFound {
+		t.Fatalf("update of an unknown instance returned %d, want 404", status)
+	}
+}
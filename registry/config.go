@@ -0,0 +1,284 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/linshule/go-distributed/tlsutil"
+)
+
+const (
+	// AddrEnv 注册中心地址的环境变量，多个地址以逗号分隔，例如 "http://10.0.0.1:3000,http://10.0.0.2:3000"
+	AddrEnv = "REGISTRY_ADDR"
+	// NamespaceEnv 客户端默认访问的命名空间
+	NamespaceEnv = "REGISTRY_NAMESPACE"
+	// ListenAddrEnv 注册中心的监听地址
+	ListenAddrEnv = "REGISTRY_LISTEN_ADDR"
+	// CacheFileEnv 客户端缓存文件的路径
+	CacheFileEnv = "REGISTRY_CACHE_FILE"
+	// StaleCacheEnv 为 true 时启用 StaleWhileRevalidate
+	StaleCacheEnv = "REGISTRY_STALE_CACHE"
+
+	defaultCacheExpiry  = 30 * time.Second
+	defaultTimeout      = 10 * time.Second
+	defaultMaxRetries   = 3
+	defaultRetryWait    = 200 * time.Millisecond
+	defaultMaxRetryWait = 5 * time.Second
+)
+
+// ClientConfig 注册中心客户端配置
+type ClientConfig struct {
+	Addresses   []string      // 注册中心地址，按顺序尝试，一个地址不可用时切换到下一个
+	Namespace   string        // 访问的命名空间，默认为 DefaultNamespace
+	Token       string        // ACL令牌
+	CacheExpiry time.Duration // 缓存过期时间，默认30秒
+
+	Timeout      time.Duration // 单次请求的超时，默认10秒，阻塞查询在此基础上加上等待时间
+	MaxRetries   int           // 所有地址都不可用时的最大重试次数，默认3次，小于0时不重试
+	RetryWait    time.Duration // 第一次重试前的等待时间，之后每次翻倍，默认200毫秒
+	MaxRetryWait time.Duration // 重试等待时间的上限，默认5秒
+
+	// StaleWhileRevalidate 缓存过期后继续返回过期的数据，同时在后台刷新，
+	// 注册中心不可用时依赖它的请求不会全部失败，过期程度见 CacheStats
+	StaleWhileRevalidate bool
+	MaxStale             time.Duration // 过期数据最多可以使用多久，为 0 时不限制
+	CacheFile            string        // 缓存文件，每次更新缓存时写入，重启后先用文件中的数据提供服务；注册中心不可用时即使没有启用 StaleWhileRevalidate 也返回其中的数据
+}
+
+// ConfigFromEnv 从环境变量 REGISTRY_ADDR、REGISTRY_NAMESPACE、REGISTRY_TOKEN、
+// REGISTRY_CACHE_FILE、REGISTRY_STALE_CACHE 读取客户端配置
+func ConfigFromEnv() ClientConfig {
+	stale, _ := strconv.ParseBool(os.Getenv(StaleCacheEnv))
+	return ClientConfig{
+		Addresses:            ParseAddresses(os.Getenv(AddrEnv)),
+		Namespace:            os.Getenv(NamespaceEnv),
+		Token:                os.Getenv(TokenEnv),
+		StaleWhileRevalidate: stale,
+		CacheFile:            os.Getenv(CacheFileEnv),
+	}
+}
+
+// withDefaults 补全没有设置的字段，没有地址时使用本机的默认端口
+func (c ClientConfig) withDefaults() ClientConfig {
+	if len(c.Addresses) == 0 {
+		c.Addresses = []string{tlsutil.Scheme() + "://localhost" + ServerPort}
+	}
+	if c.Namespace == "" {
+		c.Namespace = DefaultNamespace
+	}
+	if c.CacheExpiry <= 0 {
+		c.CacheExpiry = defaultCacheExpiry
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultTimeout
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = defaultMaxRetries
+	}
+	if c.RetryWait <= 0 {
+		c.RetryWait = defaultRetryWait
+	}
+	if c.MaxRetryWait <= 0 {
+		c.MaxRetryWait = defaultMaxRetryWait
+	}
+	return c
+}
+
+// ParseAddresses 解析以逗号分隔的注册中心地址
+// 兼容旧的 ServiceUrl 写法，末尾的 "/services" 会被去掉；没有协议的地址按当前TLS配置补全
+func ParseAddresses(s string) []string {
+	var result []string
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if !strings.Contains(addr, "://") {
+			addr = tlsutil.Scheme() + "://" + addr
+		}
+		addr = strings.TrimSuffix(strings.TrimSuffix(addr, "/"), "/services")
+		result = append(result, addr)
+	}
+	return result
+}
+
+// Configure 用 cfg 替换全局客户端，需要在第一次使用全局函数之前调用
+func Configure(cfg ClientConfig) {
+	defaultClient = NewClient(cfg)
+}
+
+// DefaultConfig 返回全局客户端的配置
+func DefaultConfig() ClientConfig {
+	return defaultClient.config
+}
+
+// AddFlags 在 fs 上注册 -registry 和 -registry-namespace 参数，解析时更新全局客户端的配置
+// 没有指定参数时使用环境变量中的配置
+func AddFlags(fs *flag.FlagSet) {
+	fs.Func("registry", "注册中心地址，多个地址以逗号分隔，默认读取环境变量 "+AddrEnv, func(s string) error {
+		addrs := ParseAddresses(s)
+		if len(addrs) == 0 {
+			return fmt.Errorf("no registry address in %q", s)
+		}
+		cfg := DefaultConfig()
+		cfg.Addresses = addrs
+		Configure(cfg)
+		return nil
+	})
+	fs.Func("registry-namespace", "访问的命名空间，默认读取环境变量 "+NamespaceEnv, func(s string) error {
+		cfg := DefaultConfig()
+		cfg.Namespace = s
+		Configure(cfg)
+		return nil
+	})
+}
+
+// ListenAddr 返回注册中心的监听地址，未设置环境变量 REGISTRY_LISTEN_ADDR 时为 ServerPort
+func ListenAddr() string {
+	if addr := os.Getenv(ListenAddrEnv); addr != "" {
+		return addr
+	}
+	return ServerPort
+}
+
+// Address 返回全局客户端当前使用的注册中心地址
+func Address() string {
+	return defaultClient.Address()
+}
+
+// Address 返回客户端当前使用的注册中心地址
+func (c *Client) Address() string {
+	return c.config.Addresses[c.current.Load()%int32(len(c.config.Addresses))]
+}
+
+// EventsURL 返回全局客户端命名空间中目录变化事件流的地址
+func EventsURL() string {
+	return defaultClient.EventsURL()
+}
+
+// EventsURL 返回客户端命名空间中目录变化事件流的地址
+func (c *Client) EventsURL() string {
+	return c.Address() + c.servicePath() + "/events"
+}
+
+// namespacePath 命名空间接口的路径前缀，默认命名空间使用不带前缀的旧接口
+func namespacePath(namespace string) string {
+	if namespace == "" || namespace == DefaultNamespace {
+		return ""
+	}
+	return "/v1/ns/" + url.PathEscape(namespace)
+}
+
+// servicePath 客户端命名空间中的服务接口路径
+func (c *Client) servicePath() string {
+	return namespacePath(c.config.Namespace) + "/services"
+}
+
+// unavailable 注册中心节点暂时无法处理请求，可以换一个地址重试
+func unavailable(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// httpClient 返回按当前TLS配置访问注册中心的 HTTP 客户端，timeout 为 0 时不设置超时
+func (c *Client) httpClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: tlsutil.Client().Transport, Timeout: timeout}
+}
+
+// do 发送一个普通请求，超时为 ClientConfig.Timeout，path 是相对于注册中心地址的路径
+func (c *Client) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	return c.send(ctx, c.httpClient(c.config.Timeout), method, path, body, nil)
+}
+
+// get 发送 GET 请求
+func (c *Client) get(ctx context.Context, path string) (*http.Response, error) {
+	return c.do(ctx, http.MethodGet, path, nil)
+}
+
+// send 发送请求，所有地址都不可用时按指数退避重试，最多重试 MaxRetries 次
+// 重试之后仍然失败时返回的错误包装了 ErrUnavailable
+func (c *Client) send(ctx context.Context, client *http.Client, method, path string, body []byte, header http.Header) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := c.tryAddresses(ctx, client, method, path, body, header)
+		if err == nil {
+			return res, nil
+		}
+		if !errors.Is(err, ErrUnavailable) || attempt >= c.config.MaxRetries {
+			return nil, err
+		}
+		wait := c.retryWait(attempt)
+		log.Printf("Registry request %s %s failed, retrying in %v: %v\n", method, path, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryWait 第 attempt 次重试前的等待时间：指数增长，不超过 MaxRetryWait，并在后一半范围内随机抖动，
+// 避免大量客户端在注册中心恢复时同时重试
+func (c *Client) retryWait(attempt int) time.Duration {
+	wait := c.config.MaxRetryWait
+	if attempt < 32 {
+		wait = min(c.config.RetryWait<<attempt, c.config.MaxRetryWait)
+	}
+	return wait/2 + rand.N(wait/2+1)
+}
+
+// tryAddresses 依次尝试每个注册中心地址，直到某个地址给出响应
+// 连接失败或返回 502/503/504 时换下一个地址，成功的地址会被记住，之后的请求优先使用它
+func (c *Client) tryAddresses(ctx context.Context, client *http.Client, method, path string, body []byte, header http.Header) (*http.Response, error) {
+	n := int32(len(c.config.Addresses))
+	start := c.current.Load()
+	var lastErr error
+	for i := int32(0); i < n; i++ {
+		k := (start + i) % n
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, c.config.Addresses[k]+path, reader)
+		if err != nil {
+			return nil, err
+		}
+		for key, v := range header {
+			req.Header[key] = v
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.config.Token != "" {
+			req.Header.Set(TokenHeader, c.config.Token)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if unavailable(res.StatusCode) {
+			res.Body.Close()
+			lastErr = fmt.Errorf("registry %s: %v", c.config.Addresses[k], res.Status)
+			continue
+		}
+		if k != start {
+			c.current.Store(k)
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("%w: %v", ErrUnavailable, lastErr)
+}
@@ -0,0 +1,67 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClientFailsOverToNextAddress(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	server := NewServer()
+	defer server.Stop()
+	live := httptest.NewServer(server)
+	defer live.Close()
+
+	// 不重试，只能靠切换地址成功
+	client := NewClient(ClientConfig{Addresses: []string{dead.URL, live.URL}, MaxRetries: -1})
+	ctx := context.Background()
+	reg := Registration{ServiceName: "Failover", ServiceUrl: "http://localhost:9100"}
+	if err := client.RegistrationService(ctx, reg); err != nil {
+		t.Fatalf("register with a dead first address: %v", err)
+	}
+	if got := client.Address(); got != live.URL {
+		t.Fatalf("client uses %s after failover, want %s", got, live.URL)
+	}
+	regs, err := client.GetServicesFresh(ctx)
+	if err != nil || len(regs) != 1 {
+		t.Fatalf("query after failover returned %v, %v", regs, err)
+	}
+}
+
+func TestClientFailsOverOnUnavailableNode(t *testing.T) {
+	var sick atomic.Int32
+	unavailableNode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sick.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailableNode.Close()
+	server := NewServer()
+	defer server.Stop()
+	live := httptest.NewServer(server)
+	defer live.Close()
+
+	client := NewClient(ClientConfig{Addresses: []string{unavailableNode.URL, live.URL}, MaxRetries: -1})
+	ctx := context.Background()
+	for range 3 {
+		if _, err := client.GetServicesFresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 切换后记住可用的地址，之后的请求不再经过返回 503 的节点
+	if got := sick.Load(); got != 1 {
+		t.Fatalf("unavailable node got %d requests, want 1", got)
+	}
+}
+
+func TestParseAddresses(t *testing.T) {
+	got := ParseAddresses(" http://10.0.0.1:3000/services, ,https://10.0.0.2:3000/,10.0.0.3:3000")
+	want := []string{"http://10.0.0.1:3000", "https://10.0.0.2:3000", "http://10.0.0.3:3000"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("ParseAddresses = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,149 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// EventType 注册中心事件类型
+type EventType string
+
+const (
+	EventRegistered    EventType = "registered"     // 新实例注册
+	EventDeregistered  EventType = "deregistered"   // 实例主动注销
+	EventUpdated       EventType = "updated"        // 已有实例重新注册
+	EventExpired       EventType = "expired"        // 实例租约过期被移除
+	EventHealthChanged EventType = "health-changed" // 实例健康状态变化
+	EventReset         EventType = "reset"          // 历史中已没有请求的事件，客户端需要重新获取全量列表
+)
+
+// Event 服务目录的一次变化，Index 就是变化后的目录修改序号
+type Event struct {
+	Index        uint64       `json:"index"`
+	Type         EventType    `json:"type"`
+	Registration Registration `json:"registration"`
+	Time         time.Time    `json:"time"`
+}
+
+const (
+	// historySize 内存中保留的最近事件数，用于 Last-Event-ID 续传
+	historySize = 1024
+	// keepAliveInterval 没有事件时发送注释行的间隔，防止连接被中间代理断开
+	keepAliveInterval = 15 * time.Second
+)
+
+// publish 目录发生变化：递增修改序号、记录事件并唤醒等待者，调用方需持有锁
+func (r *registry) publish(t EventType, reg Registration, at time.Time) uint64 {
+	index := r.bumpIndex()
+	r.history = append(r.history, Event{Index: index, Type: t, Registration: reg, Time: at})
+	if len(r.history) > historySize {
+		r.history = append(r.history[:0], r.history[len(r.history)-historySize:]...)
+	}
+	return index
+}
+
+// eventsSince 返回修改序号大于 index 的事件
+// 历史中已经缺失这些事件（或注册中心重启导致序号变小）时 reset 为 true
+func (r *registry) eventsSince(index uint64) (events []Event, reset bool, current uint64, changed chan struct{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	current, changed = r.index, r.changed
+	if index > current {
+		return nil, true, current, changed
+	}
+	if index == current {
+		return nil, false, current, changed
+	}
+	if len(r.history) == 0 || r.history[0].Index > index+1 {
+		return nil, true, current, changed
+	}
+	for _, ev := range r.history {
+		if ev.Index > index {
+			events = append(events, ev)
+		}
+	}
+	return events, false, current, changed
+}
+
+// serveEvents 以 Server-Sent Events 推送目录变化
+//
+// 客户端可以通过 Last-Event-ID 请求头或 ?index= 参数从某个序号之后续传，
+// 都没有时只推送连接之后的新事件。?service= 参数只推送指定服务的事件，
+// 只推送所访问命名空间中的事件。
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	token, ok := s.requestACL(w, r)
+	if !ok {
+		return
+	}
+
+	last := s.reg.currentIndex()
+	from := r.Header.Get("Last-Event-ID")
+	if from == "" {
+		from = r.URL.Query().Get("index")
+	}
+	if from != "" {
+		n, err := strconv.ParseUint(from, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid event index")
+			return
+		}
+		last = n
+	}
+	service := ServiceName(r.URL.Query().Get("service"))
+	ns := namespaceOf(r)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		events, reset, current, changed := s.reg.eventsSince(last)
+		if reset {
+			events = []Event{{Index: current, Type: EventReset, Time: time.Now()}}
+		}
+		for _, ev := range events {
+			if ev.Type != EventReset && (!inNamespace(ev.Registration, ns) || service != "" && ev.Registration.ServiceName != service ||
+				!token.allows(aclRead, registrationNamespace(ev.Registration), ev.Registration.ServiceName)) {
+				continue
+			}
+			if err := writeEvent(w, ev); err != nil {
+				return
+			}
+		}
+		last = current
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent 按 SSE 格式写出一个事件
+func writeEvent(w http.ResponseWriter, ev Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Index, ev.Type, data)
+	return err
+}
@@ -0,0 +1,190 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	walFileName      = "registry.wal"
+	snapshotFileName = "registry.snapshot"
+)
+
+// FileStorage 基于文件的存储：追加写的预写日志加定期快照
+//
+// 日志每行一条操作，格式为 "<crc32> <json>"。进程在写入中途崩溃时，
+// 最后一行可能不完整或校验失败，Load 会从该行截断日志并丢弃它。
+// 快照先写入临时文件再重命名，保证任何时刻磁盘上都是一个完整的快照。
+type FileStorage struct {
+	dir   string
+	wal   *os.File
+	mutex sync.Mutex
+}
+
+// NewFileStorage 在 dir 目录下打开（或创建）文件存储
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir, wal: wal}, nil
+}
+
+// Load 读取快照和快照之后的日志，并截断日志末尾损坏的记录
+func (s *FileStorage) Load() (Snapshot, []Operation, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var snap Snapshot
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return snap, nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return snap, nil, fmt.Errorf("corrupt snapshot: %v", err)
+		}
+	}
+
+	if _, err := s.wal.Seek(0, io.SeekStart); err != nil {
+		return snap, nil, err
+	}
+	var ops []Operation
+	var offset int64
+	reader := bufio.NewReader(s.wal)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Discarding incomplete WAL record at offset %d\n", offset)
+			}
+			break
+		}
+		if err != nil {
+			return snap, nil, err
+		}
+		op, ok := decodeRecord(line)
+		if !ok {
+			log.Printf("Discarding corrupt WAL record at offset %d\n", offset)
+			break
+		}
+		offset += int64(len(line))
+		if op.Seq > snap.Seq {
+			ops = append(ops, op)
+		}
+	}
+
+	// 丢弃损坏的尾部，后续追加从最后一条完整记录之后开始
+	if err := s.wal.Truncate(offset); err != nil {
+		return snap, nil, err
+	}
+	if _, err := s.wal.Seek(offset, io.SeekStart); err != nil {
+		return snap, nil, err
+	}
+	return snap, ops, nil
+}
+
+// Append 追加一条操作并同步到磁盘
+func (s *FileStorage) Append(op Operation) error {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)
+	if _, err := s.wal.WriteString(record); err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+// SaveSnapshot 原子地替换快照，然后清空日志
+func (s *FileStorage) SaveSnapshot(snap Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tmp := filepath.Join(s.dir, snapshotFileName+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, snapshotFileName)); err != nil {
+		return err
+	}
+	syncDir(s.dir)
+
+	// 在这里崩溃也没关系：重放时会跳过序号不大于快照的记录
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+// Close 关闭日志文件
+func (s *FileStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.wal.Close()
+}
+
+// decodeRecord 解析并校验一行日志记录
+func decodeRecord(line []byte) (Operation, bool) {
+	var op Operation
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	sum, data, found := bytes.Cut(line, []byte(" "))
+	if !found {
+		return op, false
+	}
+	var crc uint32
+	if _, err := fmt.Sscanf(string(sum), "%08x", &crc); err != nil {
+		return op, false
+	}
+	if crc32.ChecksumIEEE(data) != crc {
+		return op, false
+	}
+	if err := json.Unmarshal(data, &op); err != nil {
+		return op, false
+	}
+	return op, true
+}
+
+// syncDir 同步目录，保证重命名已持久化
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	d.Sync()
+}
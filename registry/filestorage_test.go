@@ -0,0 +1,282 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// openStorage 打开 dir 下的文件存储，测试结束时关闭
+func openStorage(t *testing.T, dir string) *FileStorage {
+	t.Helper()
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// addOp 注册实例 id 的操作
+func addOp(seq uint64, id string) Operation {
+	return Operation{
+		Seq:          seq,
+		Type:         OpAdd,
+		Registration: &Registration{ServiceName: "TestService", ServiceUrl: "http://" + id, InstanceID: id},
+		Time:         time.Now(),
+	}
+}
+
+// appendOps 追加序号为 from 到 to 的注册操作
+func appendOps(t *testing.T, s *FileStorage, from, to uint64) {
+	t.Helper()
+	for seq := from; seq <= to; seq++ {
+		if err := s.Append(addOp(seq, "i"+strconv.FormatUint(seq, 10))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// loadSeqs 重新打开存储并返回快照序号和重放的操作序号
+func loadSeqs(t *testing.T, dir string) (uint64, []uint64) {
+	t.Helper()
+	snap, ops, err := openStorage(t, dir).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqs := make([]uint64, len(ops))
+	for i, op := range ops {
+		seqs[i] = op.Seq
+	}
+	return snap.Seq, seqs
+}
+
+// checkSeqs 检查操作序号从 from 开始连续递增，共 n 条
+func checkSeqs(t *testing.T, seqs []uint64, from uint64, n int) {
+	t.Helper()
+	if len(seqs) != n {
+		t.Fatalf("replayed %d operations %v, want %d", len(seqs), seqs, n)
+	}
+	for i, seq := range seqs {
+		if seq != from+uint64(i) {
+			t.Fatalf("operation %d has seq %d, want %d (replayed %v)", i, seq, from+uint64(i), seqs)
+		}
+	}
+}
+
+func TestFileStorageReplayOrder(t *testing.T) {
+	dir := t.TempDir()
+	s := openStorage(t, dir)
+	if _, _, err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	appendOps(t, s, 1, 50)
+	s.Close()
+
+	snapSeq, seqs := loadSeqs(t, dir)
+	if snapSeq != 0 {
+		t.Fatalf("snapshot seq = %d, want 0", snapSeq)
+	}
+	checkSeqs(t, seqs, 1, 50)
+}
+
+func TestFileStorageTornLastRecord(t *testing.T) {
+	dir := t.TempDir()
+	s := openStorage(t, dir)
+	appendOps(t, s, 1, 3)
+	s.Close()
+
+	// 进程在写第 4 条记录时崩溃，只写入了一半
+	wal := filepath.Join(dir, walFileName)
+	good, err := os.ReadFile(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(addOp(4, "i4"))
+	f, err := os.OpenFile(wal, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("0badc0de " + string(data[:len(data)/2])))
+	f.Close()
+
+	s = openStorage(t, dir)
+	_, ops, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 3 {
+		t.Fatalf("replayed %d operations, want 3", len(ops))
+	}
+	// 损坏的尾部被截断，之后的追加从完整记录之后开始
+	if info, _ := os.Stat(wal); info.Size() != int64(len(good)) {
+		t.Fatalf("WAL size after recovery = %d, want %d", info.Size(), len(good))
+	}
+	appendOps(t, s, 4, 5)
+	s.Close()
+
+	_, seqs := loadSeqs(t, dir)
+	checkSeqs(t, seqs, 1, 5)
+}
+
+func TestFileStorageBadCRC(t *testing.T) {
+	dir := t.TempDir()
+	s := openStorage(t, dir)
+	appendOps(t, s, 1, 3)
+	s.Close()
+
+	// 最后一条记录的内容被改动，校验和不再匹配
+	wal := filepath.Join(dir, walFileName)
+	data, err := os.ReadFile(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-3] ^= 0x01
+	if err := os.WriteFile(wal, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, seqs := loadSeqs(t, dir)
+	checkSeqs(t, seqs, 1, 2)
+}
+
+func TestFileStorageSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	s := openStorage(t, dir)
+	appendOps(t, s, 1, 5)
+	regs := make([]Registration, 0, 5)
+	for seq := uint64(1); seq <= 5; seq++ {
+		regs = append(regs, *addOp(seq, "i"+strconv.FormatUint(seq, 10)).Registration)
+	}
+	if err := s.SaveSnapshot(Snapshot{Seq: 5, Registrations: regs}); err != nil {
+		t.Fatal(err)
+	}
+	appendOps(t, s, 6, 7)
+	s.Close()
+
+	// 快照之前的操作已经丢弃，只重放快照之后的操作
+	s = openStorage(t, dir)
+	snap, ops, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Seq != 5 || len(snap.Registrations) != 5 {
+		t.Fatalf("snapshot seq = %d with %d registrations, want 5 and 5", snap.Seq, len(snap.Registrations))
+	}
+	if len(ops) != 2 || ops[0].Seq != 6 || ops[1].Seq != 7 {
+		t.Fatalf("replayed %+v, want seq 6 and 7", ops)
+	}
+}
+
+func TestFileStorageCrashBetweenSnapshotAndTruncate(t *testing.T) {
+	dir := t.TempDir()
+	s := openStorage(t, dir)
+	appendOps(t, s, 1, 5)
+	s.Close()
+
+	// 快照已经重命名到位，但进程在清空日志之前崩溃：日志中还有快照包含的操作
+	r := newRegistry()
+	for seq := uint64(1); seq <= 3; seq++ {
+		r.apply(addOp(seq, "i"+strconv.FormatUint(seq, 10)))
+	}
+	data, err := json.Marshal(Snapshot{Seq: r.seq, Index: r.index, Registrations: r.registrations})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, snapshotFileName), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	snapSeq, seqs := loadSeqs(t, dir)
+	if snapSeq != 3 {
+		t.Fatalf("snapshot seq = %d, want 3", snapSeq)
+	}
+	checkSeqs(t, seqs, 4, 2)
+
+	// 注册中心恢复后每个实例只出现一次
+	recovered := newRegistry()
+	if err := recovered.load(openStorage(t, dir)); err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.stopAllChecks()
+	regs := recovered.getRegistrations(DefaultNamespace)
+	if len(regs) != 5 {
+		t.Fatalf("recovered %d registrations, want 5", len(regs))
+	}
+	if recovered.seq != 5 {
+		t.Fatalf("recovered seq = %d, want 5", recovered.seq)
+	}
+}
+
+// TestFileStorageKillHelper 在子进程中运行，不停追加操作直到被杀死
+func TestFileStorageKillHelper(t *testing.T) {
+	dir := os.Getenv("REGISTRY_TEST_WAL_DIR")
+	if dir == "" {
+		t.Skip("only runs as a subprocess of TestFileStorageKillMidWrite")
+	}
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "started"), nil, 0600)
+	for seq := uint64(1); ; seq++ {
+		op := addOp(seq, "i"+strconv.FormatUint(seq, 10))
+		// 大的元数据让一条记录需要多次写入，增加在写入中途被杀死的机会
+		op.Registration.Metadata = map[string]string{"padding": string(make([]byte, 64*1024))}
+		if err := s.Append(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileStorageKillMidWrite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a subprocess")
+	}
+	for round := 0; round < 3; round++ {
+		dir := t.TempDir()
+		ctx, cancel := context.WithCancel(context.Background())
+		cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestFileStorageKillHelper$")
+		cmd.Env = append(os.Environ(), "REGISTRY_TEST_WAL_DIR="+dir)
+		if err := cmd.Start(); err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if _, err := os.Stat(filepath.Join(dir, "started")); err == nil || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(time.Duration(50+round*50) * time.Millisecond)
+		// CommandContext 取消时发送 SIGKILL
+		cancel()
+		cmd.Wait()
+
+		_, seqs := loadSeqs(t, dir)
+		if len(seqs) == 0 {
+			t.Fatalf("round %d: no operations survived", round)
+		}
+		checkSeqs(t, seqs, 1, len(seqs))
+
+		// 恢复之后可以继续追加
+		s := openStorage(t, dir)
+		if _, _, err := s.Load(); err != nil {
+			t.Fatal(err)
+		}
+		next := uint64(len(seqs)) + 1
+		appendOps(t, s, next, next)
+		s.Close()
+		_, seqs = loadSeqs(t, dir)
+		checkSeqs(t, seqs, 1, int(next))
+	}
+}
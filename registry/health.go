@@ -0,0 +1,244 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/linshule/go-distributed/tlsutil"
+)
+
+// startChecks 重置实例的检查状态并启动它的检查，替换之前的检查，调用方需持有锁
+// 检查在第一次执行之前都是 critical，now 是注册生效的时间
+func (r *registry) startChecks(reg *Registration, now time.Time) {
+	r.stopChecks(reg.InstanceID)
+
+	reg.Health = make([]CheckStatus, 0, len(reg.Checks))
+	for _, c := range reg.Checks {
+		reg.Health = append(reg.Health, CheckStatus{
+			CheckID:       c.ID,
+			Name:          c.Name,
+			Status:        HealthCritical,
+			Output:        "not checked yet",
+			CriticalSince: now,
+		})
+	}
+	reg.Status = aggregateStatus(reg.Health)
+	if len(reg.Checks) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.checks[reg.InstanceID] = cancel
+	for _, c := range reg.Checks {
+		go r.runCheck(ctx, reg.InstanceID, c)
+	}
+}
+
+// stopChecks 停止实例的所有检查，调用方需持有锁
+func (r *registry) stopChecks(instanceID string) {
+	if cancel, ok := r.checks[instanceID]; ok {
+		cancel()
+		delete(r.checks, instanceID)
+	}
+}
+
+// stopAllChecks 停止所有实例的检查
+func (r *registry) stopAllChecks() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for id := range r.checks {
+		r.stopChecks(id)
+	}
+}
+
+// runCheck 按间隔执行一个检查，直到实例被注销或重新注册
+// 集群模式下只有 Leader 执行检查，与心跳和租约回收保持一致
+func (r *registry) runCheck(ctx context.Context, instanceID string, c CheckDefinition) {
+	ticker := time.NewTicker(c.interval())
+	defer ticker.Stop()
+	for {
+		if r.isLeader() {
+			switch c.Type {
+			case CheckHTTP:
+				status, output := probeHTTP(ctx, c)
+				r.updateCheck(instanceID, c.ID, status, output)
+			case CheckTCP:
+				status, output := probeTCP(ctx, c)
+				r.updateCheck(instanceID, c.ID, status, output)
+			case CheckTTL:
+				r.checkTTL(instanceID, c)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// errNotFound 实例或检查不存在
+var errNotFound = errors.New("not found")
+
+// updateCheck 记录一个检查的结果
+// 集群模式下状态变化经过 Raft 复制，每个节点按相同的顺序更新状态并发布 health-changed 事件，
+// 服务目录的修改序号在各节点保持一致；状态没有变化时只在本节点（Leader）更新输出和检查时间
+func (r *registry) updateCheck(instanceID, checkID string, status HealthStatus, output string) error {
+	r.mutex.Lock()
+	if r.checks[instanceID] == nil {
+		// 检查已经停止，结果作废
+		r.mutex.Unlock()
+		return fmt.Errorf("Service instance %s %w", instanceID, errNotFound)
+	}
+	i, j := r.checkIndex(instanceID, checkID)
+	if j < 0 {
+		r.mutex.Unlock()
+		return fmt.Errorf("Check %s of instance %s %w", checkID, instanceID, errNotFound)
+	}
+	if r.node != nil && r.registrations[i].Health[j].Status != status {
+		r.mutex.Unlock()
+		return r.submit(Operation{
+			Type:       OpCheck,
+			InstanceID: instanceID,
+			Check:      &CheckResult{CheckID: checkID, Status: status, Output: output},
+		})
+	}
+	r.setCheck(i, j, status, output, time.Now())
+	r.maybeDeregister(i, j)
+	r.mutex.Unlock()
+	return nil
+}
+
+// checkTTL TTL检查超过期限没有上报时置为 critical
+func (r *registry) checkTTL(instanceID string, c CheckDefinition) {
+	r.mutex.Lock()
+	i, j := r.checkIndex(instanceID, c.ID)
+	if j < 0 {
+		r.mutex.Unlock()
+		return
+	}
+	st := r.registrations[i].Health[j]
+	if st.LastChecked.IsZero() || time.Since(st.LastChecked) <= c.ttl() {
+		r.maybeDeregister(i, j)
+		r.mutex.Unlock()
+		return
+	}
+	r.mutex.Unlock()
+	r.updateCheck(instanceID, c.ID, HealthCritical, fmt.Sprintf("TTL expired, last update %v ago", time.Since(st.LastChecked).Round(time.Second)))
+}
+
+// checkIndex 返回实例和检查的位置，找不到时为 -1，调用方需持有锁
+func (r *registry) checkIndex(instanceID, checkID string) (int, int) {
+	i := r.indexOf(instanceID)
+	if i < 0 {
+		return -1, -1
+	}
+	for j, st := range r.registrations[i].Health {
+		if st.CheckID == checkID {
+			return i, j
+		}
+	}
+	return i, -1
+}
+
+// setCheck 更新检查状态，实例的汇总状态变化时发布 health-changed 事件，调用方需持有锁
+// now 是检查的时间，复制过来的结果使用操作中的时间，各节点记录的时间相同
+func (r *registry) setCheck(i, j int, status HealthStatus, output string, now time.Time) {
+	reg := &r.registrations[i]
+	st := &reg.Health[j]
+	if status == HealthCritical {
+		if st.Status != HealthCritical || st.CriticalSince.IsZero() {
+			st.CriticalSince = now
+		}
+	} else {
+		st.CriticalSince = time.Time{}
+	}
+	st.Status = status
+	st.Output = output
+	st.LastChecked = now
+
+	prev := reg.Status
+	reg.Status = aggregateStatus(reg.Health)
+	if reg.Status != prev {
+		log.Printf("Service %v (instance %s) is now %s: %s\n", reg.ServiceName, reg.InstanceID, reg.Status, output)
+		reg.ModifyIndex = r.publish(EventHealthChanged, *reg, now)
+	}
+}
+
+// maybeDeregister 检查持续 critical 超过 DeregisterCriticalAfter 时注销实例，调用方需持有锁
+func (r *registry) maybeDeregister(i, j int) {
+	reg := &r.registrations[i]
+	st := reg.Health[j]
+	if st.Status != HealthCritical {
+		return
+	}
+	for _, c := range reg.Checks {
+		after := c.deregisterAfter()
+		if c.ID == st.CheckID && after > 0 && time.Since(st.CriticalSince) > after {
+			// 提交注销需要重新获取锁，交给另一个 goroutine
+			r.stopChecks(reg.InstanceID)
+			go r.deregisterCritical(reg.InstanceID, c.ID)
+			return
+		}
+	}
+}
+
+// deregisterCritical 注销持续失败的实例
+func (r *registry) deregisterCritical(instanceID, checkID string) {
+	log.Printf("Check %s has been critical too long, removing instance %s\n", checkID, instanceID)
+	if err := r.submit(Operation{Type: OpExpire, InstanceID: instanceID}); err != nil {
+		log.Println(err)
+	}
+}
+
+// probeHTTP 执行HTTP检查：状态码符合期望为 passing，429 为 warning，其他为 critical
+func probeHTTP(ctx context.Context, c CheckDefinition) (HealthStatus, string) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+	method := c.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.HTTP, nil)
+	if err != nil {
+		return HealthCritical, err.Error()
+	}
+	resp, err := tlsutil.Client().Do(req)
+	if err != nil {
+		return HealthCritical, err.Error()
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	output := fmt.Sprintf("HTTP %s %s: %s", method, c.HTTP, resp.Status)
+	switch {
+	case c.ExpectedStatus != 0 && resp.StatusCode != c.ExpectedStatus:
+		return HealthCritical, fmt.Sprintf("%s, expected %d", output, c.ExpectedStatus)
+	case c.ExpectedStatus == 0 && resp.StatusCode == http.StatusTooManyRequests:
+		return HealthWarning, output
+	case c.ExpectedStatus == 0 && (resp.StatusCode < 200 || resp.StatusCode >= 300):
+		return HealthCritical, output
+	}
+	if c.ExpectedBody != "" && !strings.Contains(string(body), c.ExpectedBody) {
+		return HealthCritical, fmt.Sprintf("%s, body does not contain %q", output, c.ExpectedBody)
+	}
+	return HealthPassing, output
+}
+
+// probeTCP 执行TCP检查：能建立连接即为 passing
+func probeTCP(ctx context.Context, c CheckDefinition) (HealthStatus, string) {
+	dialer := net.Dialer{Timeout: c.timeout()}
+	conn, err := dialer.DialContext(ctx, "tcp", c.TCP)
+	if err != nil {
+		return HealthCritical, err.Error()
+	}
+	conn.Close()
+	return HealthPassing, fmt.Sprintf("TCP connect %s: success", c.TCP)
+}
@@ -0,0 +1,65 @@
+package registry
+
+import (
+	"net/http"
+)
+
+const (
+	// DefaultNamespace 没有指定命名空间的实例属于默认命名空间，旧的 /services 接口只访问它
+	DefaultNamespace = "default"
+	// AllNamespaces 只用于查询，表示跨所有命名空间查找
+	AllNamespaces = "*"
+
+	maxNamespaceLength = 63
+)
+
+// ValidNamespace 命名空间名称是否合法：1 到 63 个字母、数字、'-' 或 '_'
+func ValidNamespace(ns string) bool {
+	if ns == "" || len(ns) > maxNamespaceLength {
+		return false
+	}
+	for _, c := range ns {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// inNamespace 实例是否属于命名空间 ns，引入命名空间之前保存的实例属于默认命名空间
+func inNamespace(reg Registration, ns string) bool {
+	if ns == AllNamespaces {
+		return true
+	}
+	if reg.Namespace == "" {
+		return ns == DefaultNamespace
+	}
+	return reg.Namespace == ns
+}
+
+// namespaceOf 返回请求访问的命名空间，旧接口没有 {ns} 路径参数，访问默认命名空间
+func namespaceOf(r *http.Request) string {
+	if ns := r.PathValue("ns"); ns != "" {
+		return ns
+	}
+	return DefaultNamespace
+}
+
+// scoped 校验 /v1/ns/{ns} 路径中的命名空间，"*" 只能用于查询
+func scoped(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ns := r.PathValue("ns")
+		if ns == AllNamespaces {
+			if r.Method != http.MethodGet {
+				writeError(w, http.StatusBadRequest, "namespace * can only be used for queries")
+				return
+			}
+		} else if !ValidNamespace(ns) {
+			writeError(w, http.StatusBadRequest, "invalid namespace: "+ns)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -1,16 +1,40 @@
 package registry
 
-import "time"
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+)
 
 // Registration 服务注册信息
 type Registration struct {
-	ServiceName    ServiceName            `json:"serviceName"`     // 服务名称
-	ServiceUrl     string                 `json:"serviceUrl"`      // 服务URL
-	ServiceVersion string                 `json:"serviceVersion"`  // 服务版本
-	Metadata       map[string]string      `json:"metadata"`       // 服务元数据
-	Tags           []string               `json:"tags"`            // 服务标签
-	HealthCheckURL string                 `json:"healthCheckUrl"`   // 健康检查URL
-	RegisteredAt   time.Time              `json:"registeredAt"`    // 注册时间
+	InstanceID     string            `json:"instanceId"`             // 实例ID，同名服务的多个实例以此区分
+	Namespace      string            `json:"namespace,omitempty"`    // 命名空间，为空表示默认命名空间
+	ServiceName    ServiceName       `json:"serviceName"`            // 服务名称
+	ServiceUrl     string            `json:"serviceUrl"`             // 服务URL
+	ServiceVersion string            `json:"serviceVersion"`         // 服务版本
+	Metadata       map[string]string `json:"metadata"`               // 服务元数据
+	Tags           []string          `json:"tags"`                   // 服务标签
+	Dependencies   []ServiceName     `json:"dependencies,omitempty"` // 启动时需要等待就绪的其他服务
+	HealthCheckURL string            `json:"healthCheckUrl"`         // 健康检查URL
+	RegisteredAt   time.Time         `json:"registeredAt"`           // 注册时间
+	LeaseTTL       int               `json:"leaseTtl"`               // 租约时长（秒），0 表示使用默认值
+	LastHeartbeat  time.Time         `json:"lastHeartbeat"`          // 最后一次心跳时间
+	ModifyIndex    uint64            `json:"modifyIndex"`            // 最后一次修改时的目录序号
+	Checks         []CheckDefinition `json:"checks,omitempty"`       // 健康检查定义
+	Status         HealthStatus      `json:"status,omitempty"`       // 汇总健康状态，由注册中心维护
+	Health         []CheckStatus     `json:"health,omitempty"`       // 每个检查的最新结果，由注册中心维护
+}
+
+// DefaultLeaseTTL 默认租约时长，超过该时长没有心跳的实例会被注册中心移除
+const DefaultLeaseTTL = 30 * time.Second
+
+// Lease 返回实例的租约时长
+func (r Registration) Lease() time.Duration {
+	if r.LeaseTTL <= 0 {
+		return DefaultLeaseTTL
+	}
+	return time.Duration(r.LeaseTTL) * time.Second
 }
 
 // ServiceName 服务名称类型
@@ -19,8 +43,27 @@ type ServiceName string
 // 预定义的服务名称常量
 const (
 	LogService      = ServiceName("LogService")
-	LibraryService = ServiceName("LibraryService")
+	LibraryService  = ServiceName("LibraryService")
 	ProviderService = ServiceName("ProviderService")
-	WebService     = ServiceName("WebService")
-	MonitorService = ServiceName("MonitorService")
+	WebService      = ServiceName("WebService")
+	MonitorService  = ServiceName("MonitorService")
 )
+
+// NewInstanceID 根据服务名称和URL生成实例ID
+// 同一名称和URL总是得到相同的ID，因此重复注册会覆盖旧的实例而不是产生重复
+func NewInstanceID(serviceName ServiceName, serviceUrl string) string {
+	h := fnv.New64a()
+	h.Write([]byte(serviceUrl))
+	return fmt.Sprintf("%s-%016x", serviceName, h.Sum64())
+}
+
+// NewInstanceIDIn 生成命名空间 namespace 中的实例ID
+// 默认命名空间与 NewInstanceID 相同，其他命名空间加上 "{namespace}." 前缀，
+// 因此不同环境中使用相同URL的实例不会互相覆盖
+func NewInstanceIDIn(namespace string, serviceName ServiceName, serviceUrl string) string {
+	id := NewInstanceID(serviceName, serviceUrl)
+	if namespace == "" || namespace == DefaultNamespace {
+		return id
+	}
+	return namespace + "." + id
+}
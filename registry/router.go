@@ -0,0 +1,339 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/linshule/go-distributed/tlsutil"
+)
+
+// router 注册中心API的路由表
+//
+//	GET    /health                          注册中心健康检查
+//	GET    /health/{name}                   服务健康检查
+//	GET    /services                        获取所有服务（支持 index/wait/passing）
+//	POST   /services                        注册服务
+//	DELETE /services                        注销服务，请求体为实例ID或服务URL（兼容旧客户端）
+//	DELETE /services/{id}                   注销服务
+//	GET    /services/events                 目录变化事件流
+//	GET    /services/tag/{tag}              按标签查询服务
+//	GET    /services/{name}                 按名称查询服务
+//	PUT    /services/{id}/heartbeat         实例心跳续约
+//	PUT    /services/{id}/checks/{check}    上报TTL检查状态
+//	GET    /v1/acl/tokens                   列出ACL令牌
+//	POST   /v1/acl/tokens                   创建ACL令牌
+//	GET    /v1/acl/tokens/{accessor}        查看ACL令牌
+//	PUT    /v1/acl/tokens/{accessor}        修改ACL令牌
+//	DELETE /v1/acl/tokens/{accessor}        删除ACL令牌
+//	GET    /v1/acl/token/self               查看请求所用令牌的权限
+//
+// 除 GET /health 外，每个接口都有一个带命名空间的版本 /v1/ns/{ns}/...，
+// 例如 GET /v1/ns/dev/services/LogService。不带前缀的旧接口访问默认命名空间，
+// 查询接口的 {ns} 可以是 "*"，表示跨所有命名空间查找
+func (s *Server) newRouter() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", s.handleRegistryHealth)
+	mux.HandleFunc("GET /v1/acl/tokens", s.handleListTokens)
+	mux.HandleFunc("POST /v1/acl/tokens", s.handleCreateToken)
+	mux.HandleFunc("GET /v1/acl/tokens/{accessor}", s.handleGetToken)
+	mux.HandleFunc("PUT /v1/acl/tokens/{accessor}", s.handleUpdateToken)
+	mux.HandleFunc("DELETE /v1/acl/tokens/{accessor}", s.handleDeleteToken)
+	mux.HandleFunc("GET /v1/acl/token/self", s.handleTokenSelf)
+
+	routes := []struct {
+		pattern string
+		handler http.HandlerFunc
+	}{
+		{"GET /health/{name}", s.handleServiceHealth},
+		{"GET /services", s.handleListServices},
+		{"GET /services/{$}", s.handleListServices},
+		{"POST /services", s.handleRegister},
+		{"DELETE /services", s.handleDeregisterBody},
+		{"DELETE /services/{id}", s.handleDeregister},
+		{"GET /services/events", s.serveEvents},
+		{"GET /services/tag/{tag}", s.handleFindByTag},
+		{"GET /services/{name}", s.handleFindByName},
+		{"PUT /services/{id}/heartbeat", s.handleHeartbeat},
+		{"PUT /services/{id}/checks/{check}", s.handleCheckUpdate},
+	}
+	for _, route := range routes {
+		method, path, _ := strings.Cut(route.pattern, " ")
+		mux.HandleFunc(route.pattern, route.handler)
+		mux.HandleFunc(method+" /v1/ns/{ns}"+path, scoped(route.handler))
+	}
+	return mux
+}
+
+// serveRoute 分发请求；没有匹配的路由时，把 ServeMux 生成的 404/405 改写成JSON错误
+func (s *Server) serveRoute(w http.ResponseWriter, r *http.Request) {
+	if _, pattern := s.router.Handler(r); pattern != "" {
+		s.router.ServeHTTP(w, r)
+		return
+	}
+	h, _ := s.router.Handler(r)
+	rec := &statusRecorder{header: w.Header()}
+	h.ServeHTTP(rec, r)
+	writeError(w, rec.status, strings.ToLower(http.StatusText(rec.status)))
+}
+
+// statusRecorder 只记录状态码，丢弃响应体
+type statusRecorder struct {
+	header http.Header
+	status int
+}
+
+func (s *statusRecorder) Header() http.Header         { return s.header }
+func (s *statusRecorder) Write(b []byte) (int, error) { return len(b), nil }
+func (s *statusRecorder) WriteHeader(status int)      { s.status = status }
+
+// checkIdentity 请求方出示了客户端证书时，证书中的服务名称必须与所操作的服务一致，否则写出 403
+func checkIdentity(w http.ResponseWriter, r *http.Request, name ServiceName) bool {
+	identity := tlsutil.PeerIdentity(r)
+	if identity == "" || identity == string(name) {
+		return true
+	}
+	log.Printf("Rejected %s %s: client certificate is for %s, not %s\n", r.Method, r.URL.Path, identity, name)
+	writeError(w, http.StatusForbidden, "client certificate is for "+identity+", not "+string(name))
+	return false
+}
+
+// writeJSON 写出JSON响应
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError 写出统一格式的错误响应 {"error": "..."}
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{
+		"error": msg,
+	})
+}
+
+// handleRegistryHealth 注册中心自身的健康检查
+func (s *Server) handleRegistryHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"status": "ok",
+		"time":   time.Now().Format(time.RFC3339),
+	})
+}
+
+// handleServiceHealth 服务健康检查
+func (s *Server) handleServiceHealth(w http.ResponseWriter, r *http.Request) {
+	serviceName := r.PathValue("name")
+	if !s.authorize(w, r, aclRead, namespaceOf(r), ServiceName(serviceName)) {
+		return
+	}
+	healthy, latency := s.reg.healthCheck(r.Context(), namespaceOf(r), ServiceName(serviceName))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"serviceName": serviceName,
+		"healthy":     healthy,
+		"latency":     latency,
+	})
+}
+
+// handleListServices 获取所有服务
+func (s *Server) handleListServices(w http.ResponseWriter, r *http.Request) {
+	token, ok := s.requestACL(w, r)
+	if !ok || !s.blockingQuery(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, filterQuery(r, token.readable(s.reg.getRegistrations(namespaceOf(r)))))
+}
+
+// handleFindByName 按名称查询服务
+func (s *Server) handleFindByName(w http.ResponseWriter, r *http.Request) {
+	token, ok := s.requestACL(w, r)
+	if !ok || !s.blockingQuery(w, r) {
+		return
+	}
+	regs := token.readable(s.reg.findByName(namespaceOf(r), ServiceName(r.PathValue("name"))))
+	if len(regs) == 0 {
+		writeError(w, http.StatusNotFound, "service not found")
+		return
+	}
+	regs = filterQuery(r, regs)
+	if len(regs) == 0 {
+		writeError(w, http.StatusNotFound, "no passing instance")
+		return
+	}
+	writeJSON(w, http.StatusOK, regs)
+}
+
+// handleFindByTag 按标签查询服务
+func (s *Server) handleFindByTag(w http.ResponseWriter, r *http.Request) {
+	token, ok := s.requestACL(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, filterQuery(r, token.readable(s.reg.findByTag(namespaceOf(r), r.PathValue("tag")))))
+}
+
+// handleRegister 注册服务
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var regData Registration
+	err := json.NewDecoder(r.Body).Decode(&regData)
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusBadRequest, "invalid registration: "+err.Error())
+		return
+	}
+	if regData.ServiceName == "" || regData.ServiceUrl == "" {
+		writeError(w, http.StatusBadRequest, "serviceName and serviceUrl are required")
+		return
+	}
+	// 带命名空间的接口以路径为准，旧接口以请求体为准，都没有时属于默认命名空间
+	if ns := r.PathValue("ns"); ns != "" {
+		if regData.Namespace != "" && regData.Namespace != ns {
+			writeError(w, http.StatusBadRequest, "namespace in body does not match path")
+			return
+		}
+		regData.Namespace = ns
+	}
+	if regData.Namespace == "" {
+		regData.Namespace = DefaultNamespace
+	}
+	if !ValidNamespace(regData.Namespace) {
+		writeError(w, http.StatusBadRequest, "invalid namespace: "+regData.Namespace)
+		return
+	}
+	if !s.authorize(w, r, aclRegister, regData.Namespace, regData.ServiceName) || !checkIdentity(w, r, regData.ServiceName) {
+		return
+	}
+	for _, c := range regData.Checks {
+		if err := c.Validate(); err != nil {
+			log.Println(err)
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	// 健康状态由注册中心维护，忽略客户端传入的值
+	regData.Status = ""
+	regData.Health = nil
+	// 设置注册时间，注册本身也算一次心跳
+	regData.RegisteredAt = time.Now()
+	regData.LastHeartbeat = regData.RegisteredAt
+	if regData.InstanceID == "" {
+		regData.InstanceID = NewInstanceIDIn(regData.Namespace, regData.ServiceName, regData.ServiceUrl)
+	}
+	log.Printf("Adding service: %v with URL: %s (instance %s, namespace %s)\n", regData.ServiceName, regData.ServiceUrl, regData.InstanceID, regData.Namespace)
+	err = s.reg.add(regData)
+	if err != nil {
+		log.Println(err)
+		status := clusterError(err)
+		if errors.Is(err, errConflict) {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleDeregisterBody 注销服务，实例ID（或服务URL）在请求体中
+func (s *Server) handleDeregisterBody(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.deregister(w, r, string(payload))
+}
+
+// handleDeregister 注销服务，实例ID在路径中
+func (s *Server) handleDeregister(w http.ResponseWriter, r *http.Request) {
+	s.deregister(w, r, r.PathValue("id"))
+}
+
+func (s *Server) deregister(w http.ResponseWriter, r *http.Request, id string) {
+	ns := namespaceOf(r)
+	log.Printf("Removing service instance: %s (namespace %s)\n", id, ns)
+	instance, ok := s.reg.get(ns, id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "service instance not found")
+		return
+	}
+	if !s.authorize(w, r, aclDeregister, ns, instance.ServiceName) || !checkIdentity(w, r, instance.ServiceName) {
+		return
+	}
+	if err := s.reg.remove(ns, id); err != nil {
+		log.Println(err)
+		writeError(w, clusterError(err), err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleHeartbeat 实例心跳续约
+func (s *Server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	ns, id := namespaceOf(r), r.PathValue("id")
+	instance, ok := s.reg.get(ns, id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "service instance not found")
+		return
+	}
+	if !s.authorize(w, r, aclRegister, ns, instance.ServiceName) || !checkIdentity(w, r, instance.ServiceName) {
+		return
+	}
+	if err := s.reg.heartbeat(ns, id); err != nil {
+		log.Println(err)
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleCheckUpdate 上报TTL检查状态
+func (s *Server) handleCheckUpdate(w http.ResponseWriter, r *http.Request) {
+	var update struct {
+		Status HealthStatus `json:"status"`
+		Output string       `json:"output"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		log.Println(err)
+		writeError(w, http.StatusBadRequest, "invalid check update: "+err.Error())
+		return
+	}
+	if update.Status != HealthPassing && update.Status != HealthWarning && update.Status != HealthCritical {
+		writeError(w, http.StatusBadRequest, "status must be passing, warning or critical")
+		return
+	}
+	ns, id := namespaceOf(r), r.PathValue("id")
+	instance, ok := s.reg.get(ns, id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "service instance not found")
+		return
+	}
+	if !s.authorize(w, r, aclRegister, ns, instance.ServiceName) || !checkIdentity(w, r, instance.ServiceName) {
+		return
+	}
+	// HTTP和TCP检查由注册中心自己执行，只有TTL检查接受上报
+	checkID := r.PathValue("check")
+	i := slices.IndexFunc(instance.Checks, func(c CheckDefinition) bool { return c.ID == checkID })
+	if i < 0 {
+		writeError(w, http.StatusNotFound, "check not found")
+		return
+	}
+	if instance.Checks[i].Type != CheckTTL {
+		writeError(w, http.StatusBadRequest, "check "+checkID+" is a "+string(instance.Checks[i].Type)+" check run by the registry, only ttl checks accept updates")
+		return
+	}
+	if err := s.reg.updateCheck(instance.InstanceID, checkID, update.Status, update.Output); err != nil {
+		log.Println(err)
+		status := clusterError(err)
+		if errors.Is(err, errNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
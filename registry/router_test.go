@@ -0,0 +1,604 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// request 直接调用 server 处理请求，返回响应
+func request(t *testing.T, server http.Handler, method, target string, body interface{}, prepare ...func(*http.Request)) *httptest.ResponseRecorder {
+	t.Helper()
+	var data []byte
+	switch b := body.(type) {
+	case nil:
+	case string:
+		data = []byte(b)
+	default:
+		var err error
+		if data, err = json.Marshal(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, target, bytes.NewReader(data))
+	for _, p := range prepare {
+		p(req)
+	}
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	return rec
+}
+
+// withIdentity 模拟出示了服务名称为 name 的客户端证书
+func withIdentity(name string) func(*http.Request) {
+	return func(r *http.Request) {
+		r.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: name}}},
+		}
+	}
+}
+
+// withToken 携带ACL令牌
+func withToken(secret string) func(*http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set(TokenHeader, secret)
+	}
+}
+
+// decode 解析响应体，失败时测试失败
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid response %q: %v", rec.Body, err)
+	}
+}
+
+// expect 检查响应的状态码
+func expect(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("returned %d, want %d: %s", rec.Code, status, rec.Body)
+	}
+}
+
+// instanceIDs 返回实例ID列表
+func instanceIDs(regs []Registration) []string {
+	ids := make([]string, 0, len(regs))
+	for _, reg := range regs {
+		ids = append(ids, reg.InstanceID)
+	}
+	return ids
+}
+
+// mustRegister 注册实例，失败时测试失败
+func mustRegister(t *testing.T, server http.Handler, reg Registration, prepare ...func(*http.Request)) {
+	t.Helper()
+	if rec := request(t, server, http.MethodPost, "/services", reg, prepare...); rec.Code != http.StatusOK {
+		t.Fatalf("register %s returned %d: %s", reg.InstanceID, rec.Code, rec.Body)
+	}
+}
+
+func TestDeregisterChecksIdentity(t *testing.T) {
+	server := NewServer()
+	mustRegister(t, server, Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100", InstanceID: "orders-1"})
+
+	// 其他服务的证书不能注销这个实例，无论实例ID在路径中还是请求体中
+	if rec := request(t, server, http.MethodDelete, "/services/orders-1", nil, withIdentity("Payments")); rec.Code != http.StatusForbidden {
+		t.Fatalf("deregister with another service's certificate returned %d, want 403", rec.Code)
+	}
+	if rec := request(t, server, http.MethodDelete, "/services", "orders-1", withIdentity("Payments")); rec.Code != http.StatusForbidden {
+		t.Fatalf("deregister by body with another service's certificate returned %d, want 403", rec.Code)
+	}
+	if _, ok := server.reg.get(DefaultNamespace, "orders-1"); !ok {
+		t.Fatal("instance was removed by another service")
+	}
+
+	if rec := request(t, server, http.MethodDelete, "/services/orders-1", nil, withIdentity("Orders")); rec.Code != http.StatusOK {
+		t.Fatalf("deregister with the service's own certificate returned %d", rec.Code)
+	}
+	if _, ok := server.reg.get(DefaultNamespace, "orders-1"); ok {
+		t.Fatal("instance was not removed")
+	}
+}
+
+func TestRegistryHealth(t *testing.T) {
+	rec := request(t, NewServer(), http.MethodGet, "/health", nil)
+	expect(t, rec, http.StatusOK)
+	var body map[string]string
+	decode(t, rec, &body)
+	if body["status"] != "ok" {
+		t.Fatalf("status is %q", body["status"])
+	}
+}
+
+func TestServiceHealth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+	server := NewServer()
+	mustRegister(t, server, Registration{ServiceName: "Orders", ServiceUrl: backend.URL, InstanceID: "orders-1"})
+
+	var body struct {
+		ServiceName string `json:"serviceName"`
+		Healthy     bool   `json:"healthy"`
+	}
+	rec := request(t, server, http.MethodGet, "/health/Orders", nil)
+	expect(t, rec, http.StatusOK)
+	decode(t, rec, &body)
+	if body.ServiceName != "Orders" || !body.Healthy {
+		t.Fatalf("health of Orders is %+v", body)
+	}
+
+	rec = request(t, server, http.MethodGet, "/health/Unknown", nil)
+	expect(t, rec, http.StatusOK)
+	decode(t, rec, &body)
+	if body.Healthy {
+		t.Fatal("unknown service is healthy")
+	}
+}
+
+func TestRegisterValidation(t *testing.T) {
+	server := NewServer()
+	expect(t, request(t, server, http.MethodPost, "/services", "{"), http.StatusBadRequest)
+	expect(t, request(t, server, http.MethodPost, "/services", Registration{ServiceName: "Orders"}), http.StatusBadRequest)
+	expect(t, request(t, server, http.MethodPost, "/services",
+		Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100", Namespace: "Bad Namespace"}), http.StatusBadRequest)
+	expect(t, request(t, server, http.MethodPost, "/services", Registration{
+		ServiceName: "Orders",
+		ServiceUrl:  "http://localhost:9100",
+		Checks:      []CheckDefinition{{ID: "ttl", Type: CheckTTL}},
+	}), http.StatusBadRequest)
+	// 过短的TTL和间隔会让检查的 ticker 得到非正数的周期
+	for _, check := range []CheckDefinition{
+		{ID: "ttl", Type: CheckTTL, TTL: "1ns"},
+		{ID: "tcp", Type: CheckTCP, TCP: "localhost:9100", Interval: "10ms"},
+	} {
+		expect(t, request(t, server, http.MethodPost, "/services", Registration{
+			ServiceName: "Orders",
+			ServiceUrl:  "http://localhost:9100",
+			Checks:      []CheckDefinition{check},
+		}), http.StatusBadRequest)
+	}
+	expect(t, request(t, server, http.MethodPost, "/v1/ns/dev/services",
+		Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100", Namespace: "prod"}), http.StatusBadRequest)
+	expect(t, request(t, server, http.MethodPost, "/v1/ns/*/services",
+		Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100"}), http.StatusBadRequest)
+	if regs := server.reg.getRegistrations(AllNamespaces); len(regs) != 0 {
+		t.Fatalf("invalid registrations were stored: %v", instanceIDs(regs))
+	}
+
+	// 没有实例ID时由注册中心生成，客户端传入的健康状态被忽略
+	mustRegister(t, server, Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100", Status: HealthPassing})
+	regs := server.reg.findByName(DefaultNamespace, "Orders")
+	if len(regs) != 1 || regs[0].InstanceID == "" || regs[0].Namespace != DefaultNamespace || regs[0].RegisteredAt.IsZero() {
+		t.Fatalf("registered %+v", regs)
+	}
+}
+
+func TestListAndFindServices(t *testing.T) {
+	server := NewServer()
+	mustRegister(t, server, Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100", InstanceID: "orders-1", Tags: []string{"v1"}})
+	mustRegister(t, server, Registration{
+		ServiceName: "Orders",
+		ServiceUrl:  "http://localhost:9101",
+		InstanceID:  "orders-2",
+		Tags:        []string{"v2"},
+		Checks:      []CheckDefinition{{ID: "ttl", Type: CheckTTL, TTL: "30s"}},
+	})
+	mustRegister(t, server, Registration{ServiceName: "Payments", ServiceUrl: "http://localhost:9200", InstanceID: "payments-1", Tags: []string{"v1"}})
+	t.Cleanup(server.Stop)
+
+	var regs []Registration
+	for _, path := range []string{"/services", "/services/"} {
+		rec := request(t, server, http.MethodGet, path, nil)
+		expect(t, rec, http.StatusOK)
+		if rec.Header().Get(IndexHeader) == "" {
+			t.Fatalf("%s has no %s header", path, IndexHeader)
+		}
+		decode(t, rec, &regs)
+		if len(regs) != 3 {
+			t.Fatalf("%s returned %v", path, instanceIDs(regs))
+		}
+	}
+
+	// 还没有通过检查的实例在 ?passing=true 时被过滤
+	rec := request(t, server, http.MethodGet, "/services?passing=true", nil)
+	expect(t, rec, http.StatusOK)
+	decode(t, rec, &regs)
+	if len(regs) != 2 {
+		t.Fatalf("passing services are %v", instanceIDs(regs))
+	}
+
+	rec = request(t, server, http.MethodGet, "/services/Orders", nil)
+	expect(t, rec, http.StatusOK)
+	decode(t, rec, &regs)
+	if len(regs) != 2 {
+		t.Fatalf("Orders instances are %v", instanceIDs(regs))
+	}
+	expect(t, request(t, server, http.MethodGet, "/services/Unknown", nil), http.StatusNotFound)
+
+	rec = request(t, server, http.MethodGet, "/services/tag/v1", nil)
+	expect(t, rec, http.StatusOK)
+	decode(t, rec, &regs)
+	if len(regs) != 2 {
+		t.Fatalf("instances tagged v1 are %v", instanceIDs(regs))
+	}
+	rec = request(t, server, http.MethodGet, "/services/tag/v2?passing=true", nil)
+	expect(t, rec, http.StatusOK)
+	decode(t, rec, &regs)
+	if len(regs) != 0 {
+		t.Fatalf("passing instances tagged v2 are %v", instanceIDs(regs))
+	}
+
+	// 没有匹配的标签返回空数组而不是 null
+	rec = request(t, server, http.MethodGet, "/services/tag/none", nil)
+	expect(t, rec, http.StatusOK)
+	if body := strings.TrimSpace(rec.Body.String()); body != "[]" {
+		t.Fatalf("unknown tag returned %s, want []", body)
+	}
+}
+
+func TestFindByNamePassing(t *testing.T) {
+	server := NewServer()
+	mustRegister(t, server, Registration{
+		ServiceName: "Orders",
+		ServiceUrl:  "http://localhost:9100",
+		InstanceID:  "orders-1",
+		Checks:      []CheckDefinition{{ID: "ttl", Type: CheckTTL, TTL: "30s"}},
+	})
+	t.Cleanup(server.Stop)
+
+	rec := request(t, server, http.MethodGet, "/services/Orders?passing=true", nil)
+	expect(t, rec, http.StatusNotFound)
+	var body map[string]string
+	decode(t, rec, &body)
+	if body["error"] != "no passing instance" {
+		t.Fatalf("error is %q", body["error"])
+	}
+
+	expect(t, request(t, server, http.MethodPut, "/services/orders-1/checks/ttl", map[string]string{"status": "passing"}), http.StatusOK)
+	expect(t, request(t, server, http.MethodGet, "/services/Orders?passing=true", nil), http.StatusOK)
+}
+
+func TestBlockingQuery(t *testing.T) {
+	server := NewServer()
+	rec := request(t, server, http.MethodGet, "/services", nil)
+	index := rec.Header().Get(IndexHeader)
+
+	expect(t, request(t, server, http.MethodGet, "/services?index=x", nil), http.StatusBadRequest)
+	expect(t, request(t, server, http.MethodGet, "/services?index=1&wait=-1s", nil), http.StatusBadRequest)
+
+	// 目录没有变化时等到超时，返回相同的序号
+	start := time.Now()
+	rec = request(t, server, http.MethodGet, "/services?index="+index+"&wait=50ms", nil)
+	expect(t, rec, http.StatusOK)
+	if time.Since(start) < 50*time.Millisecond || rec.Header().Get(IndexHeader) != index {
+		t.Fatalf("query returned index %s after %v", rec.Header().Get(IndexHeader), time.Since(start))
+	}
+
+	// 目录变化时立即返回新的序号
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- request(t, server, http.MethodGet, "/services?index="+index+"&wait=10s", nil)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	mustRegister(t, server, Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100", InstanceID: "orders-1"})
+	select {
+	case rec = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocking query did not return after a change")
+	}
+	var regs []Registration
+	decode(t, rec, &regs)
+	if rec.Header().Get(IndexHeader) == index || len(regs) != 1 {
+		t.Fatalf("query returned index %s and %v", rec.Header().Get(IndexHeader), instanceIDs(regs))
+	}
+}
+
+func TestDeregister(t *testing.T) {
+	server := NewServer()
+	mustRegister(t, server, Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100", InstanceID: "orders-1"})
+	mustRegister(t, server, Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9101", InstanceID: "orders-2"})
+
+	expect(t, request(t, server, http.MethodDelete, "/services/orders-1", nil), http.StatusOK)
+	expect(t, request(t, server, http.MethodDelete, "/services/orders-1", nil), http.StatusNotFound)
+
+	// 旧客户端在请求体中发送服务URL
+	expect(t, request(t, server, http.MethodDelete, "/services", "http://localhost:9101"), http.StatusOK)
+	expect(t, request(t, server, http.MethodDelete, "/services", "unknown"), http.StatusNotFound)
+	if regs := server.reg.getRegistrations(AllNamespaces); len(regs) != 0 {
+		t.Fatalf("left %v", instanceIDs(regs))
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	server := NewServer()
+	mustRegister(t, server, Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100", InstanceID: "orders-1"})
+	before, _ := server.reg.get(DefaultNamespace, "orders-1")
+	time.Sleep(10 * time.Millisecond)
+
+	expect(t, request(t, server, http.MethodPut, "/services/orders-1/heartbeat", nil), http.StatusOK)
+	after, _ := server.reg.get(DefaultNamespace, "orders-1")
+	if !after.LastHeartbeat.After(before.LastHeartbeat) {
+		t.Fatal("heartbeat did not renew the lease")
+	}
+	expect(t, request(t, server, http.MethodPut, "/services/unknown/heartbeat", nil), http.StatusNotFound)
+	expect(t, request(t, server, http.MethodPut, "/services/orders-1/heartbeat", nil, withIdentity("Payments")), http.StatusForbidden)
+}
+
+func TestCheckUpdate(t *testing.T) {
+	server := NewServer()
+	mustRegister(t, server, Registration{
+		ServiceName: "Orders",
+		ServiceUrl:  "http://localhost:9100",
+		InstanceID:  "orders-1",
+		Checks: []CheckDefinition{
+			{ID: "ttl", Type: CheckTTL, TTL: "30s"},
+			{ID: "tcp", Type: CheckTCP, TCP: "localhost:9100", Interval: "1h"},
+		},
+	})
+	t.Cleanup(server.Stop)
+
+	expect(t, request(t, server, http.MethodPut, "/services/orders-1/checks/ttl", "{"), http.StatusBadRequest)
+	// TCP检查由注册中心执行，客户端不能覆盖它的结果
+	expect(t, request(t, server, http.MethodPut, "/services/orders-1/checks/tcp", map[string]string{"status": "passing"}), http.StatusBadRequest)
+	expect(t, request(t, server, http.MethodPut, "/services/orders-1/checks/ttl", map[string]string{"status": "unknown"}), http.StatusBadRequest)
+	expect(t, request(t, server, http.MethodPut, "/services/orders-1/checks/other", map[string]string{"status": "passing"}), http.StatusNotFound)
+	expect(t, request(t, server, http.MethodPut, "/services/unknown/checks/ttl", map[string]string{"status": "passing"}), http.StatusNotFound)
+
+	expect(t, request(t, server, http.MethodPut, "/services/orders-1/checks/ttl", map[string]string{"status": "warning", "output": "slow"}), http.StatusOK)
+	reg, _ := server.reg.get(DefaultNamespace, "orders-1")
+	if reg.Health[0].Status != HealthWarning || reg.Health[0].Output != "slow" {
+		t.Fatalf("instance is %s, check is %+v", reg.Status, reg.Health[0])
+	}
+}
+
+func TestEvents(t *testing.T) {
+	server := NewServer()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	mustRegister(t, server, Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100", InstanceID: "orders-1"})
+	mustRegister(t, server, Registration{ServiceName: "Payments", ServiceUrl: "http://localhost:9200", InstanceID: "payments-1"})
+
+	expect(t, request(t, server, http.MethodGet, "/services/events?index=x", nil), http.StatusBadRequest)
+
+	// 从初始序号 1 续传并且只要 Orders 的事件
+	res, err := http.Get(ts.URL + "/services/events?index=1&service=Orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("events returned %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(res.Body)
+	next := func() Event {
+		t.Helper()
+		var ev Event
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				if err := json.Unmarshal([]byte(data), &ev); err != nil {
+					t.Fatal(err)
+				}
+				return ev
+			}
+		}
+	}
+	if ev := next(); ev.Registration.InstanceID != "orders-1" {
+		t.Fatalf("first event is %s %s", ev.Type, ev.Registration.InstanceID)
+	}
+	expect(t, request(t, server, http.MethodDelete, "/services/payments-1", nil), http.StatusOK)
+	expect(t, request(t, server, http.MethodDelete, "/services/orders-1", nil), http.StatusOK)
+	if ev := next(); ev.Registration.InstanceID != "orders-1" || ev.Index != server.reg.currentIndex() {
+		t.Fatalf("next event is %s %s at %d", ev.Type, ev.Registration.InstanceID, ev.Index)
+	}
+}
+
+func TestNamespacedRoutes(t *testing.T) {
+	server := NewServer()
+	mustRegister(t, server, Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100", InstanceID: "orders-1"})
+	expect(t, request(t, server, http.MethodPost, "/v1/ns/dev/services",
+		Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9101", InstanceID: "orders-dev"}), http.StatusOK)
+
+	var regs []Registration
+	for path, want := range map[string]int{
+		"/services/Orders":               1,
+		"/v1/ns/default/services/Orders": 1,
+		"/v1/ns/dev/services/Orders":     1,
+		"/v1/ns/*/services/Orders":       2,
+		"/v1/ns/*/services":              2,
+	} {
+		rec := request(t, server, http.MethodGet, path, nil)
+		expect(t, rec, http.StatusOK)
+		decode(t, rec, &regs)
+		if len(regs) != want {
+			t.Fatalf("%s returned %v, want %d instances", path, instanceIDs(regs), want)
+		}
+	}
+	expect(t, request(t, server, http.MethodGet, "/v1/ns/bad.ns/services", nil), http.StatusBadRequest)
+
+	// 实例只能在自己的命名空间中操作
+	expect(t, request(t, server, http.MethodPut, "/services/orders-dev/heartbeat", nil), http.StatusNotFound)
+	expect(t, request(t, server, http.MethodPut, "/v1/ns/dev/services/orders-dev/heartbeat", nil), http.StatusOK)
+	expect(t, request(t, server, http.MethodDelete, "/v1/ns/*/services/orders-dev", nil), http.StatusBadRequest)
+	expect(t, request(t, server, http.MethodDelete, "/v1/ns/dev/services/orders-dev", nil), http.StatusOK)
+}
+
+func TestUnknownRoutes(t *testing.T) {
+	server := NewServer()
+	for _, tc := range []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/unknown", http.StatusNotFound},
+		{http.MethodPatch, "/services", http.StatusMethodNotAllowed},
+	} {
+		rec := request(t, server, tc.method, tc.path, nil)
+		expect(t, rec, tc.status)
+		var body map[string]string
+		decode(t, rec, &body)
+		if body["error"] == "" {
+			t.Fatalf("%s %s has no error message", tc.method, tc.path)
+		}
+	}
+}
+
+func TestACLTokens(t *testing.T) {
+	const bootstrap = "bootstrap-secret"
+	server := NewServer()
+	if err := server.EnableACL(bootstrap, false); err != nil {
+		t.Fatal(err)
+	}
+	admin := withToken(bootstrap)
+
+	expect(t, request(t, server, http.MethodGet, "/v1/acl/tokens", nil), http.StatusForbidden)
+	expect(t, request(t, server, http.MethodGet, "/v1/acl/tokens", nil, withToken("wrong")), http.StatusForbidden)
+
+	rec := request(t, server, http.MethodPost, "/v1/acl/tokens", ACLToken{
+		Description: "orders",
+		Policy:      ACLPolicy{Register: []string{"Orders"}, Read: []string{"Orders"}},
+	}, admin)
+	expect(t, rec, http.StatusOK)
+	var token ACLToken
+	decode(t, rec, &token)
+	if token.AccessorID == "" || token.SecretID == "" {
+		t.Fatalf("created token %+v", token)
+	}
+	expect(t, request(t, server, http.MethodPost, "/v1/acl/tokens", "{", admin), http.StatusBadRequest)
+
+	// 列出和查看令牌时不返回 SecretID
+	var tokens []ACLToken
+	rec = request(t, server, http.MethodGet, "/v1/acl/tokens", nil, admin)
+	expect(t, rec, http.StatusOK)
+	decode(t, rec, &tokens)
+	if len(tokens) != 1 || tokens[0].SecretID != "" {
+		t.Fatalf("listed %+v", tokens)
+	}
+	var got ACLToken
+	rec = request(t, server, http.MethodGet, "/v1/acl/tokens/"+token.AccessorID, nil, admin)
+	expect(t, rec, http.StatusOK)
+	decode(t, rec, &got)
+	if got.Description != "orders" || got.SecretID != "" {
+		t.Fatalf("got %+v", got)
+	}
+	expect(t, request(t, server, http.MethodGet, "/v1/acl/tokens/unknown", nil, admin), http.StatusNotFound)
+
+	// 令牌只能按策略注册和查询，不能管理令牌
+	user := withToken(token.SecretID)
+	expect(t, request(t, server, http.MethodGet, "/v1/acl/tokens", nil, user), http.StatusForbidden)
+	expect(t, request(t, server, http.MethodPost, "/services",
+		Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100", InstanceID: "orders-1"}, user), http.StatusOK)
+	expect(t, request(t, server, http.MethodPost, "/services",
+		Registration{ServiceName: "Payments", ServiceUrl: "http://localhost:9200", InstanceID: "payments-1"}, user), http.StatusForbidden)
+	expect(t, request(t, server, http.MethodGet, "/services/Orders", nil, user), http.StatusOK)
+	expect(t, request(t, server, http.MethodDelete, "/services/orders-1", nil, user), http.StatusForbidden)
+
+	rec = request(t, server, http.MethodGet, "/v1/acl/token/self", nil, user)
+	expect(t, rec, http.StatusOK)
+	decode(t, rec, &got)
+	if got.AccessorID != token.AccessorID || got.SecretID != "" {
+		t.Fatalf("self is %+v", got)
+	}
+
+	// 修改权限后立即生效，SecretID 不变
+	rec = request(t, server, http.MethodPut, "/v1/acl/tokens/"+token.AccessorID, ACLToken{
+		Description: "orders admin",
+		Policy:      ACLPolicy{Register: []string{"Orders"}, Deregister: []string{"Orders"}, Read: []string{"Orders"}},
+	}, admin)
+	expect(t, rec, http.StatusOK)
+	expect(t, request(t, server, http.MethodPut, "/v1/acl/tokens/unknown", ACLToken{}, admin), http.StatusNotFound)
+	expect(t, request(t, server, http.MethodDelete, "/services/orders-1", nil, user), http.StatusOK)
+
+	expect(t, request(t, server, http.MethodDelete, "/v1/acl/tokens/"+token.AccessorID, nil, admin), http.StatusOK)
+	expect(t, request(t, server, http.MethodDelete, "/v1/acl/tokens/"+token.AccessorID, nil, admin), http.StatusNotFound)
+	expect(t, request(t, server, http.MethodGet, "/services", nil, user), http.StatusForbidden)
+}
+
+func TestTokenSelfWithoutACL(t *testing.T) {
+	expect(t, request(t, NewServer(), http.MethodGet, "/v1/acl/token/self", nil), http.StatusNotFound)
+}
+
+func TestAnonymousRead(t *testing.T) {
+	server := NewServer()
+	if err := server.EnableACL("bootstrap-secret", true); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, request(t, server, http.MethodPost, "/services",
+		Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100"}), http.StatusForbidden)
+	expect(t, request(t, server, http.MethodPost, "/services",
+		Registration{ServiceName: "Orders", ServiceUrl: "http://localhost:9100"}, withToken("bootstrap-secret")), http.StatusOK)
+	rec := request(t, server, http.MethodGet, "/services", nil)
+	expect(t, rec, http.StatusOK)
+	if n, _ := strconv.Atoi(rec.Header().Get(IndexHeader)); n == 0 {
+		t.Fatalf("index is %q", rec.Header().Get(IndexHeader))
+	}
+}
+
+func TestRegisterCannotTakeOverOtherInstances(t *testing.T) {
+	server := NewServer()
+	if err := server.EnableACL("bootstrap-secret", true); err != nil {
+		t.Fatal(err)
+	}
+	victim := Registration{ServiceName: "LibraryService", ServiceUrl: "http://localhost:6000", InstanceID: "LibraryService-victim"}
+	mustRegister(t, server, victim, withToken("bootstrap-secret"))
+
+	rec := request(t, server, http.MethodPost, "/v1/acl/tokens", ACLToken{Policy: ACLPolicy{Register: []string{"Attacker"}}}, withToken("bootstrap-secret"))
+	expect(t, rec, http.StatusOK)
+	var token ACLToken
+	decode(t, rec, &token)
+	attacker := withToken(token.SecretID)
+
+	for name, reg := range map[string]Registration{
+		"instance ID":                {ServiceName: "Attacker", ServiceUrl: "http://localhost:6666", InstanceID: victim.InstanceID},
+		"service URL":                {ServiceName: "Attacker", ServiceUrl: victim.ServiceUrl},
+		"instance ID in a namespace": {ServiceName: "Attacker", ServiceUrl: "http://localhost:6666", InstanceID: victim.InstanceID, Namespace: "dev"},
+		"service URL in a namespace": {ServiceName: "Attacker", ServiceUrl: victim.ServiceUrl, Namespace: "dev"},
+	} {
+		if rec := request(t, server, http.MethodPost, "/services", reg, attacker); rec.Code != http.StatusConflict {
+			t.Fatalf("takeover by %s returned %d, want 409", name, rec.Code)
+		}
+	}
+	// 客户端证书只能证明服务名称，同样不能顶替
+	takeover := Registration{ServiceName: "Attacker", ServiceUrl: "http://localhost:6666", InstanceID: victim.InstanceID}
+	if rec := request(t, server, http.MethodPost, "/v1/ns/dev/services", takeover, attacker, withIdentity("Attacker")); rec.Code != http.StatusConflict {
+		t.Fatalf("takeover with a client certificate returned %d, want 409", rec.Code)
+	}
+
+	// 同一个服务在其他命名空间中也不能使用这个实例ID
+	moved := victim
+	moved.Namespace = "dev"
+	if rec := request(t, server, http.MethodPost, "/services", moved, withToken("bootstrap-secret")); rec.Code != http.StatusConflict {
+		t.Fatalf("registering the instance in another namespace returned %d, want 409", rec.Code)
+	}
+
+	got, ok := server.reg.get(DefaultNamespace, victim.InstanceID)
+	if !ok || got.ServiceName != victim.ServiceName || got.ServiceUrl != victim.ServiceUrl {
+		t.Fatalf("victim instance is %+v, found %v", got, ok)
+	}
+	if regs := server.reg.getRegistrations(AllNamespaces); len(regs) != 1 {
+		t.Fatalf("registry has %v", instanceIDs(regs))
+	}
+
+	// 服务自己重新注册仍然可以更新实例
+	victim.Tags = []string{"v2"}
+	mustRegister(t, server, victim, withToken("bootstrap-secret"))
+	if got, _ := server.reg.get(DefaultNamespace, victim.InstanceID); len(got.Tags) != 1 {
+		t.Fatalf("re-registration did not update the instance: %+v", got)
+	}
+}
@@ -1,78 +1,343 @@
 package registry
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
+
+	"github.com/linshule/go-distributed/raft"
+	"github.com/linshule/go-distributed/tlsutil"
 )
 
+// ServerPort 注册中心默认的监听端口，实际的监听地址见 ListenAddr
 const ServerPort = ":3000"
-const ServiceUrl = "http://localhost" + ServerPort + "/services"
+
+// RegistryUrl 未启用TLS时注册中心的默认地址，客户端实际使用的地址见 Address
+const RegistryUrl = "http://localhost" + ServerPort
+
+// ServiceUrl 默认地址下的服务接口，客户端的地址通过 ClientConfig 配置
+const ServiceUrl = RegistryUrl + "/services"
+
+// snapshotEvery 每追加多少条操作保存一次快照
+const snapshotEvery = 1000
 
 type registry struct {
-	registrations []Registration
-	mutex         *sync.Mutex
+	registrations  []Registration
+	mutex          *sync.Mutex
+	storage        Storage
+	seq            uint64                        // 最后一个已应用操作的序号
+	index          uint64                        // 服务目录的修改序号，只在目录变化时递增
+	changed        chan struct{}                 // 目录每变化一次关闭一次，用于唤醒阻塞查询
+	history        []Event                       // 最近的目录变化事件
+	checks         map[string]context.CancelFunc // 每个实例正在运行的健康检查
+	sinceSnapshot  int                           // 上次快照之后追加的操作数
+	node           *raft.Node                    // 集群模式下的 Raft 节点，单机模式为 nil
+	leading        bool                          // 集群模式下本节点是否已经作为 Leader 接管
+	tokens         map[string]ACLToken           // ACL令牌，以 AccessorID 为键
+	aclEnabled     bool
+	bootstrapToken string    // 初始管理令牌，不写入存储
+	anonymous      ACLPolicy // 没有携带令牌的请求使用的权限
 }
 
+// errConflict 实例ID或服务URL已经属于另一个服务或命名空间
+var errConflict = errors.New("already registered by another service")
+
 func (r *registry) add(reg Registration) error {
+	if reg.InstanceID == "" {
+		reg.InstanceID = NewInstanceID(reg.ServiceName, reg.ServiceUrl)
+	}
 	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	err := r.checkOwner(reg)
+	r.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return r.submit(Operation{Type: OpAdd, Registration: &reg})
+}
 
-	// 检查是否已存在同名服务，如果是则更新
-	for i, existing := range r.registrations {
-		if existing.ServiceName == reg.ServiceName {
-			r.registrations[i] = reg
-			return nil
+// checkOwner 实例ID或服务URL已经被其他服务或其他命名空间的实例使用时返回 errConflict，调用方需持有锁
+// 注册只能替换同一个命名空间中同一个服务的实例，有注册权限的令牌或证书不能借此顶替其他服务
+func (r *registry) checkOwner(reg Registration) error {
+	ns := registrationNamespace(reg)
+	for _, other := range r.registrations {
+		if other.InstanceID != reg.InstanceID && other.ServiceUrl != reg.ServiceUrl {
+			continue
+		}
+		if registrationNamespace(other) != ns || other.ServiceName != reg.ServiceName {
+			return fmt.Errorf("Instance %s (%s) %w %v in namespace %s", reg.InstanceID, reg.ServiceUrl, errConflict, other.ServiceName, registrationNamespace(other))
 		}
 	}
-	r.registrations = append(r.registrations, reg)
 	return nil
 }
 
-func (r *registry) remove(url string) error {
+// remove 注销命名空间 ns 中的一个实例，id 可以是实例ID，也可以是服务URL（兼容旧客户端）
+func (r *registry) remove(ns, id string) error {
+	r.mutex.Lock()
+	i := r.find(ns, id)
+	if i < 0 {
+		r.mutex.Unlock()
+		return fmt.Errorf("Service instance %s not found", id)
+	}
+	instanceID := r.registrations[i].InstanceID
+	r.mutex.Unlock()
+	return r.submit(Operation{Type: OpRemove, InstanceID: instanceID})
+}
+
+// get 返回命名空间 ns 中的实例，id 可以是实例ID或服务URL
+func (r *registry) get(ns, id string) (Registration, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	i := r.find(ns, id)
+	if i < 0 {
+		return Registration{}, false
+	}
+	return r.registrations[i], true
+}
+
+// getRegistrations 返回命名空间 ns 中的所有实例
+func (r *registry) getRegistrations(ns string) []Registration {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
+	result := make([]Registration, 0, len(r.registrations))
+	for _, reg := range r.registrations {
+		if inNamespace(reg, ns) {
+			result = append(result, reg)
+		}
+	}
+	return result
+}
+
+// heartbeat 续约命名空间 ns 中的一个实例，心跳只在本节点生效，集群模式下由 Leader 处理
+func (r *registry) heartbeat(ns, id string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	i := r.find(ns, id)
+	if i < 0 {
+		return fmt.Errorf("Service instance %s not found", id)
+	}
+	return r.commit(Operation{Type: OpHeartbeat, InstanceID: r.registrations[i].InstanceID})
+}
+
+// expire 移除租约已过期的实例，返回被移除的实例
+// 集群模式下只有 Leader 掌握最新的心跳，因此只在 Leader 上执行
+func (r *registry) expire(now time.Time) []Registration {
+	if !r.isLeader() {
+		return nil
+	}
+	r.mutex.Lock()
+	var expired []Registration
+	for _, reg := range r.registrations {
+		if now.Sub(reg.LastHeartbeat) > reg.Lease() {
+			expired = append(expired, reg)
+		}
+	}
+	r.mutex.Unlock()
+
+	var removed []Registration
+	for _, reg := range expired {
+		if err := r.submit(Operation{Type: OpExpire, InstanceID: reg.InstanceID}); err != nil {
+			log.Println(err)
+			continue
+		}
+		removed = append(removed, reg)
+	}
+	return removed
+}
+
+// indexOf 返回实例ID为 id 的实例在列表中的位置，调用方需持有锁
+func (r *registry) indexOf(id string) int {
 	for i := range r.registrations {
-		if r.registrations[i].ServiceUrl == url {
+		if r.registrations[i].InstanceID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// find 在命名空间 ns 中查找实例，返回它在列表中的位置，id 可以是实例ID或服务URL，调用方需持有锁
+func (r *registry) find(ns, id string) int {
+	for i, reg := range r.registrations {
+		if inNamespace(reg, ns) && (reg.InstanceID == id || reg.ServiceUrl == id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// submit 提交一条变更：单机模式直接写入，集群模式先经过 Raft 复制到多数节点
+func (r *registry) submit(op Operation) error {
+	if r.node != nil {
+		return r.propose(op)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.commit(op)
+}
+
+// commit 先把操作写入存储，再应用到内存，调用方需持有锁
+func (r *registry) commit(op Operation) error {
+	op.Seq = r.seq + 1
+	if op.Time.IsZero() {
+		op.Time = time.Now()
+	}
+	if err := r.storage.Append(op); err != nil {
+		return err
+	}
+	r.apply(op)
+
+	r.sinceSnapshot++
+	if r.sinceSnapshot >= snapshotEvery {
+		if err := r.snapshot(); err != nil {
+			log.Println("Failed to save snapshot:", err)
+		}
+	}
+	return nil
+}
+
+// apply 把一条操作应用到内存状态，调用方需持有锁
+func (r *registry) apply(op Operation) {
+	switch op.Type {
+	case OpAdd:
+		reg := *op.Registration
+		// 提交之前已经检查过，这里再检查一次，并发的注册不会顶替其他服务的实例
+		if err := r.checkOwner(reg); err != nil {
+			log.Println(err)
+			break
+		}
+		r.startChecks(&reg, op.Time)
+		i := r.indexOf(reg.InstanceID)
+		if i >= 0 {
+			reg.ModifyIndex = r.publish(EventUpdated, reg, op.Time)
+			r.registrations[i] = reg
+		} else {
+			reg.ModifyIndex = r.publish(EventRegistered, reg, op.Time)
+			r.registrations = append(r.registrations, reg)
+		}
+	case OpRemove, OpExpire:
+		if i := r.indexOf(op.InstanceID); i >= 0 {
+			removed := r.registrations[i]
+			r.stopChecks(removed.InstanceID)
 			r.registrations = append(r.registrations[:i], r.registrations[i+1:]...)
-			return nil
+			if op.Type == OpExpire {
+				r.publish(EventExpired, removed, op.Time)
+			} else {
+				r.publish(EventDeregistered, removed, op.Time)
+			}
 		}
+	case OpHeartbeat:
+		if i := r.indexOf(op.InstanceID); i >= 0 {
+			r.registrations[i].LastHeartbeat = op.Time
+		}
+	case OpCheck:
+		if i, j := r.checkIndex(op.InstanceID, op.Check.CheckID); j >= 0 {
+			r.setCheck(i, j, op.Check.Status, op.Check.Output, op.Time)
+		}
+	case OpTokenSet:
+		r.tokens[op.Token.AccessorID] = *op.Token
+	case OpTokenDelete:
+		delete(r.tokens, op.Token.AccessorID)
 	}
-	return fmt.Errorf("Service at %s not found", url)
+	r.seq = op.Seq
 }
 
-func (r *registry) getRegistrations() []Registration {
+// snapshot 保存当前状态的快照，调用方需持有锁
+func (r *registry) snapshot() error {
+	regs := make([]Registration, len(r.registrations))
+	copy(regs, r.registrations)
+	err := r.storage.SaveSnapshot(Snapshot{Seq: r.seq, Index: r.index, Registrations: regs, Tokens: r.snapshotTokens()})
+	if err != nil {
+		return err
+	}
+	r.sinceSnapshot = 0
+	return nil
+}
+
+// load 从存储恢复状态：先加载快照，再按顺序重放之后的操作
+func (r *registry) load(s Storage) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	result := make([]Registration, len(r.registrations))
-	copy(result, r.registrations)
-	return result
+
+	snap, ops, err := s.Load()
+	if err != nil {
+		return err
+	}
+	r.storage = s
+	r.registrations = snap.Registrations
+	r.seq = snap.Seq
+	r.index = max(snap.Index, 1)
+	r.tokens = make(map[string]ACLToken, len(snap.Tokens))
+	for _, t := range snap.Tokens {
+		r.tokens[t.AccessorID] = t
+	}
+	for _, op := range ops {
+		r.apply(op)
+	}
+
+	// 注册中心停机期间服务无法续约，重启后给所有实例一个完整的租约，并重新开始健康检查
+	now := time.Now()
+	for i := range r.registrations {
+		r.registrations[i].LastHeartbeat = now
+		r.startChecks(&r.registrations[i], now)
+	}
+	log.Printf("Recovered %d services from storage (seq %d, %d operations replayed)\n", len(r.registrations), r.seq, len(ops))
+
+	// 把重放过的日志压缩进快照
+	return r.snapshot()
+}
+
+// UseStorage 切换注册中心的存储后端，并从中恢复之前的状态
+// 需要在注册中心开始处理请求之前调用
+func (s *Server) UseStorage(storage Storage) error {
+	return s.reg.load(storage)
 }
 
-// findByName 根据服务名称查找服务
-func (r *registry) findByName(serviceName ServiceName) []Registration {
+// CloseStorage 保存最终快照并关闭存储
+func (s *Server) CloseStorage() error {
+	s.reg.mutex.Lock()
+	defer s.reg.mutex.Unlock()
+	if err := s.reg.snapshot(); err != nil {
+		log.Println("Failed to save snapshot:", err)
+	}
+	return s.reg.storage.Close()
+}
+
+// UseStorage 切换默认注册中心实例的存储后端
+func UseStorage(s Storage) error {
+	return defaultServer.UseStorage(s)
+}
+
+// CloseStorage 关闭默认注册中心实例的存储
+func CloseStorage() error {
+	return defaultServer.CloseStorage()
+}
+
+// findByName 根据服务名称查找命名空间 ns 中的服务
+func (r *registry) findByName(ns string, serviceName ServiceName) []Registration {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	var result []Registration
 	for _, reg := range r.registrations {
-		if reg.ServiceName == serviceName {
+		if reg.ServiceName == serviceName && inNamespace(reg, ns) {
 			result = append(result, reg)
 		}
 	}
 	return result
 }
 
-// findByTag 根据标签查找服务
-func (r *registry) findByTag(tag string) []Registration {
+// findByTag 根据标签查找命名空间 ns 中的服务
+func (r *registry) findByTag(ns, tag string) []Registration {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	var result []Registration
+	result := []Registration{}
 	for _, reg := range r.registrations {
+		if !inNamespace(reg, ns) {
+			continue
+		}
 		for _, t := range reg.Tags {
 			if t == tag {
 				result = append(result, reg)
@@ -84,141 +349,146 @@ func (r *registry) findByTag(tag string) []Registration {
 }
 
 // healthCheck 检查服务健康状态
-func (r *registry) healthCheck(serviceName ServiceName) (bool, int64) {
-	regs := r.findByName(serviceName)
+// 定义了健康检查的实例直接使用注册中心维护的状态，否则临时探测 {url}/health
+// 每次探测最多等待 defaultCheckTimeout，请求结束时放弃探测
+func (r *registry) healthCheck(ctx context.Context, ns string, serviceName ServiceName) (bool, int64) {
+	regs := r.findByName(ns, serviceName)
 	if len(regs) == 0 {
 		return false, 0
 	}
 
 	for _, reg := range regs {
+		if len(reg.Checks) > 0 {
+			if reg.Status == HealthPassing {
+				return true, 0
+			}
+			continue
+		}
 		healthURL := reg.HealthCheckURL
 		if healthURL == "" {
 			healthURL = reg.ServiceUrl
 		}
 
 		start := time.Now()
-		resp, err := http.Get(healthURL + "/health")
+		code, err := probeHealth(ctx, healthURL+"/health")
 		latency := time.Since(start).Milliseconds()
 
-		if err == nil && resp.StatusCode == http.StatusOK {
+		if err != nil {
+			continue
+		}
+		if code == http.StatusOK {
 			return true, latency
 		}
 	}
 	return false, 0
 }
 
-var reg = registry{
-	registrations: make([]Registration, 0),
-	mutex:         new(sync.Mutex),
+// probeHealth 请求实例的健康检查地址并返回状态码，超时为 defaultCheckTimeout
+func probeHealth(ctx context.Context, url string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := tlsutil.Client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
 }
 
-// RegistryService HTTP处理器
-type RegistryService struct{}
+// filterQuery 按查询参数过滤实例：?passing=true 时去掉健康状态为 critical 的实例
+func filterQuery(r *http.Request, regs []Registration) []Registration {
+	passing, _ := strconv.ParseBool(r.URL.Query().Get("passing"))
+	if !passing {
+		return regs
+	}
+	return FilterPassing(regs)
+}
 
-func (s RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Println("Request received:", r.Method, r.URL.Path)
+// FilterPassing 去掉最新健康状态为 critical 的实例，warning 的实例仍然保留
+func FilterPassing(regs []Registration) []Registration {
+	result := make([]Registration, 0, len(regs))
+	for _, reg := range regs {
+		if reg.Status != HealthCritical {
+			result = append(result, reg)
+		}
+	}
+	return result
+}
 
-	// 路由处理
-	path := r.URL.Path
-
-	switch {
-	// 健康检查端点: /health
-	case path == "/health":
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{
-			"status": "ok",
-			"time":   time.Now().Format(time.RFC3339),
-		})
-
-	// 按名称查询服务: /services/{serviceName}
-	case strings.HasPrefix(path, "/services/") && r.Method == http.MethodGet:
-		serviceName := strings.TrimPrefix(path, "/services/")
-		if serviceName == "" {
-			// 返回所有服务
-			w.Header().Set("Content-Type", "application/json")
-			regs := reg.getRegistrations()
-			json.NewEncoder(w).Encode(regs)
-			return
-		}
-		regs := reg.findByName(ServiceName(serviceName))
-		w.Header().Set("Content-Type", "application/json")
-		if len(regs) == 0 {
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(map[string]string{
-				"error": "service not found",
-			})
-			return
-		}
-		json.NewEncoder(w).Encode(regs)
-
-	// 按标签查询服务: /services/tag/{tag}
-	case strings.HasPrefix(path, "/services/tag/") && r.Method == http.MethodGet:
-		tag := strings.TrimPrefix(path, "/services/tag/")
-		regs := reg.findByTag(tag)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(regs)
-
-	// 服务健康检查: /health/{serviceName}
-	case strings.HasPrefix(path, "/health/") && r.Method == http.MethodGet:
-		serviceName := strings.TrimPrefix(path, "/health/")
-		healthy, latency := reg.healthCheck(ServiceName(serviceName))
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"serviceName": serviceName,
-			"healthy":     healthy,
-			"latency":     latency,
-		})
-
-	// 核心服务注册接口: /services
-	case path == "/services":
-		switch r.Method {
-		case http.MethodPost:
-			dec := json.NewDecoder(r.Body)
-			var regData Registration
-			err := dec.Decode(&regData)
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-			// 设置注册时间
-			regData.RegisteredAt = time.Now()
-			log.Printf("Adding service: %v with URL: %s\n", regData.ServiceName, regData.ServiceUrl)
-			err = reg.add(regData)
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-			w.WriteHeader(http.StatusOK)
+// newRegistry 创建一个使用内存存储的空注册表
+func newRegistry() *registry {
+	return &registry{
+		registrations: make([]Registration, 0),
+		mutex:         new(sync.Mutex),
+		storage:       NewMemoryStorage(),
+		changed:       make(chan struct{}),
+		index:         1, // 从 1 开始，index=0 的查询总是立即返回
+		checks:        make(map[string]context.CancelFunc),
+		tokens:        make(map[string]ACLToken),
+	}
+}
 
-		case http.MethodDelete:
-			payload, err := io.ReadAll(r.Body)
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			url := string(payload)
-			log.Printf("Removing service at URL: %s\n", url)
-			err = reg.remove(url)
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
+// Server 一个注册中心实例，实现 http.Handler
+// 每个实例有自己的服务目录、存储和集群节点，同一个进程中可以运行多个实例
+type Server struct {
+	reg    *registry
+	router *http.ServeMux
+}
+
+// NewServer 创建一个使用内存存储的注册中心实例
+func NewServer() *Server {
+	s := &Server{reg: newRegistry()}
+	s.router = s.newRouter()
+	return s
+}
+
+// defaultServer RegistryService 和包级函数使用的注册中心实例
+var defaultServer = NewServer()
+
+// StartReaper 启动租约回收，每隔 interval 移除一次租约过期的实例，ctx 结束时停止
+func (s *Server) StartReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
 				return
+			case now := <-ticker.C:
+				for _, r := range s.reg.expire(now) {
+					log.Printf("Lease expired, removing service: %v (instance %s)\n", r.ServiceName, r.InstanceID)
+				}
 			}
+		}
+	}()
+}
 
-		case http.MethodGet:
-			w.Header().Set("Content-Type", "application/json")
-			regs := reg.getRegistrations()
-			json.NewEncoder(w).Encode(regs)
+// StartReaper 启动默认注册中心实例的租约回收
+func StartReaper(ctx context.Context, interval time.Duration) {
+	defaultServer.StartReaper(ctx, interval)
+}
 
-		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
-		}
+// Stop 停止所有健康检查，注册中心停止服务时调用
+func (s *Server) Stop() {
+	s.reg.stopAllChecks()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("Request received:", r.Method, r.URL.Path)
 
-	default:
-		w.WriteHeader(http.StatusNotFound)
+	if s.routeToLeader(w, r) {
+		return
 	}
+	s.serveRoute(w, r)
+}
+
+// RegistryService HTTP处理器，使用默认的注册中心实例
+type RegistryService struct{}
+
+func (s RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defaultServer.ServeHTTP(w, r)
 }
@@ -0,0 +1,67 @@
+package registry
+
+import "time"
+
+// OpType 注册表变更操作类型
+type OpType string
+
+const (
+	OpAdd         OpType = "add"          // 注册或更新实例
+	OpRemove      OpType = "remove"       // 注销实例
+	OpExpire      OpType = "expire"       // 租约过期移除实例
+	OpHeartbeat   OpType = "heartbeat"    // 实例续约
+	OpTokenSet    OpType = "token-set"    // 创建或更新ACL令牌
+	OpTokenDelete OpType = "token-delete" // 删除ACL令牌
+	OpCheck       OpType = "check"        // 健康检查状态变化，只在集群模式下复制
+)
+
+// CheckResult OpCheck 携带的检查结果
+type CheckResult struct {
+	CheckID string       `json:"checkId"`
+	Status  HealthStatus `json:"status"`
+	Output  string       `json:"output,omitempty"`
+}
+
+// Operation 一次注册表变更，按 Seq 顺序写入预写日志
+type Operation struct {
+	Seq          uint64        `json:"seq"`                    // 操作序号，单调递增
+	Type         OpType        `json:"type"`                   // 操作类型
+	Registration *Registration `json:"registration,omitempty"` // OpAdd 时的注册信息
+	InstanceID   string        `json:"instanceId,omitempty"`   // OpRemove/OpExpire/OpHeartbeat/OpCheck 的目标实例
+	Token        *ACLToken     `json:"token,omitempty"`        // OpTokenSet/OpTokenDelete 的令牌
+	Check        *CheckResult  `json:"check,omitempty"`        // OpCheck 的检查结果
+	Time         time.Time     `json:"time"`                   // 操作时间
+}
+
+// Snapshot 注册表在某个序号时的完整状态
+type Snapshot struct {
+	Seq           uint64         `json:"seq"`              // 快照包含的最后一个操作序号
+	Index         uint64         `json:"index"`            // 快照时服务目录的修改序号
+	Registrations []Registration `json:"registrations"`    // 所有实例
+	Tokens        []ACLToken     `json:"tokens,omitempty"` // 所有ACL令牌
+}
+
+// Storage 注册表存储后端
+type Storage interface {
+	// Load 返回最近的快照以及快照之后的所有操作
+	Load() (Snapshot, []Operation, error)
+	// Append 追加一条操作，返回前必须已经持久化
+	Append(op Operation) error
+	// SaveSnapshot 保存快照，之后可以丢弃快照之前的操作
+	SaveSnapshot(s Snapshot) error
+	// Close 关闭存储
+	Close() error
+}
+
+// memoryStorage 不做任何持久化，注册中心重启后状态丢失
+type memoryStorage struct{}
+
+// NewMemoryStorage 创建内存存储（默认存储）
+func NewMemoryStorage() Storage {
+	return memoryStorage{}
+}
+
+func (memoryStorage) Load() (Snapshot, []Operation, error) { return Snapshot{}, nil, nil }
+func (memoryStorage) Append(Operation) error               { return nil }
+func (memoryStorage) SaveSnapshot(Snapshot) error          { return nil }
+func (memoryStorage) Close() error                         { return nil }
@@ -0,0 +1,84 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// IndexHeader 响应头，携带服务目录当前的修改序号
+	IndexHeader = "X-Registry-Index"
+
+	defaultWait = 30 * time.Second
+	maxWait     = 5 * time.Minute
+)
+
+// bumpIndex 目录发生变化：递增修改序号并唤醒所有阻塞查询，调用方需持有锁
+func (r *registry) bumpIndex() uint64 {
+	r.index++
+	close(r.changed)
+	r.changed = make(chan struct{})
+	return r.index
+}
+
+// currentIndex 返回目录当前的修改序号
+func (r *registry) currentIndex() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.index
+}
+
+// waitForChange 阻塞到目录的修改序号不再等于 index，或者超时、ctx 结束
+// 返回最新的修改序号。注册中心重启后序号可能变小，此时立即返回，客户端据此重置
+func (r *registry) waitForChange(ctx context.Context, index uint64, wait time.Duration) uint64 {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		r.mutex.Lock()
+		current, changed := r.index, r.changed
+		r.mutex.Unlock()
+		if current != index {
+			return current
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return current
+		case <-ctx.Done():
+			return current
+		}
+	}
+}
+
+// blockingQuery 处理 ?index=N&wait=30s 参数：目录修改序号等于 N 时阻塞等待变化
+// 之后设置 X-Registry-Index 响应头。参数错误时写出 400 并返回 false
+func (s *Server) blockingQuery(w http.ResponseWriter, r *http.Request) bool {
+	query := r.URL.Query()
+	index := s.reg.currentIndex()
+	if v := query.Get("index"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid index")
+			return false
+		}
+		wait := defaultWait
+		if v := query.Get("wait"); v != "" {
+			wait, err = time.ParseDuration(v)
+			if err != nil || wait <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid wait")
+				return false
+			}
+		}
+		if wait > maxWait {
+			wait = maxWait
+		}
+		// index=0 表示客户端还没有任何数据，直接返回
+		if n > 0 {
+			index = s.reg.waitForChange(r.Context(), n, wait)
+		}
+	}
+	w.Header().Set(IndexHeader, strconv.FormatUint(index, 10))
+	return true
+}
@@ -0,0 +1,259 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/linshule/go-distributed/registry"
+	"github.com/linshule/go-distributed/tlsutil"
+)
+
+// DependencyPolicy 依赖在超时时间内没有就绪时的处理方式
+type DependencyPolicy int
+
+const (
+	// DependencyFail 停止服务，Wait 返回错误
+	DependencyFail DependencyPolicy = iota
+	// DependencyDegrade 以降级状态就绪，/health/ready 返回 200，未就绪的依赖报告为 warning
+	DependencyDegrade
+)
+
+// DefaultDependencyTimeout 等待依赖就绪的默认时间
+const DefaultDependencyTimeout = time.Minute
+
+// dependencyPollInterval 等待依赖时查询注册中心的间隔
+const dependencyPollInterval = time.Second
+
+// dependencyRefreshInterval 就绪之后在后台刷新依赖状态的间隔
+const dependencyRefreshInterval = 10 * time.Second
+
+// dependencyProbeTimeout 探测依赖实例就绪状态的超时
+const dependencyProbeTimeout = 2 * time.Second
+
+// DependencyProbeHeader 探测依赖的 /health/ready 时携带的请求头，值为发起探测的服务名称
+// 收到这个请求头的服务不再检查自己的依赖，互相依赖的服务不会循环探测
+const DependencyProbeHeader = "X-Dependency-Probe"
+
+// 就绪状态
+const (
+	gateWaiting  int32 = iota // 还在等待依赖
+	gateOpen                  // 所有依赖都已就绪
+	gateDegraded              // 等待超时，以降级状态就绪
+)
+
+// WithDependencyTimeout 设置等待 Registration.Dependencies 就绪的时间
+func WithDependencyTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.dependencyTimeout = d
+	}
+}
+
+// WithDependencyPolicy 设置依赖等待超时后的处理方式，默认为 DependencyFail
+func WithDependencyPolicy(p DependencyPolicy) Option {
+	return func(o *options) {
+		o.dependencyPolicy = p
+	}
+}
+
+// OnReady 添加在服务就绪（包括降级就绪）后执行一次的钩子
+func OnReady(h Hook) Option {
+	return func(o *options) {
+		o.onReady = append(o.onReady, h)
+	}
+}
+
+// waitDependencies 等待所有依赖都有一个就绪的实例，期间 /health/ready 返回 503
+// 就绪之后继续按 dependencyRefreshInterval 刷新依赖状态，直到服务停止
+func (s *Service) waitDependencies() {
+	deps := s.reg.Dependencies
+	if len(deps) > 0 {
+		log.Printf("%v waiting for dependencies: %v\n", s.reg.ServiceName, deps)
+	}
+	deadline := time.NewTimer(s.opts.dependencyTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(dependencyPollInterval)
+	defer ticker.Stop()
+	for len(deps) > 0 {
+		missing := s.refreshDependencies()
+		if len(missing) == 0 {
+			log.Printf("%v dependencies ready\n", s.reg.ServiceName)
+			break
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			continue
+		case <-deadline.C:
+		}
+		err := fmt.Errorf("dependencies not ready after %v: %s", s.opts.dependencyTimeout, strings.Join(missing, ", "))
+		if s.opts.dependencyPolicy == DependencyFail {
+			log.Printf("%v %v\n", s.reg.ServiceName, err)
+			s.stop(context.Background(), err)
+			return
+		}
+		log.Printf("%v %v, continuing in degraded mode\n", s.reg.ServiceName, err)
+		s.gate.Store(gateDegraded)
+		s.ready()
+		s.watchDependencies()
+		return
+	}
+	s.gate.Store(gateOpen)
+	s.ready()
+	s.watchDependencies()
+}
+
+// watchDependencies 定期刷新依赖状态，直到服务停止
+func (s *Service) watchDependencies() {
+	if len(s.reg.Dependencies) == 0 {
+		return
+	}
+	ticker := time.NewTicker(dependencyRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.refreshDependencies()
+		}
+	}
+}
+
+// ready 执行 OnReady 钩子
+func (s *Service) ready() {
+	for _, h := range s.opts.onReady {
+		if err := h(s.ctx); err != nil {
+			log.Printf("%v ready hook failed: %v\n", s.reg.ServiceName, err)
+		}
+	}
+}
+
+// refreshDependencies 检查所有依赖并保存结果，返回还没有就绪实例的依赖
+func (s *Service) refreshDependencies() []string {
+	results := s.checkDependencies(s.ctx)
+	s.dependencies.Store(&results)
+	var missing []string
+	for _, r := range results {
+		if r.Status != registry.HealthPassing {
+			missing = append(missing, r.Name)
+		}
+	}
+	return missing
+}
+
+// dependencyStatus 返回最近一次依赖检查的结果，不访问注册中心和依赖
+// 还在等待依赖时未就绪的依赖为 critical，就绪之后依赖下线只报告为 warning，不会让服务变为未就绪
+func (s *Service) dependencyStatus() []CheckResult {
+	var results []CheckResult
+	if cached := s.dependencies.Load(); cached != nil {
+		results = slices.Clone(*cached)
+	} else {
+		for _, dep := range s.reg.Dependencies {
+			results = append(results, CheckResult{Name: string(dep), Status: registry.HealthCritical, Output: "not checked yet", Dependency: true})
+		}
+	}
+	if s.gate.Load() != gateWaiting {
+		for i := range results {
+			if results[i].Status == registry.HealthCritical {
+				results[i].Status = registry.HealthWarning
+			}
+		}
+	}
+	return results
+}
+
+// checkDependencies 从注册中心获取最新的实例列表，为每个依赖找一个就绪的实例，见 readyInstance
+// 没有就绪实例的依赖为 critical
+func (s *Service) checkDependencies(ctx context.Context) []CheckResult {
+	results := make([]CheckResult, 0, len(s.reg.Dependencies))
+	if len(s.reg.Dependencies) == 0 {
+		return results
+	}
+	regs, listErr := s.client.GetServicesFresh(ctx)
+	for _, dep := range s.reg.Dependencies {
+		start := time.Now()
+		var inst registry.Registration
+		err := listErr
+		if err == nil {
+			inst, err = s.readyInstance(ctx, regs, dep)
+		}
+		r := CheckResult{Name: string(dep), Status: registry.HealthPassing, Duration: time.Since(start).Round(time.Microsecond).String(), Dependency: true}
+		if err != nil {
+			r.Status = registry.HealthCritical
+			r.Output = err.Error()
+		} else {
+			r.Output = fmt.Sprintf("instance %s at %s", inst.InstanceID, inst.ServiceUrl)
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// readyInstance 返回服务 dep 的一个就绪实例
+// 定义了注册中心健康检查的实例必须处于 passing 状态（warning 不算就绪）；
+// 没有定义检查的实例在注册中心中没有真实的健康状态，直接探测它的 /health/ready
+func (s *Service) readyInstance(ctx context.Context, regs []registry.Registration, dep registry.ServiceName) (registry.Registration, error) {
+	err := fmt.Errorf("service %s: %w", dep, registry.ErrNotFound)
+	for _, reg := range regs {
+		if reg.ServiceName != dep {
+			continue
+		}
+		if len(reg.Checks) > 0 {
+			if reg.Status == registry.HealthPassing {
+				return reg, nil
+			}
+			err = fmt.Errorf("instance %s is %s", reg.InstanceID, reg.Status)
+			continue
+		}
+		if probeErr := s.probeReady(ctx, reg); probeErr != nil {
+			err = fmt.Errorf("instance %s: %w", reg.InstanceID, probeErr)
+			continue
+		}
+		return reg, nil
+	}
+	return registry.Registration{}, err
+}
+
+// probeReady 请求实例的 /health/ready，不是 service 包启动的服务没有这个端点时改为请求 /health
+func (s *Service) probeReady(ctx context.Context, reg registry.Registration) error {
+	base := reg.HealthCheckURL
+	if base == "" {
+		base = reg.ServiceUrl
+	}
+	ctx, cancel := context.WithTimeout(ctx, dependencyProbeTimeout)
+	defer cancel()
+	status, err := s.probe(ctx, base+"/health/ready")
+	if err == nil && status == http.StatusNotFound {
+		status, err = s.probe(ctx, base+"/health")
+	}
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("not ready: %d %s", status, http.StatusText(status))
+	}
+	return nil
+}
+
+// probe 发送一次探测请求，返回状态码
+func (s *Service) probe(ctx context.Context, url string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(DependencyProbeHeader, string(s.reg.ServiceName))
+	res, err := tlsutil.Client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return res.StatusCode, nil
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/linshule/go-distributed/registry"
+)
+
+// newDependentService 创建一个依赖 deps 的服务（不启动HTTP服务），以及它使用的进程内注册中心客户端
+func newDependentService(t *testing.T, deps ...registry.ServiceName) (*Service, *registry.Client) {
+	t.Helper()
+	server := registry.NewServer()
+	ts := httptest.NewServer(server)
+	t.Cleanup(func() {
+		ts.CloseClientConnections()
+		ts.Close()
+		server.Stop()
+	})
+	client := registry.NewClient(registry.ClientConfig{Addresses: []string{ts.URL}, MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+	s := &Service{
+		reg:    registry.Registration{ServiceName: "Frontend", Dependencies: deps},
+		client: client,
+		ctx:    context.Background(),
+	}
+	return s, client
+}
+
+// dependencyStatus 返回依赖 dep 的检查结果
+func dependencyStatus(t *testing.T, s *Service, dep registry.ServiceName) CheckResult {
+	t.Helper()
+	for _, r := range s.checkDependencies(context.Background()) {
+		if r.Name == string(dep) {
+			return r
+		}
+	}
+	t.Fatalf("no result for %s", dep)
+	return CheckResult{}
+}
+
+func TestDependencyWithoutChecksIsProbed(t *testing.T) {
+	s, client := newDependentService(t, "Backend")
+	var ready atomic.Bool
+	var probedBy atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health/ready" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		probedBy.Store(r.Header.Get(DependencyProbeHeader))
+		if !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+
+	if r := dependencyStatus(t, s, "Backend"); r.Status != registry.HealthCritical {
+		t.Fatalf("unregistered dependency is %s", r.Status)
+	}
+
+	// 已经注册但还没有就绪的实例不算就绪
+	reg := registry.Registration{ServiceName: "Backend", ServiceUrl: backend.URL, InstanceID: "backend-1"}
+	if err := client.RegistrationService(context.Background(), reg); err != nil {
+		t.Fatal(err)
+	}
+	if r := dependencyStatus(t, s, "Backend"); r.Status != registry.HealthCritical {
+		t.Fatalf("dependency whose readiness probe fails is %s: %s", r.Status, r.Output)
+	}
+	if got := probedBy.Load(); got != "Frontend" {
+		t.Fatalf("probe carried %s %v, want Frontend", DependencyProbeHeader, got)
+	}
+
+	ready.Store(true)
+	if r := dependencyStatus(t, s, "Backend"); r.Status != registry.HealthPassing {
+		t.Fatalf("ready dependency is %s: %s", r.Status, r.Output)
+	}
+}
+
+func TestDependencyWithChecksRequiresPassing(t *testing.T) {
+	s, client := newDependentService(t, "Backend")
+	reg := registry.Registration{
+		ServiceName: "Backend",
+		ServiceUrl:  "http://localhost:9100",
+		InstanceID:  "backend-1",
+		Checks:      []registry.CheckDefinition{{ID: "ttl", Type: registry.CheckTTL, TTL: "30s"}},
+	}
+	ctx := context.Background()
+	if err := client.RegistrationService(ctx, reg); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		status registry.HealthStatus
+		want   registry.HealthStatus
+	}{
+		{registry.HealthWarning, registry.HealthCritical},
+		{registry.HealthPassing, registry.HealthPassing},
+		{registry.HealthCritical, registry.HealthCritical},
+	} {
+		if err := client.UpdateCheck(ctx, reg.InstanceID, "ttl", tc.status, ""); err != nil {
+			t.Fatal(err)
+		}
+		if r := dependencyStatus(t, s, "Backend"); r.Status != tc.want {
+			t.Fatalf("dependency whose check is %s is %s, want %s: %s", tc.status, r.Status, tc.want, r.Output)
+		}
+	}
+}
+
+func TestReadinessProbeSkipsDependencies(t *testing.T) {
+	s, _ := newDependentService(t, "Backend")
+	mux := http.NewServeMux()
+	s.mountHealth(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("ready with a missing dependency returned %d", rec.Code)
+	}
+
+	// 其他服务的探测只看本服务自己的就绪检查
+	req := httptest.NewRequest(http.MethodGet, "/health/ready", nil)
+	req.Header.Set(DependencyProbeHeader, "Backend")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("dependency probe returned %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// readyStatus 请求 /health/ready，返回状态码和依赖 dep 的状态
+func readyStatus(t *testing.T, s *Service, dep registry.ServiceName) (int, registry.HealthStatus) {
+	t.Helper()
+	mux := http.NewServeMux()
+	s.mountHealth(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+	var report HealthReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range report.Checks {
+		if c.Dependency && c.Name == string(dep) {
+			return rec.Code, c.Status
+		}
+	}
+	t.Fatalf("no result for %s in %+v", dep, report)
+	return 0, ""
+}
+
+func TestReadyReportsCachedDependencies(t *testing.T) {
+	s, client := newDependentService(t, "Backend")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.ctx = ctx
+	s.opts.dependencyTimeout = time.Minute
+
+	reg := registry.Registration{
+		ServiceName: "Backend",
+		ServiceUrl:  "http://localhost:9100",
+		InstanceID:  "backend-1",
+		Checks:      []registry.CheckDefinition{{ID: "ttl", Type: registry.CheckTTL, TTL: "30s"}},
+	}
+	if err := client.RegistrationService(ctx, reg); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.UpdateCheck(ctx, reg.InstanceID, "ttl", registry.HealthPassing, ""); err != nil {
+		t.Fatal(err)
+	}
+	if code, status := readyStatus(t, s, "Backend"); code != http.StatusServiceUnavailable || status != registry.HealthCritical {
+		t.Fatalf("before the first check ready returned %d with the dependency %s", code, status)
+	}
+
+	go s.waitDependencies()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.gate.Load() != gateOpen {
+		if time.Now().After(deadline) {
+			t.Fatal("dependencies never became ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code, status := readyStatus(t, s, "Backend"); code != http.StatusOK || status != registry.HealthPassing {
+		t.Fatalf("ready returned %d with the dependency %s", code, status)
+	}
+
+	// /health/ready 不访问注册中心，依赖下线要等到下一次刷新才会出现
+	if err := client.ShutdownService(ctx, reg.InstanceID); err != nil {
+		t.Fatal(err)
+	}
+	if _, status := readyStatus(t, s, "Backend"); status != registry.HealthPassing {
+		t.Fatalf("ready checked the registry, dependency is %s", status)
+	}
+	s.refreshDependencies()
+	if code, status := readyStatus(t, s, "Backend"); code != http.StatusOK || status != registry.HealthWarning {
+		t.Fatalf("after the dependency went away ready returned %d with the dependency %s", code, status)
+	}
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/linshule/go-distributed/breaker"
+	"github.com/linshule/go-distributed/registry"
+)
+
+// defaultCheckTimeout 单个就绪检查的超时
+const defaultCheckTimeout = 5 * time.Second
+
+// CheckFunc 就绪检查，返回 nil 表示通过，错误信息会出现在 /health/ready 的响应中
+type CheckFunc func(ctx context.Context) error
+
+type readinessCheck struct {
+	name  string
+	check CheckFunc
+}
+
+// CheckResult 一个就绪检查的结果
+type CheckResult struct {
+	Name     string                `json:"name"`
+	Status   registry.HealthStatus `json:"status"`
+	Output   string                `json:"output,omitempty"`
+	Duration string                `json:"duration"`
+	// Dependency 为 true 时这是 Registration.Dependencies 中的一个依赖，Name 为服务名称
+	Dependency bool `json:"dependency,omitempty"`
+}
+
+// HealthReport /health/live 和 /health/ready 的响应
+type HealthReport struct {
+	Status     registry.HealthStatus `json:"status"`
+	Service    registry.ServiceName  `json:"service"`
+	InstanceID string                `json:"instanceId"`
+	Checks     []CheckResult         `json:"checks,omitempty"`
+}
+
+// ServiceInfo /info 的响应
+type ServiceInfo struct {
+	Service    registry.ServiceName `json:"service"`
+	InstanceID string               `json:"instanceId"`
+	Namespace  string               `json:"namespace,omitempty"`
+	Version    string               `json:"version"`
+	URL        string               `json:"url"`
+	Tags       []string             `json:"tags,omitempty"`
+	Metadata   map[string]string    `json:"metadata,omitempty"`
+	StartedAt  time.Time            `json:"startedAt"`
+	Uptime     string               `json:"uptime"`
+	GoVersion  string               `json:"goVersion"`
+}
+
+// WithReadinessCheck 添加一个就绪检查，所有检查通过时 /health/ready 才返回 200
+func WithReadinessCheck(name string, check CheckFunc) Option {
+	return func(o *options) {
+		o.checks = append(o.checks, readinessCheck{name: name, check: check})
+	}
+}
+
+// AddReadinessCheck 在服务运行期间添加一个就绪检查
+func (s *Service) AddReadinessCheck(name string, check CheckFunc) {
+	s.checkMutex.Lock()
+	defer s.checkMutex.Unlock()
+	s.checks = append(s.checks, readinessCheck{name: name, check: check})
+}
+
+// mountHealth 在 mux 上挂载 /health、/health/live、/health/ready、/info 和 /breakers
+// 注册中心、服务发现和监控服务频繁探测 /health，它只读取本进程的状态；监控服务从 /breakers 读取本进程熔断器的状态
+func (s *Service) mountHealth(mux *http.ServeMux) {
+	mux.HandleFunc("GET /health/live", s.handleLive)
+	mux.HandleFunc("GET /health/ready", s.handleReady)
+	mux.HandleFunc("GET /health", s.handleHealth)
+	mux.HandleFunc("GET /info", s.handleInfo)
+	mux.Handle("GET /breakers", breaker.Default)
+}
+
+// handleLive 进程能处理请求就是存活的
+func (s *Service) handleLive(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, HealthReport{Status: registry.HealthPassing, Service: s.reg.ServiceName, InstanceID: s.reg.InstanceID})
+}
+
+// handleHealth 服务正在停止或还在等待依赖时返回 critical，不执行就绪检查
+func (s *Service) handleHealth(w http.ResponseWriter, r *http.Request) {
+	report := HealthReport{Status: registry.HealthPassing, Service: s.reg.ServiceName, InstanceID: s.reg.InstanceID}
+	switch {
+	case s.stopping.Load():
+		report.Status = registry.HealthCritical
+		report.Checks = []CheckResult{{Name: "shutdown", Status: registry.HealthCritical, Output: "service is shutting down"}}
+	case len(s.reg.Dependencies) > 0 && s.gate.Load() == gateWaiting:
+		report.Status = registry.HealthCritical
+		report.Checks = []CheckResult{{Name: "dependencies", Status: registry.HealthCritical, Output: "waiting for dependencies"}}
+	}
+	writeReport(w, report)
+}
+
+// handleReady 执行所有就绪检查并报告最近一次检查到的依赖状态，服务正在停止时直接返回 critical
+// 带有 DependencyProbeHeader 的请求只执行本服务的就绪检查
+// 有 warning 时仍然返回 200，例如以降级状态就绪
+func (s *Service) handleReady(w http.ResponseWriter, r *http.Request) {
+	report := HealthReport{Status: registry.HealthPassing, Service: s.reg.ServiceName, InstanceID: s.reg.InstanceID}
+	if s.stopping.Load() {
+		report.Status = registry.HealthCritical
+		report.Checks = []CheckResult{{Name: "shutdown", Status: registry.HealthCritical, Output: "service is shutting down"}}
+		writeReport(w, report)
+		return
+	}
+	report.Checks = s.runChecks(r.Context())
+	// 其他服务探测本服务是否就绪时不检查依赖，避免互相依赖的服务循环探测
+	if r.Header.Get(DependencyProbeHeader) == "" {
+		report.Checks = append(report.Checks, s.dependencyStatus()...)
+	}
+	for _, c := range report.Checks {
+		switch {
+		case c.Status == registry.HealthCritical:
+			report.Status = registry.HealthCritical
+		case c.Status == registry.HealthWarning && report.Status == registry.HealthPassing:
+			report.Status = registry.HealthWarning
+		}
+	}
+	writeReport(w, report)
+}
+
+// runChecks 并发执行所有就绪检查，每个检查最多执行 defaultCheckTimeout
+func (s *Service) runChecks(ctx context.Context) []CheckResult {
+	s.checkMutex.RLock()
+	checks := append([]readinessCheck(nil), s.checks...)
+	s.checkMutex.RUnlock()
+
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Go(func() {
+			ctx, cancel := context.WithTimeout(ctx, defaultCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			err := c.check(ctx)
+			results[i] = CheckResult{Name: c.name, Status: registry.HealthPassing, Duration: time.Since(start).Round(time.Microsecond).String()}
+			if err != nil {
+				results[i].Status = registry.HealthCritical
+				results[i].Output = err.Error()
+			}
+		})
+	}
+	wg.Wait()
+	return results
+}
+
+// handleInfo 返回服务的注册信息和运行时间
+func (s *Service) handleInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ServiceInfo{
+		Service:    s.reg.ServiceName,
+		InstanceID: s.reg.InstanceID,
+		Namespace:  s.reg.Namespace,
+		Version:    s.reg.ServiceVersion,
+		URL:        s.reg.ServiceUrl,
+		Tags:       s.reg.Tags,
+		Metadata:   s.reg.Metadata,
+		StartedAt:  s.startedAt,
+		Uptime:     time.Since(s.startedAt).Round(time.Second).String(),
+		GoVersion:  runtime.Version(),
+	})
+}
+
+// writeReport 写出检查结果，critical 时状态码为 503
+func writeReport(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status == registry.HealthCritical {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
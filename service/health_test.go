@@ -0,0 +1,48 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthIsLocal(t *testing.T) {
+	s, _ := newDependentService(t, "Backend")
+	var calls atomic.Int32
+	s.AddReadinessCheck("database", func(ctx context.Context) error {
+		calls.Add(1)
+		return errors.New("database is down")
+	})
+	mux := http.NewServeMux()
+	s.mountHealth(mux)
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	if code := get("/health"); code != http.StatusServiceUnavailable {
+		t.Fatalf("/health while waiting for dependencies returned %d", code)
+	}
+	s.gate.Store(gateOpen)
+	for _, path := range []string{"/health", "/health/live"} {
+		if code := get(path); code != http.StatusOK {
+			t.Fatalf("%s returned %d", path, code)
+		}
+	}
+	if n := calls.Load(); n != 0 {
+		t.Fatalf("/health and /health/live ran readiness checks %d times", n)
+	}
+
+	if code := get("/health/ready"); code != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Fatalf("/health/ready returned %d after %d checks", code, calls.Load())
+	}
+
+	s.stopping.Store(true)
+	if code := get("/health"); code != http.StatusServiceUnavailable {
+		t.Fatalf("/health while stopping returned %d", code)
+	}
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/linshule/go-distributed/registry"
+)
+
+// DefaultGracePeriod 停止时等待处理中的请求完成的默认时间
+const DefaultGracePeriod = 10 * time.Second
+
+// Hook 停止过程中执行的钩子，ctx 是传给 Stop 的 context
+type Hook func(ctx context.Context) error
+
+// Option 服务的启动选项
+type Option func(*options)
+
+type options struct {
+	gracePeriod  time.Duration
+	signals      []os.Signal
+	preShutdown  []Hook
+	postShutdown []Hook
+	checks       []readinessCheck
+
+	dependencyTimeout time.Duration
+	dependencyPolicy  DependencyPolicy
+	onReady           []Hook
+}
+
+// WithGracePeriod 设置停止时等待处理中的请求完成的时间，超时后强制关闭连接
+func WithGracePeriod(d time.Duration) Option {
+	return func(o *options) {
+		o.gracePeriod = d
+	}
+}
+
+// WithSignals 设置触发停止的信号，默认为 SIGINT 和 SIGTERM，不传参数时不处理信号
+func WithSignals(signals ...os.Signal) Option {
+	return func(o *options) {
+		o.signals = signals
+	}
+}
+
+// OnPreShutdown 添加在注销之前执行的钩子，例如让负载均衡先摘除本实例
+func OnPreShutdown(h Hook) Option {
+	return func(o *options) {
+		o.preShutdown = append(o.preShutdown, h)
+	}
+}
+
+// OnPostShutdown 添加在HTTP服务停止之后执行的钩子，例如关闭文件和数据库连接
+func OnPostShutdown(h Hook) Option {
+	return func(o *options) {
+		o.postShutdown = append(o.postShutdown, h)
+	}
+}
+
+// Service 由 Start 启动的服务实例
+type Service struct {
+	reg    registry.Registration
+	client *registry.Client
+	server *http.Server
+	opts   options
+
+	ctx       context.Context // 服务停止时结束
+	cancel    context.CancelFunc
+	startedAt time.Time
+	stopping  atomic.Bool  // 开始停止后就绪检查总是失败
+	gate      atomic.Int32 // 依赖是否就绪，见 waitDependencies
+	// dependencies 最近一次依赖检查的结果，/health/ready 只读取它，见 refreshDependencies
+	dependencies atomic.Pointer[[]CheckResult]
+
+	checkMutex sync.RWMutex
+	checks     []readinessCheck
+
+	stopOnce sync.Once
+	done     chan struct{}
+	err      error
+}
+
+// Registration 返回服务的注册信息
+func (s *Service) Registration() registry.Registration {
+	return s.reg
+}
+
+// Context 返回服务的 context，服务开始停止时结束
+func (s *Service) Context() context.Context {
+	return s.ctx
+}
+
+// Wait 等待服务停止，返回停止过程中的错误
+func (s *Service) Wait() error {
+	<-s.done
+	return s.err
+}
+
+// Stop 停止服务，可以重复调用，之后的调用等待第一次停止完成
+//
+// 停止的顺序为：执行 OnPreShutdown 钩子、停止心跳、从注册中心注销并停止客户端的后台跟踪、
+// 等待处理中的请求完成（最多 WithGracePeriod 设置的时间）、执行 OnPostShutdown 钩子。
+// 先注销再停止HTTP服务，客户端在连接被拒绝之前就能从注册中心得知实例已下线。
+func (s *Service) Stop(ctx context.Context) error {
+	return s.stop(ctx, nil)
+}
+
+// stop 停止服务，cause 是导致停止的错误，例如HTTP服务异常退出
+func (s *Service) stop(ctx context.Context, cause error) error {
+	s.stopOnce.Do(func() {
+		s.err = errors.Join(cause, s.shutdown(ctx))
+		close(s.done)
+	})
+	<-s.done
+	return s.err
+}
+
+func (s *Service) shutdown(ctx context.Context) error {
+	name := s.reg.ServiceName
+	log.Printf("%v shutting down\n", name)
+	s.stopping.Store(true)
+	var errs []error
+	for _, h := range s.opts.preShutdown {
+		if err := h(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("pre-shutdown hook: %w", err))
+		}
+	}
+
+	// 先停止心跳，避免注销之后心跳返回 404 又重新注册
+	s.cancel()
+	if err := s.client.ShutdownService(ctx, s.reg.InstanceID); err != nil {
+		errs = append(errs, fmt.Errorf("deregister: %w", err))
+	} else {
+		log.Printf("%v deregistered %s\n", name, s.reg.InstanceID)
+	}
+	// 停止客户端在后台跟踪注册中心的阻塞查询
+	s.client.Close()
+
+	graceCtx, cancel := context.WithTimeout(ctx, s.opts.gracePeriod)
+	defer cancel()
+	if err := s.server.Shutdown(graceCtx); err != nil {
+		s.server.Close()
+		errs = append(errs, fmt.Errorf("drain requests: %w", err))
+	}
+
+	for _, h := range s.opts.postShutdown {
+		if err := h(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("post-shutdown hook: %w", err))
+		}
+	}
+	log.Printf("%v stopped\n", name)
+	return errors.Join(errs...)
+}
+
+// serve 运行HTTP服务，异常退出时注销并停止服务
+func (s *Service) serve(ln net.Listener) {
+	var err error
+	if s.server.TLSConfig != nil {
+		err = s.server.ServeTLS(ln, "", "")
+	} else {
+		err = s.server.Serve(ln)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return
+	}
+	log.Printf("%v server failed: %v\n", s.reg.ServiceName, err)
+	s.stop(context.Background(), err)
+}
+
+// handleSignals 收到停止信号或 Start 的 ctx 结束时停止服务
+func (s *Service) handleSignals() {
+	if len(s.opts.signals) == 0 {
+		<-s.ctx.Done()
+		s.Stop(context.Background())
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, s.opts.signals...)
+	defer signal.Stop(ch)
+	select {
+	case sig := <-ch:
+		log.Printf("%v received %v\n", s.reg.ServiceName, sig)
+	case <-s.ctx.Done():
+	}
+	s.Stop(context.Background())
+}
@@ -0,0 +1,282 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/linshule/go-distributed/registry"
+)
+
+// eventLog 按发生顺序记录停止过程中的事件
+type eventLog struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (l *eventLog) add(event string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *eventLog) list() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return slices.Clone(l.events)
+}
+
+// hook 返回一个记录 event 的钩子
+func (l *eventLog) hook(event string) Hook {
+	return func(ctx context.Context) error {
+		l.add(event)
+		return nil
+	}
+}
+
+// useRegistry 让全局客户端使用一个进程内的注册中心，注销请求记录为 "deregister"
+// 返回的通道在第一次注销时关闭
+func useRegistry(t *testing.T, events *eventLog) (*registry.Client, <-chan struct{}) {
+	t.Helper()
+	server := registry.NewServer()
+	deregistered := make(chan struct{})
+	var once sync.Once
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.ServeHTTP(w, r)
+		if r.Method == http.MethodDelete {
+			events.add("deregister")
+			once.Do(func() { close(deregistered) })
+		}
+	}))
+	old := registry.DefaultConfig()
+	cfg := registry.ClientConfig{Addresses: []string{ts.URL}, MaxRetries: -1}
+	registry.Configure(cfg)
+	t.Cleanup(func() {
+		registry.Configure(old)
+		ts.CloseClientConnections()
+		ts.Close()
+		server.Stop()
+	})
+	client := registry.NewClient(cfg)
+	t.Cleanup(func() { client.Close() })
+	return client, deregistered
+}
+
+// startService 在随机端口上启动服务，不处理信号，测试结束时停止
+func startService(t *testing.T, name registry.ServiceName, handlers RegisterFunc, opts ...Option) *Service {
+	t.Helper()
+	// 注册中心不允许两个服务使用同一个地址，按服务名区分
+	url := "http://" + strings.ToLower(string(name)) + ":9100"
+	reg := registry.Registration{ServiceName: name, ServiceUrl: url, InstanceID: string(name) + "-1"}
+	s, err := Start(context.Background(), "127.0.0.1", "0", reg, handlers, append([]Option{WithSignals()}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop(context.Background()) })
+	return s
+}
+
+// registered 实例是否在注册中心中
+func registered(t *testing.T, client *registry.Client, s *Service) bool {
+	t.Helper()
+	regs, err := client.GetServicesFresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return slices.ContainsFunc(regs, func(r registry.Registration) bool {
+		return r.InstanceID == s.Registration().InstanceID
+	})
+}
+
+// waitStopped 等待服务停止，返回 Wait 的结果
+func waitStopped(t *testing.T, s *Service) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- s.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("service did not stop")
+		return nil
+	}
+}
+
+func TestStopOrder(t *testing.T) {
+	var events eventLog
+	client, deregistered := useRegistry(t, &events)
+	started := make(chan struct{})
+	var s *Service
+	s = startService(t, "Lifecycle", func(mux *http.ServeMux) {
+		mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			// 处理中的请求在注销之后才结束，停止过程要等它完成
+			<-deregistered
+			time.Sleep(20 * time.Millisecond)
+			events.add("request done")
+		})
+	},
+		OnPreShutdown(func(ctx context.Context) error {
+			if !registered(t, client, s) {
+				t.Error("instance was deregistered before the pre-shutdown hook")
+			}
+			events.add("pre")
+			return nil
+		}),
+		OnPostShutdown(events.hook("post")),
+		WithGracePeriod(5*time.Second),
+	)
+	if !registered(t, client, s) {
+		t.Fatal("instance was not registered")
+	}
+
+	response := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + s.server.Addr + "/slow")
+		if err != nil {
+			response <- 0
+			return
+		}
+		res.Body.Close()
+		response <- res.StatusCode
+	}()
+	<-started
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	want := []string{"pre", "deregister", "request done", "post"}
+	if got := events.list(); !slices.Equal(got, want) {
+		t.Fatalf("stop ran %q, want %q", got, want)
+	}
+	if code := <-response; code != http.StatusOK {
+		t.Fatalf("in-flight request got %d", code)
+	}
+	if registered(t, client, s) {
+		t.Fatal("instance is still registered after Stop")
+	}
+	if err := waitStopped(t, s); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if s.Context().Err() == nil {
+		t.Fatal("service context is not done after Stop")
+	}
+	// 重复调用不会再执行钩子
+	if err := s.Stop(context.Background()); err != nil || len(events.list()) != len(want) {
+		t.Fatalf("second Stop returned %v and ran %q", err, events.list())
+	}
+}
+
+func TestStopForceClosesAfterGracePeriod(t *testing.T) {
+	var events eventLog
+	useRegistry(t, &events)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	s := startService(t, "Lifecycle", func(mux *http.ServeMux) {
+		mux.HandleFunc("/stuck", func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		})
+	}, OnPostShutdown(events.hook("post")), WithGracePeriod(50*time.Millisecond))
+
+	go func() {
+		if res, err := http.Get("http://" + s.server.Addr + "/stuck"); err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+	start := time.Now()
+	err := s.Stop(context.Background())
+	if err == nil {
+		t.Fatal("Stop with a stuck request returned no error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Stop took %v with a 50ms grace period", elapsed)
+	}
+	if want := []string{"deregister", "post"}; !slices.Equal(events.list(), want) {
+		t.Fatalf("stop ran %q, want %q", events.list(), want)
+	}
+	if waitErr := waitStopped(t, s); waitErr == nil || waitErr.Error() != err.Error() {
+		t.Fatalf("Wait returned %v, Stop returned %v", waitErr, err)
+	}
+}
+
+func TestStopReportsHookErrors(t *testing.T) {
+	var events eventLog
+	useRegistry(t, &events)
+	failed := errors.New("flush failed")
+	s := startService(t, "Lifecycle", func(*http.ServeMux) {},
+		OnPreShutdown(func(ctx context.Context) error { return failed }),
+		OnPostShutdown(events.hook("post")),
+	)
+	// 钩子失败不会中断停止过程
+	if err := s.Stop(context.Background()); !errors.Is(err, failed) {
+		t.Fatalf("Stop returned %v, want the hook error", err)
+	}
+	if want := []string{"deregister", "post"}; !slices.Equal(events.list(), want) {
+		t.Fatalf("stop ran %q, want %q", events.list(), want)
+	}
+}
+
+func TestSignalStopsService(t *testing.T) {
+	var events eventLog
+	client, _ := useRegistry(t, &events)
+	// 测试自己也接收该信号，服务开始监听之前收到信号时进程不会退出
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	defer signal.Stop(ch)
+	s := startService(t, "Lifecycle", func(*http.ServeMux) {},
+		WithSignals(syscall.SIGUSR1),
+		OnPreShutdown(events.hook("pre")),
+		OnPostShutdown(events.hook("post")),
+	)
+	// handleSignals 在后台开始监听，反复发送直到服务停止
+	stopped := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(stopped)
+	}()
+	for done := false; !done; {
+		if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-stopped:
+			done = true
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if want := []string{"pre", "deregister", "post"}; !slices.Equal(events.list(), want) {
+		t.Fatalf("stop ran %q, want %q", events.list(), want)
+	}
+	if registered(t, client, s) {
+		t.Fatal("instance is still registered after the signal")
+	}
+}
+
+func TestContextStopsService(t *testing.T) {
+	var events eventLog
+	useRegistry(t, &events)
+	ctx, cancel := context.WithCancel(context.Background())
+	reg := registry.Registration{ServiceName: "Lifecycle", ServiceUrl: "http://localhost:9100", InstanceID: "Lifecycle-1"}
+	s, err := Start(ctx, "127.0.0.1", "0", reg, func(*http.ServeMux) {}, WithSignals(), OnPostShutdown(events.hook("post")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := waitStopped(t, s); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if want := []string{"deregister", "post"}; !slices.Equal(events.list(), want) {
+		t.Fatalf("stop ran %q, want %q", events.list(), want)
+	}
+}
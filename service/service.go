@@ -2,45 +2,142 @@ package service
 
 import (
 	"context"
-	"fmt"
+	"crypto/tls"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"syscall"
+	"time"
 
 	"github.com/linshule/go-distributed/registry"
+	"github.com/linshule/go-distributed/tlsutil"
 )
 
-func Start(ctx context.Context, host, port string, reg registry.Registration, registerHandlersFunc func()) (context.Context, error) {
-	registerHandlersFunc()
-	ctx = startServer(ctx, reg.ServiceName, host, port)
-	err := registry.RegistrationService(reg)
+// maxReregisterBackoff 重新注册失败时的最长重试间隔
+const maxReregisterBackoff = 30 * time.Second
+
+// RegisterFunc 在服务的 ServeMux 上注册HTTP处理器
+type RegisterFunc func(mux *http.ServeMux)
+
+// Legacy 把旧式的、向 http.DefaultServeMux 注册处理器的函数转换为 RegisterFunc
+// 服务的 ServeMux 会把没有单独注册的路径交给 http.DefaultServeMux 处理
+//
+// Deprecated: 直接在传入的 ServeMux 上注册处理器。
+func Legacy(registerHandlersFunc func()) RegisterFunc {
+	return func(mux *http.ServeMux) {
+		registerHandlersFunc()
+		mux.Handle("/", http.DefaultServeMux)
+	}
+}
+
+// Start 启动HTTP服务并注册到注册中心，返回运行中的服务
+// 除了 registerHandlersFunc 注册的处理器，服务还会提供 /health/live、/health/ready（/health）、/info 和 /breakers
+// reg.Dependencies 中的服务都出现健康实例之前 /health/ready 返回 503，见 WithDependencyPolicy
+// 服务在收到 SIGINT/SIGTERM、ctx 结束或调用 Stop 时先注销再停止，见 Service.Stop
+func Start(ctx context.Context, host, port string, reg registry.Registration, registerHandlersFunc RegisterFunc, opts ...Option) (*Service, error) {
+	o := options{
+		gracePeriod:       DefaultGracePeriod,
+		signals:           []os.Signal{os.Interrupt, syscall.SIGTERM},
+		dependencyTimeout: DefaultDependencyTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	// 没有指定命名空间时使用客户端配置的命名空间（-registry-namespace 或 REGISTRY_NAMESPACE）
+	if reg.Namespace == "" {
+		reg.Namespace = registry.DefaultConfig().Namespace
+	}
+	if reg.InstanceID == "" {
+		reg.InstanceID = registry.NewInstanceIDIn(reg.Namespace, reg.ServiceName, reg.ServiceUrl)
+	}
+	s := &Service{
+		reg:       reg,
+		opts:      o,
+		done:      make(chan struct{}),
+		startedAt: time.Now(),
+		checks:    o.checks,
+	}
+	// 每个服务使用自己的 ServeMux，同一个进程中可以运行多个服务
+	// 健康检查和 /info 先挂载，服务自己注册的 "/" 不会覆盖它们
+	mux := http.NewServeMux()
+	s.mountHealth(mux)
+	registerHandlersFunc(mux)
+	// 注册、心跳和注销都发往实例所在的命名空间，并带上 REGISTRY_TOKEN 中的ACL令牌
+	client := registry.NewDiscoveryClient(reg.Namespace)
+	// 配置了证书时以 HTTPS 提供服务，见 tlsutil
+	var tlsConfig *tls.Config
+	if cfg := tlsutil.Current(); cfg.Enabled() {
+		var err error
+		if tlsConfig, err = cfg.ServerConfig(); err != nil {
+			return nil, err
+		}
+	}
+	// 先监听端口，端口被占用时直接返回错误，不会注册一个无法访问的实例
+	ln, err := net.Listen("tcp", host+":"+port)
 	if err != nil {
-		return ctx, err
+		return nil, err
 	}
-	return ctx, nil
+	s.client = client
+	s.server = &http.Server{Addr: ln.Addr().String(), Handler: mux, TLSConfig: tlsConfig}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	go s.serve(ln)
+	if err := client.RegistrationService(s.ctx, reg); err != nil {
+		s.cancel()
+		s.server.Close()
+		return nil, err
+	}
+	go heartbeat(s.ctx, client, reg)
+	go s.handleSignals()
+	go s.waitDependencies()
+	log.Printf("%v started on %s\n", reg.ServiceName, s.server.Addr)
+	return s, nil
 }
 
-func startServer(ctx context.Context, serviceName registry.ServiceName, host, port string) context.Context {
-	ctx, cancel := context.WithCancel(ctx)
-	var srv http.Server
-	srv.Addr = host + ":" + port
-	go func() {
-		log.Println(srv.ListenAndServe())
-		err := registry.ShutdownService(fmt.Sprintf("http://%s:%s", host, port))
-		if err != nil {
-			log.Println(err)
+// heartbeat 定期向注册中心续约，间隔为租约时长的三分之一，ctx 结束时停止
+// 心跳失败或注册中心找不到本实例（例如注册中心重启后丢失了数据）时，用原来的注册信息重新注册，
+// 重新注册失败时按指数退避重试，成功后恢复心跳
+func heartbeat(ctx context.Context, client *registry.Client, reg registry.Registration) {
+	interval := reg.Lease() / 3
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	registered := true
+	backoff := time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if registered {
+			err := client.Heartbeat(ctx, reg.InstanceID)
+			if err == nil {
+				timer.Reset(interval)
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, registry.ErrNotFound) {
+				log.Printf("%v instance %s is not in the registry, re-registering\n", reg.ServiceName, reg.InstanceID)
+			} else {
+				log.Printf("%v heartbeat failed, re-registering: %v\n", reg.ServiceName, err)
+			}
+			registered = false
+			backoff = time.Second
 		}
-		cancel()
-	}()
-	go func() {
-		fmt.Printf("%v started.Press any key to stop.\n", serviceName)
-		var s string
-		fmt.Scanln(&s)
-		err := registry.ShutdownService(fmt.Sprintf("http://%s:%s", host, port))
-		if err != nil {
-			log.Println(err)
+		if err := client.RegistrationService(ctx, reg); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("%v re-registration failed, retrying in %v: %v\n", reg.ServiceName, backoff, err)
+			timer.Reset(backoff)
+			backoff = min(backoff*2, maxReregisterBackoff)
+			continue
 		}
-		srv.Shutdown(ctx)
-		cancel()
-	}()
-	return ctx
+		log.Printf("%v re-registered as %s\n", reg.ServiceName, reg.InstanceID)
+		registered = true
+		timer.Reset(interval)
+	}
 }
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linshule/go-distributed/registry"
+)
+
+// bouncingRegistry 进程内的注册中心，可以停止或者换成一个空的新实例，模拟注册中心重启
+type bouncingRegistry struct {
+	mutex  sync.Mutex
+	server *registry.Server // 停止时为 nil，请求返回 503
+}
+
+func (b *bouncingRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mutex.Lock()
+	server := b.server
+	b.mutex.Unlock()
+	if server == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	server.ServeHTTP(w, r)
+}
+
+// restart 换成一个没有任何数据的新注册中心
+func (b *bouncingRegistry) restart() *registry.Server {
+	server := registry.NewServer()
+	b.mutex.Lock()
+	b.server = server
+	b.mutex.Unlock()
+	return server
+}
+
+func (b *bouncingRegistry) stop() {
+	b.mutex.Lock()
+	b.server = nil
+	b.mutex.Unlock()
+}
+
+// startHeartbeat 注册实例并启动心跳，返回注册中心和实例信息
+func startHeartbeat(t *testing.T) (*bouncingRegistry, *registry.Client, registry.Registration) {
+	t.Helper()
+	b := &bouncingRegistry{}
+	b.restart()
+	ts := httptest.NewServer(b)
+	t.Cleanup(ts.Close)
+
+	client := registry.NewClient(registry.ClientConfig{Addresses: []string{ts.URL}, Timeout: time.Second, MaxRetries: -1})
+	reg := registry.Registration{
+		ServiceName: "TestService",
+		ServiceUrl:  "http://localhost:9100",
+		InstanceID:  "test-1",
+		LeaseTTL:    1,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := client.RegistrationService(ctx, reg); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		heartbeat(ctx, client, reg)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return b, client, reg
+}
+
+// waitRegistered 等待实例出现在注册中心中
+func waitRegistered(t *testing.T, client *registry.Client, reg registry.Registration) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := client.Heartbeat(ctx, reg.InstanceID)
+		cancel()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was not re-registered: %v", reg.InstanceID, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestHeartbeatReregistersAfterRegistryRestart(t *testing.T) {
+	b, client, reg := startHeartbeat(t)
+
+	// 注册中心重启后丢失了数据，下一次心跳返回 404，服务重新注册
+	b.restart()
+	waitRegistered(t, client, reg)
+}
+
+func TestHeartbeatReregistersAfterRegistryOutage(t *testing.T) {
+	b, client, reg := startHeartbeat(t)
+
+	// 注册中心停止期间心跳和重新注册都失败，恢复后服务重新注册
+	b.stop()
+	time.Sleep(reg.Lease())
+	b.restart()
+	waitRegistered(t, client, reg)
+}
+
+// get 请求服务上的 path，返回状态码和响应体
+func get(t *testing.T, s *Service, path string) (int, string) {
+	t.Helper()
+	res, err := http.Get("http://" + s.server.Addr + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+func TestServicesHaveSeparateMuxes(t *testing.T) {
+	var events eventLog
+	useRegistry(t, &events)
+	handlers := func(name string) RegisterFunc {
+		return func(mux *http.ServeMux) {
+			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, name)
+			})
+		}
+	}
+	// 同一个进程中的两个服务注册相同的路径不会冲突
+	a := startService(t, "ServiceA", handlers("a"))
+	b := startService(t, "ServiceB", handlers("b"))
+	for s, want := range map[*Service]string{a: "a", b: "b"} {
+		if code, body := get(t, s, "/anything"); code != http.StatusOK || body != want {
+			t.Fatalf("%s served %d %q, want %q", s.reg.ServiceName, code, body, want)
+		}
+		// 服务注册的 "/" 不会覆盖健康检查和 /info
+		for _, path := range []string{"/health/live", "/info"} {
+			if code, body := get(t, s, path); code != http.StatusOK || body == want {
+				t.Fatalf("%s %s served %d %q from the service handler", s.reg.ServiceName, path, code, body)
+			}
+		}
+	}
+}
+
+func TestLegacyHandlers(t *testing.T) {
+	var events eventLog
+	useRegistry(t, &events)
+	path := "/legacy-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	s := startService(t, "Legacy", Legacy(func() {
+		http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "legacy")
+		})
+	}))
+	if code, body := get(t, s, path); code != http.StatusOK || body != "legacy" {
+		t.Fatalf("legacy handler served %d %q", code, body)
+	}
+	if code, _ := get(t, s, "/health/live"); code != http.StatusOK {
+		t.Fatalf("/health/live behind a legacy mux returned %d", code)
+	}
+}
@@ -0,0 +1,183 @@
+// Package tlsutil 服务之间以及服务与注册中心之间的 TLS / mTLS 配置
+//
+// 配置默认从环境变量读取，三个文件都不设置时使用普通 HTTP：
+//
+//	TLS_CA_FILE         信任的CA证书，用于校验对端证书
+//	TLS_CERT_FILE       本服务的证书，既作为服务端证书，也在访问其他服务时作为客户端证书
+//	TLS_KEY_FILE        本服务的私钥
+//	TLS_VERIFY_CLIENTS  为 true 时服务端要求客户端出示由CA签发的证书（mTLS）
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// 环境变量名
+const (
+	EnvCAFile        = "TLS_CA_FILE"
+	EnvCertFile      = "TLS_CERT_FILE"
+	EnvKeyFile       = "TLS_KEY_FILE"
+	EnvVerifyClients = "TLS_VERIFY_CLIENTS"
+)
+
+// Config TLS配置
+type Config struct {
+	CAFile        string // 信任的CA证书
+	CertFile      string // 本服务的证书
+	KeyFile       string // 本服务的私钥
+	VerifyClients bool   // 服务端是否要求并校验客户端证书
+}
+
+// FromEnv 从环境变量读取配置
+func FromEnv() Config {
+	verify, _ := strconv.ParseBool(os.Getenv(EnvVerifyClients))
+	return Config{
+		CAFile:        os.Getenv(EnvCAFile),
+		CertFile:      os.Getenv(EnvCertFile),
+		KeyFile:       os.Getenv(EnvKeyFile),
+		VerifyClients: verify,
+	}
+}
+
+// Enabled 是否启用TLS
+func (c Config) Enabled() bool {
+	return c.CAFile != "" || c.CertFile != "" || c.KeyFile != ""
+}
+
+// Scheme 返回服务地址使用的协议
+func (c Config) Scheme() string {
+	if c.Enabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// ServerConfig 生成服务端的TLS配置
+// 配置了CA时总是校验客户端出示的证书，VerifyClients 为 true 时客户端必须出示证书
+func (c Config) ServerConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("tls: certificate and key are required to serve TLS")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.CAFile != "" {
+		pool, err := loadPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if c.VerifyClients {
+		if c.CAFile == "" {
+			return nil, errors.New("tls: a CA is required to verify clients")
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// ClientConfig 生成客户端的TLS配置，配置了证书时在握手中出示它
+func (c Config) ClientConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		pool, err := loadPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func loadPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("tls: no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+var (
+	mutex   sync.RWMutex
+	current Config
+	client  = http.DefaultClient
+)
+
+func init() {
+	if err := Configure(FromEnv()); err != nil {
+		log.Println("Invalid TLS configuration:", err)
+	}
+}
+
+// Configure 设置进程使用的TLS配置，替换从环境变量读取的配置
+// 客户端配置无效时返回错误，此时 Client 仍然使用之前的配置
+func Configure(c Config) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	current = c
+	if !c.Enabled() {
+		client = http.DefaultClient
+		return nil
+	}
+	cfg, err := c.ClientConfig()
+	if err != nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	client = &http.Client{Transport: transport}
+	return nil
+}
+
+// Current 返回进程当前的TLS配置
+func Current() Config {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return current
+}
+
+// Client 返回按当前配置访问其他服务的 HTTP 客户端，没有启用TLS时就是 http.DefaultClient
+func Client() *http.Client {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return client
+}
+
+// Scheme 返回当前配置下服务地址使用的协议
+func Scheme() string {
+	return Current().Scheme()
+}
+
+// PeerIdentity 返回请求方客户端证书中的服务名称（CN），没有出示证书时返回空字符串
+func PeerIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
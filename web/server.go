@@ -7,6 +7,7 @@ import (
 	"net/http"
 
 	"github.com/linshule/go-distributed/registry"
+	"github.com/linshule/go-distributed/tlsutil"
 )
 
 var webPage = `
@@ -132,7 +133,7 @@ var webPage = `
             <h2>服务列表</h2>
             <button onclick="refreshServices()">刷新服务列表</button>
             <div id="services"></div>
-            <div class="refresh-info">点击"刷新服务列表"查看已注册的服务</div>
+            <div class="refresh-info">服务列表通过注册中心事件流自动更新，也可以点击"刷新服务列表"手动刷新</div>
         </div>
 
         <div class="section">
@@ -153,28 +154,58 @@ var webPage = `
     </div>
 
     <script>
+        // 以实例ID为键的服务列表，由事件流增量更新
+        let services = {};
+
+        function renderServices() {
+            const list = Object.values(services);
+            const container = document.getElementById('services');
+            if (list.length === 0) {
+                container.innerHTML = '<p>暂无注册服务</p>';
+            } else {
+                container.innerHTML = list.map(s =>
+                    '<div class="service-card">' +
+                        '<span class="service-name">' + s.serviceName + '</span>' +
+                        '<span class="status online">在线</span>' +
+                        '<div class="service-url">' + s.serviceUrl + '</div>' +
+                    '</div>'
+                ).join('');
+            }
+        }
+
         async function refreshServices() {
             try {
                 const response = await fetch('/services');
-                const services = await response.json();
-                const container = document.getElementById('services');
-                if (services.length === 0) {
-                    container.innerHTML = '<p>暂无注册服务</p>';
-                } else {
-                    container.innerHTML = services.map(s =>
-                        '<div class="service-card">' +
-                            '<span class="service-name">' + s.serviceName + '</span>' +
-                            '<span class="status online">在线</span>' +
-                            '<div class="service-url">' + s.serviceUrl + '</div>' +
-                        '</div>'
-                    ).join('');
-                }
+                const list = await response.json();
+                services = {};
+                list.forEach(s => services[s.instanceId] = s);
+                renderServices();
             } catch (error) {
                 console.error('Error:', error);
                 document.getElementById('services').innerHTML = '<p class="error">获取服务列表失败</p>';
             }
         }
 
+        function watchServices() {
+            const source = new EventSource('/events');
+            const upsert = e => {
+                const ev = JSON.parse(e.data);
+                services[ev.registration.instanceId] = ev.registration;
+                renderServices();
+            };
+            const remove = e => {
+                const ev = JSON.parse(e.data);
+                delete services[ev.registration.instanceId];
+                renderServices();
+            };
+            source.addEventListener('registered', upsert);
+            source.addEventListener('updated', upsert);
+            source.addEventListener('health-changed', upsert);
+            source.addEventListener('deregistered', remove);
+            source.addEventListener('expired', remove);
+            source.addEventListener('reset', refreshServices);
+        }
+
         async function sendLog() {
             const message = document.getElementById('log-message').value;
             if (!message) {
@@ -228,16 +259,19 @@ var webPage = `
             el.style.display = 'block';
         }
 
-        // 页面加载时自动刷新服务列表
-        window.onload = refreshServices;
+        // 页面加载时获取服务列表，之后通过事件流更新
+        window.onload = () => {
+            refreshServices();
+            watchServices();
+        };
     </script>
 </body>
 </html>
 `
 
-// RegisterHandlers 注册HTTP处理器
-func RegisterHandlers() {
-	http.HandleFunc("/", serveHTTP)
+// RegisterHandlers 在 mux 上注册HTTP处理器
+func RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/", serveHTTP)
 }
 
 func serveHTTP(w http.ResponseWriter, r *http.Request) {
@@ -268,9 +302,21 @@ func serveHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 转发注册中心的事件流
+	if path == "/events" {
+		proxyEvents(w, r)
+		return
+	}
+
 	// 处理代理路径
 	if path == "/proxy/log" {
-		resp, err := http.Post("http://localhost:4000/log", "text/plain", r.Body)
+		target, err := serviceURL(registry.LogService, "/log")
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		resp, err := tlsutil.Client().Post(target, "text/plain", r.Body)
 		if err != nil {
 			w.WriteHeader(http.StatusBadGateway)
 			return
@@ -282,7 +328,13 @@ func serveHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if path == "/proxy/books" {
-		resp, err := http.Get("http://localhost:5000/library/books")
+		target, err := serviceURL(registry.LibraryService, "/library/books")
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		resp, err := tlsutil.Client().Get(target)
 		if err != nil {
 			w.WriteHeader(http.StatusBadGateway)
 			return
@@ -294,7 +346,13 @@ func serveHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if path == "/proxy/borrow" {
-		resp, err := http.Get("http://localhost:5000/library/borrow")
+		target, err := serviceURL(registry.LibraryService, "/library/borrow")
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		resp, err := tlsutil.Client().Get(target)
 		if err != nil {
 			w.WriteHeader(http.StatusBadGateway)
 			return
@@ -307,3 +365,55 @@ func serveHTTP(w http.ResponseWriter, r *http.Request) {
 
 	http.NotFound(w, r)
 }
+
+// proxyEvents 把注册中心的 SSE 事件流转发给浏览器
+func proxyEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, registry.EventsURL(), nil)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		req.Header.Set("Last-Event-ID", id)
+	}
+	if token := registry.Token(); token != "" {
+		req.Header.Set(registry.TokenHeader, token)
+	}
+	resp, err := tlsutil.Client().Do(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(resp.StatusCode)
+	buf := make([]byte, 4096)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			flusher.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// serviceURL 从注册中心查找健康的服务实例，返回 path 对应的完整地址
+func serviceURL(name registry.ServiceName, path string) (string, error) {
+	reg, err := registry.FindService(name, registry.Passing())
+	if err != nil {
+		return "", err
+	}
+	return reg.ServiceUrl + path, nil
+}